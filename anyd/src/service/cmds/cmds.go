@@ -3,10 +3,8 @@ package cmds
 import (
 	"github.com/BurntSushi/toml"
 	"net/http"
-	"net/smtp"
 	"runtime/debug"
 	"service/dlog"
-	"strings"
 	"syscall"
 )
 
@@ -71,6 +69,9 @@ func Uninit() {
 func SafeHandler(handler http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		dlog.Printf("%(+v)\n", req)
+		if peer := PeerIdentity(req); peer != "" {
+			dlog.Printf("client certificate %s, %s\n", peer, req.URL.Path)
+		}
 		defer func() {
 			if err, ok := recover().(error); ok {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -100,17 +101,3 @@ func DiskUsage(path string) (disk DiskStatus) {
 	disk.Used = disk.All - disk.Free
 	return
 }
-
-func SendMail(subject, body string) error {
-	user := "cxw_eric@126.com"
-	password := "abc123"
-	host := "smtp.126.com:25"
-	hp := strings.Split(host, ":")
-	auth := smtp.PlainAuth("", user, password, hp[0])
-	content_type := "Content-Type: text/plain" + "; charset=UTF-8"
-	to := "cxw_eric@126.com"
-	msg := []byte("To: " + to + "\r\nFrom: " + user + "\r\nSubject: " + subject + "\r\n" + content_type + "\r\n\r\n" + body)
-	send_to := strings.Split(to, ";")
-	err := smtp.SendMail(host, auth, user, send_to, msg)
-	return err
-}
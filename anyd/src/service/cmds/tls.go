@@ -0,0 +1,107 @@
+package cmds
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// TLSConfig
+// ClientAuth is "request" to verify client certificates when given, or
+// "require" to refuse clients without one. it defaults to "require" once a
+// client CA is configured.
+type TLSConfig struct {
+	CertFile   string `toml:"cert_file"`
+	KeyFile    string `toml:"key_file"`
+	ClientCA   string `toml:"client_ca"`
+	ClientAuth string `toml:"client_auth"`
+}
+
+func (tc *TLSConfig) Enabled() bool {
+	return tc.CertFile != "" || tc.KeyFile != ""
+}
+
+// CertReloader
+// serves the certificate loaded from disk, Reload swaps it without
+// dropping the listener.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.lock.Lock()
+	cr.cert = &cert
+	cr.lock.Unlock()
+	return nil
+}
+
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return cr.cert, nil
+}
+
+func NewServerTLSConfig(tc *TLSConfig) (*tls.Config, *CertReloader, error) {
+	if tc.CertFile == "" || tc.KeyFile == "" {
+		return nil, nil, errors.New("tls needs both cert_file and key_file")
+	}
+	reloader, err := NewCertReloader(tc.CertFile, tc.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12}
+	if tc.ClientCA != "" {
+		data, err := ioutil.ReadFile(tc.ClientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, nil, fmt.Errorf("no certificate found in %s", tc.ClientCA)
+		}
+	}
+	switch tc.ClientAuth {
+	case "":
+		if config.ClientCAs != nil {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	case "request":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, nil, fmt.Errorf("invalid client_auth %s", tc.ClientAuth)
+	}
+	if config.ClientAuth != tls.NoClientCert && config.ClientCAs == nil {
+		return nil, nil, errors.New("client_auth needs client_ca")
+	}
+	return config, reloader, nil
+}
+
+// PeerIdentity
+// the common name of the verified client certificate, empty without one.
+func PeerIdentity(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return req.TLS.VerifiedChains[0][0].Subject.CommonName
+}
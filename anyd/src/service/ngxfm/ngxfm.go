@@ -15,9 +15,11 @@ import (
 	"service/cmds"
 	"service/dlog"
 	_ "service/files"
+	"service/notify"
 	_ "service/qianke"
 	_ "service/sandbox"
 	_ "service/url2name"
+	"syscall"
 	// "sync"
 )
 
@@ -64,20 +66,32 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
+	err = notify.InitNotifyConf(config, md)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
 	err = cmds.InitHandlerConf(config, md)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	var reloader *cmds.CertReloader
 	cmdServer := &http.Server{Addr: fmConf.HttpListenAddr, Handler: cmds.CmdServerMux}
-	err = cmdServer.ListenAndServe()
-	if err != nil {
-		fmt.Printf("%s", err.Error())
+	if fmConf.TLSConfig.Enabled() {
+		cmdServer.TLSConfig, reloader, err = cmds.NewServerTLSConfig(&fmConf.TLSConfig)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
 	}
 	// var wg sync.WaitGroup
 	// wg.Add(1)
 	go func() {
-		cmdServer := &http.Server{Addr: fmConf.HttpListenAddr, Handler: cmds.CmdServerMux}
-		err = cmdServer.ListenAndServe()
+		var err error
+		if cmdServer.TLSConfig != nil {
+			err = cmdServer.ListenAndServeTLS("", "")
+		} else {
+			err = cmdServer.ListenAndServe()
+		}
 		if err != nil {
 			fmt.Printf("%s", err.Error())
 		}
@@ -98,10 +112,20 @@ func main() {
 	}()
 	// wg.Wait()
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGHUP)
 
-	// Block until a signal is received.
+	// Block until a signal is received, SIGHUP only reloads the certificate.
 	s := <-c
+	for ; s == syscall.SIGHUP; s = <-c {
+		if reloader == nil {
+			continue
+		}
+		if err = reloader.Reload(); err != nil {
+			dlog.EPrintf("reload certificate failed: %s\n", err.Error())
+			continue
+		}
+		dlog.Printf("certificate reloaded\n")
+	}
 	cmds.Uninit()
 	dlog.Printf("Accept %s signal, quit server...\n", s.String())
 }
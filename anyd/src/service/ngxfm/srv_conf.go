@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"service/cmds"
 )
 
 type BasicSvrConfig struct {
@@ -15,6 +16,7 @@ type BasicSvrConfig struct {
 }
 type FmdConfig struct {
 	BasicSvrConfig
+	cmds.TLSConfig
 	FastcgiListenAddr string `toml:"fastcgi_listen_addr"`
 	HttpListenAddr    string `toml:"http_listen_addr"`
 }
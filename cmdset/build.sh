@@ -13,7 +13,8 @@ gofmt -w src
 
 # go build ./src/examples/testtoml.go
 
-go install service
+VERSION=`git describe --always --dirty 2>/dev/null || echo dev`
+go install -ldflags "-X main.Version=$VERSION" service
 
 if [ ! -f ./bin/service ]; then
 echo 'do not exist ./bin/service file.'
@@ -22,6 +23,8 @@ fi
 
 mv ./bin/service ./bin/cmdServer
 
+go install cmdctl
+
 export GOPATH="$OLDGOPATH"
 
 echo 'finished'
\ No newline at end of file
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmdproto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-etcd/etcd"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	etcdAddrs  = flag.String("etcd", "http://127.0.0.1:2379", "comma separated etcd addresses agents register to.")
+	configDir  = flag.String("dir", "/cmds", "etcd directory agents register under.")
+	hostList   = flag.String("hosts", "", "comma separated ip:port list, skips etcd discovery.")
+	hostFilter = flag.String("filter", "", "only send to agents whose address matches this regexp.")
+	reqType    = flag.String("type", "sys", "request type: sys, mgo or sc.")
+	op         = flag.String("op", "syscmd", "request op, or mongo command for -type mgo.")
+	db         = flag.String("db", "admin", "database for -type mgo.")
+	service    = flag.String("service", "", "service name for -type sc.")
+	stderr     = flag.String("stderr", "", "\"merge\" to interleave stderr for -type sys.")
+	data       = flag.String("d", "", "raw request body, overrides -op and arguments.")
+	parallel   = flag.Int("parallel", 16, "max agents requested at the same time.")
+	timeout    = flag.Duration("timeout", time.Minute, "per agent request timeout.")
+	token      = flag.String("token", "", "bearer token.")
+	keyName    = flag.String("key", "", "token name for signed requests.")
+	secret     = flag.String("secret", "", "token secret for signed requests.")
+	caFile     = flag.String("cacert", "", "ca certificate to verify agents with.")
+	certFile   = flag.String("cert", "", "client certificate.")
+	keyFile    = flag.String("certkey", "", "client certificate key.")
+	quiet      = flag.Bool("q", false, "do not print agent output, only the summary.")
+)
+
+var handlerNames = map[string]string{"sys": "syscmd", "mgo": "mongo", "sc": "sctl"}
+
+type agent struct {
+	Addr string
+	Info *cmdproto.AgentInfo
+}
+
+type result struct {
+	Addr     string
+	Status   string
+	Code     int
+	ExitCode string
+	Duration time.Duration
+	Err      string
+}
+
+var outLock sync.Mutex
+
+func discoverAgents(handler string) ([]agent, error) {
+	var agents []agent
+	if *hostList != "" {
+		for _, host := range strings.Split(*hostList, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				agents = append(agents, agent{Addr: host})
+			}
+		}
+		return agents, nil
+	}
+	client := etcd.NewClient(strings.Split(*etcdAddrs, ","))
+	resp, err := client.Get(*configDir, true, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range resp.Node.Nodes {
+		if node.Dir {
+			continue
+		}
+		info := &cmdproto.AgentInfo{}
+		if err := json.Unmarshal([]byte(node.Value), info); err != nil {
+			// agents registered before the metadata was added only store ip:port.
+			agents = append(agents, agent{Addr: node.Value})
+			continue
+		}
+		if !hasHandler(info, handler) {
+			continue
+		}
+		agents = append(agents, agent{Addr: info.Addr, Info: info})
+	}
+	return agents, nil
+}
+
+func hasHandler(info *cmdproto.AgentInfo, handler string) bool {
+	for _, name := range info.Handlers {
+		if name == handler {
+			return true
+		}
+	}
+	return false
+}
+
+func buildBody(args []string) ([]byte, error) {
+	if *data != "" {
+		return []byte(*data), nil
+	}
+	switch *reqType {
+	case "sys":
+		req := &cmdproto.SysRequest{Op: *op, Args: args}
+		req.Options.Stderr = *stderr
+		return json.Marshal(req)
+	case "mgo":
+		req := &cmdproto.MgoRequest{DB: *db}
+		req.DBCmd.DBCmd = *op
+		req.DBCmd.Args = args
+		return json.Marshal(req)
+	case "sc":
+		req := &cmdproto.ScRequest{Op: *op}
+		req.ServiceInfo.Service = *service
+		req.ServiceInfo.Args = args
+		return json.Marshal(req)
+	}
+	return nil, fmt.Errorf("invalid request type %s", *reqType)
+}
+
+func newHTTPClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if *caFile != "" {
+		pem, err := ioutil.ReadFile(*caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", *caFile)
+		}
+	}
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Timeout: *timeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}}, nil
+}
+
+func newNonce() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func sendRequest(client *http.Client, ag agent, handler string, body []byte) *result {
+	res := &result{Addr: ag.Addr}
+	start := time.Now()
+	defer func() {
+		res.Duration = time.Since(start)
+	}()
+
+	scheme := "http"
+	if *caFile != "" || *certFile != "" || (ag.Info != nil && ag.Info.TLS) {
+		scheme = "https"
+	}
+	req, err := http.NewRequest("POST", scheme+"://"+ag.Addr+"/"+handler, bytes.NewReader(body))
+	if err != nil {
+		res.Status, res.Err = "failed", err.Error()
+		return res
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	} else if *keyName != "" {
+		timestamp, nonce := strconv.FormatInt(time.Now().Unix(), 10), newNonce()
+		req.Header.Set("X-Cmd-Key", *keyName)
+		req.Header.Set("X-Cmd-Timestamp", timestamp)
+		req.Header.Set("X-Cmd-Nonce", nonce)
+		req.Header.Set("X-Cmd-Signature",
+			cmdproto.SignRequest(*secret, "POST", req.URL.RequestURI(), timestamp, nonce, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		res.Status, res.Err = failure(err), err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+	res.Code = resp.StatusCode
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 && !*quiet {
+			outLock.Lock()
+			fmt.Printf("%s | %s", ag.Addr, line)
+			if !strings.HasSuffix(line, "\n") {
+				fmt.Println()
+			}
+			outLock.Unlock()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			res.Status, res.Err = failure(err), err.Error()
+			return res
+		}
+	}
+
+	res.ExitCode = resp.Trailer.Get("X-Cmd-Exit-Code")
+	switch {
+	case resp.StatusCode != http.StatusOK:
+		res.Status, res.Err = "failed", http.StatusText(resp.StatusCode)
+	case res.ExitCode != "" && res.ExitCode != "0":
+		res.Status = "failed"
+		if sig := resp.Trailer.Get("X-Cmd-Signal"); sig != "" {
+			res.Err = "signal " + sig
+		}
+	default:
+		res.Status = "ok"
+	}
+	return res
+}
+
+func failure(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "failed"
+}
+
+func printSummary(results []*result) (failed int) {
+	sort.Slice(results, func(i, j int) bool { return results[i].Addr < results[j].Addr })
+	counts := make(map[string]int)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tSTATUS\tHTTP\tEXIT\tTIME\tERROR")
+	for _, res := range results {
+		counts[res.Status]++
+		code := "-"
+		if res.Code > 0 {
+			code = strconv.Itoa(res.Code)
+		}
+		exitCode := res.ExitCode
+		if exitCode == "" {
+			exitCode = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", res.Addr, res.Status, code, exitCode,
+			res.Duration.Round(time.Millisecond), res.Err)
+	}
+	tw.Flush()
+	fmt.Printf("%d agents: %d ok, %d failed, %d timeout\n", len(results),
+		counts["ok"], counts["failed"], counts["timeout"])
+	return counts["failed"] + counts["timeout"]
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] [args...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	handler, ok := handlerNames[*reqType]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "invalid request type %s\n", *reqType)
+		os.Exit(2)
+	}
+	body, err := buildBody(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+	agents, err := discoverAgents(handler)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if *hostFilter != "" {
+		reg, err := regexp.Compile(*hostFilter)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(2)
+		}
+		filtered := agents[:0]
+		for _, ag := range agents {
+			if reg.MatchString(ag.Addr) {
+				filtered = append(filtered, ag)
+			}
+		}
+		agents = filtered
+	}
+	if len(agents) == 0 {
+		fmt.Fprintln(os.Stderr, "no agent found")
+		os.Exit(1)
+	}
+	client, err := newHTTPClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+	if *parallel < 1 {
+		*parallel = 1
+	}
+
+	results := make([]*result, len(agents))
+	sem := make(chan bool, *parallel)
+	var wg sync.WaitGroup
+	for i, ag := range agents {
+		wg.Add(1)
+		sem <- true
+		go func(i int, ag agent) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = sendRequest(client, ag, handler, body)
+		}(i, ag)
+	}
+	wg.Wait()
+
+	if printSummary(results) > 0 {
+		os.Exit(1)
+	}
+}
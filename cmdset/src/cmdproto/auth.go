@@ -0,0 +1,18 @@
+package cmdproto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// SignRequest
+// the X-Cmd-Signature of a request, sent along with X-Cmd-Key (the token
+// name), X-Cmd-Timestamp (unix seconds) and X-Cmd-Nonce.
+func SignRequest(secret, method, uri, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, uri, timestamp, nonce, hex.EncodeToString(sum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
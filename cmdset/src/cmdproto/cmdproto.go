@@ -1,10 +1,21 @@
 package cmdproto
 
+import (
+	"encoding/json"
+	"time"
+)
+
+// MgoRequest
+// Target names the [mongo.targets] entry the request is for, the default
+// target when empty. Options holds the further fields of the command
+// document of the run op, in mongo extended json.
 type MgoRequest struct {
-	DB    string `json:"db"`
-	DBCmd struct {
-		DBCmd string   `json:"cmd"`
-		Args  []string `json:"args,omitempty"`
+	Target string `json:"target,omitempty"`
+	DB     string `json:"db"`
+	DBCmd  struct {
+		DBCmd   string          `json:"cmd"`
+		Args    []string        `json:"args,omitempty"`
+		Options json.RawMessage `json:"options,omitempty"`
 	} `json:"cmd"`
 	//more...
 }
@@ -12,6 +23,140 @@ type MgoRequest struct {
 type MgoResponse struct {
 }
 
+// MgoHealth
+// the state of the session of a mongo target. Since is when it last
+// connected or lost the connection, Ping the round trip of the health check
+// itself.
+type MgoHealth struct {
+	Target         string    `json:"target"`
+	Connected      bool      `json:"connected"`
+	Reconnecting   bool      `json:"reconnecting"`
+	Since          time.Time `json:"since"`
+	Reconnects     int       `json:"reconnects"`
+	LastError      string    `json:"last_error,omitempty"`
+	Addrs          []string  `json:"addrs"`
+	LiveServers    []string  `json:"live_servers"`
+	ReadPreference string    `json:"read_preference"`
+	Ping           float64   `json:"ping"`
+	PingError      string    `json:"ping_error,omitempty"`
+	PoolSize       int       `json:"pool_size"`
+	PoolFree       int       `json:"pool_free"`
+}
+
+// RetentionReport
+// what the retention rules of DB dropped, or would drop on a DryRun. Kept
+// counts the collections matched by a rule that stay.
+type RetentionReport struct {
+	Time        time.Time         `json:"time"`
+	DB          string            `json:"db"`
+	DryRun      bool              `json:"dry_run,omitempty"`
+	FreePercent int               `json:"free_percent"`
+	Dropped     []RetentionAction `json:"dropped"`
+	Kept        int               `json:"kept"`
+	Errors      []string          `json:"errors,omitempty"`
+}
+
+// RetentionAction
+// one collection dropped by Rule, Date is the date taken from its name and
+// Bytes its storage size. Error is set when the drop failed.
+type RetentionAction struct {
+	Collection string `json:"collection"`
+	Rule       string `json:"rule"`
+	Date       string `json:"date"`
+	Bytes      int64  `json:"bytes"`
+	Reason     string `json:"reason"`
+	Archive    string `json:"archive,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// RSStatus
+// the last check of the replica set monitor. Lag of a secondary is how far
+// its optime trails the primary, in seconds. OpsPerSec are the opcounters
+// rates since the previous check, Alerts the alert keys currently firing.
+type RSStatus struct {
+	Target         string             `json:"target"`
+	Running        bool               `json:"running"`
+	Checked        time.Time          `json:"checked"`
+	Error          string             `json:"error,omitempty"`
+	Set            string             `json:"set,omitempty"`
+	Primary        string             `json:"primary,omitempty"`
+	PrimaryChanges int                `json:"primary_changes"`
+	Members        []RSMember         `json:"members,omitempty"`
+	Connections    int64              `json:"connections"`
+	Available      int64              `json:"available"`
+	OpsPerSec      map[string]float64 `json:"ops_per_sec,omitempty"`
+	Alerts         []string           `json:"alerts"`
+}
+
+type RSMember struct {
+	Name   string    `json:"name"`
+	State  string    `json:"state"`
+	Health float64   `json:"health"`
+	Optime time.Time `json:"optime"`
+	Lag    float64   `json:"lag"`
+	Self   bool      `json:"self,omitempty"`
+}
+
+// ArchiveManifest
+// describes the archive File of DB.Collection, written next to it as
+// Name.manifest.json. Documents and Bytes count the archived documents and
+// their bson size, Size and Sha256 are those of the compressed File.
+type ArchiveManifest struct {
+	Name       string      `json:"name"`
+	DB         string      `json:"db"`
+	Collection string      `json:"collection"`
+	Format     string      `json:"format"`
+	File       string      `json:"file"`
+	Documents  int64       `json:"documents"`
+	Bytes      int64       `json:"bytes"`
+	Size       int64       `json:"size"`
+	Sha256     string      `json:"sha256"`
+	Indexes    []IndexSpec `json:"indexes,omitempty"`
+	Time       time.Time   `json:"time"`
+}
+
+// IndexSpec
+// an index of a collection, Key fields prefixed with - are descending and
+// ExpireAfter is in seconds. Size is the index size from collStats. the
+// secondary indexes of an archived collection are recreated on restore.
+type IndexSpec struct {
+	Name        string   `json:"name"`
+	Key         []string `json:"key"`
+	Unique      bool     `json:"unique,omitempty"`
+	Sparse      bool     `json:"sparse,omitempty"`
+	ExpireAfter float64  `json:"expire_after,omitempty"`
+	Size        int64    `json:"size,omitempty"`
+}
+
+// CollInfo
+// the collStats of a collection, sizes in bytes.
+type CollInfo struct {
+	Name           string           `json:"name"`
+	Count          int64            `json:"count"`
+	Size           int64            `json:"size"`
+	StorageSize    int64            `json:"storage_size"`
+	AvgObjSize     int64            `json:"avg_obj_size"`
+	TotalIndexSize int64            `json:"total_index_size"`
+	IndexSizes     map[string]int64 `json:"index_sizes"`
+}
+
+// IndexBuild
+// an index build started by createIndex. State is running, done or failed,
+// Progress the message of the build in currentOp while it runs.
+type IndexBuild struct {
+	DB         string     `json:"db"`
+	Collection string     `json:"collection"`
+	Index      IndexSpec  `json:"index"`
+	Background bool       `json:"background"`
+	State      string     `json:"state"`
+	Started    time.Time  `json:"started"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Progress   string     `json:"progress,omitempty"`
+	Done       int64      `json:"done,omitempty"`
+	Total      int64      `json:"total,omitempty"`
+}
+
 //ScRequest
 //used to start, stop, monitor(and other actions) a service.
 type ScRequest struct {
@@ -25,6 +170,159 @@ type ScRequest struct {
 //SysRequest
 //used to execute nix command.
 type SysRequest struct {
-	Op   string   `json:"op"`
-	Args []string `json:"args"`
+	Op      string     `json:"op"`
+	Args    []string   `json:"args"`
+	JobId   string     `json:"job_id,omitempty"`
+	Options SysOptions `json:"options"`
+}
+
+// SysOptions
+// Stderr "merge" interleaves stderr into the streamed stdout, otherwise
+// stderr is only kept with the job. Footer appends an ExitFooterPrefix
+// line holding the ExitStatus once the stream ends. Threshold and Interval
+// (a duration like "30s") override the monitor defaults. Timeout (a
+// duration), CPUTime (seconds), Memory and MaxOutput (bytes), CPUs, Nice
+// and IONice ("best-effort:<0-7>" or "idle") limit the command within the
+// ceilings of the agent, the whole process group is killed once one is hit.
+type SysOptions struct {
+	Stderr    string  `json:"stderr,omitempty"`
+	Footer    bool    `json:"footer,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+	Interval  string  `json:"interval,omitempty"`
+	Timeout   string  `json:"timeout,omitempty"`
+	CPUTime   int64   `json:"cpu_time,omitempty"`
+	Memory    int64   `json:"memory,omitempty"`
+	CPUs      float64 `json:"cpus,omitempty"`
+	MaxOutput int64   `json:"max_output,omitempty"`
+	Nice      int     `json:"nice,omitempty"`
+	IONice    string  `json:"ionice,omitempty"`
+}
+
+const ExitFooterPrefix = "#cmd-exit "
+
+// ExitStatus
+// how a command finished, times are in seconds. Limit names the limit the
+// command was killed for: timeout, cpu_time, memory or max_output.
+type ExitStatus struct {
+	State    string  `json:"state"`
+	ExitCode int     `json:"exit_code"`
+	Signal   string  `json:"signal,omitempty"`
+	Limit    string  `json:"limit,omitempty"`
+	WallTime float64 `json:"wall_time"`
+	Rusage   Rusage  `json:"rusage"`
+}
+
+type Rusage struct {
+	UserTime float64 `json:"utime"`
+	SysTime  float64 `json:"stime"`
+	MaxRSS   int64   `json:"maxrss_kb"`
+	MinFlt   int64   `json:"minflt"`
+	MajFlt   int64   `json:"majflt"`
+	InBlock  int64   `json:"inblock"`
+	OuBlock  int64   `json:"oublock"`
+	NvCsw    int64   `json:"nvcsw"`
+	NivCsw   int64   `json:"nivcsw"`
+}
+
+// AuditRequest
+// Op is "query" or "verify". query returns the last Limit records matching
+// every filter given, From and To are RFC 3339 times and CmdOp the op of the
+// audited request.
+type AuditRequest struct {
+	Op      string `json:"op"`
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	Caller  string `json:"caller,omitempty"`
+	Handler string `json:"handler,omitempty"`
+	CmdOp   string `json:"cmd_op,omitempty"`
+	Limit   int    `json:"limit,omitempty"`
+}
+
+// AuditRecord
+// one line of the audit log. Hash is the sha256 of the line up to the hash
+// field, Prev the hash of the record before, so edits and removed records
+// break the chain. Duration is in seconds, Bytes the response body size.
+type AuditRecord struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Caller   string    `json:"caller,omitempty"`
+	Remote   string    `json:"remote"`
+	Handler  string    `json:"handler"`
+	Op       string    `json:"op,omitempty"`
+	Args     []string  `json:"args,omitempty"`
+	Status   int       `json:"status"`
+	JobId    string    `json:"job_id,omitempty"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+	Signal   string    `json:"signal,omitempty"`
+	Limit    string    `json:"limit,omitempty"`
+	Duration float64   `json:"duration"`
+	Bytes    int64     `json:"bytes"`
+	Prev     string    `json:"prev"`
+	Hash     string    `json:"hash,omitempty"`
+}
+
+// FileInfo
+// a file on the agent as returned by the file handler, Mode holds the octal
+// permission bits and Sha256 the hex digest when it was computed.
+type FileInfo struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	Uid     int       `json:"uid"`
+	Gid     int       `json:"gid"`
+	ModTime time.Time `json:"mod_time"`
+	Sha256  string    `json:"sha256,omitempty"`
+}
+
+// SchedRequest
+// Op is list, add, pause, resume, remove, results or tasks. add takes
+// Schedule, pause, resume and remove the schedule Id, results returns the
+// last Limit runs of Id.
+type SchedRequest struct {
+	Op       string    `json:"op"`
+	Id       string    `json:"id,omitempty"`
+	Limit    int       `json:"limit,omitempty"`
+	Schedule *Schedule `json:"schedule,omitempty"`
+}
+
+// Schedule
+// runs one of Sys, Mgo or the named Task with Args whenever Cron matches.
+// Cron has the five crontab fields, a macro like @daily, or "@every 10m".
+// runs are made on behalf of Owner, the caller that added the schedule.
+type Schedule struct {
+	Id      string      `json:"id"`
+	Name    string      `json:"name,omitempty"`
+	Cron    string      `json:"cron"`
+	Sys     *SysRequest `json:"sys,omitempty"`
+	Mgo     *MgoRequest `json:"mgo,omitempty"`
+	Task    string      `json:"task,omitempty"`
+	Args    []string    `json:"args,omitempty"`
+	Paused  bool        `json:"paused"`
+	Owner   string      `json:"owner,omitempty"`
+	Created time.Time   `json:"created"`
+}
+
+// SchedRun
+// the outcome of one run, Status is the http status of the dispatched
+// request and Output its first bytes. Skipped runs found the previous one
+// still running.
+type SchedRun struct {
+	Start     time.Time `json:"start"`
+	Duration  float64   `json:"duration"`
+	Status    int       `json:"status,omitempty"`
+	ExitCode  *int      `json:"exit_code,omitempty"`
+	Output    string    `json:"output,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Skipped   bool      `json:"skipped,omitempty"`
+}
+
+// AgentInfo
+// registered by each agent under config_dir/ip:port.
+type AgentInfo struct {
+	Addr      string    `json:"addr"`
+	Version   string    `json:"version"`
+	StartTime time.Time `json:"start_time"`
+	Handlers  []string  `json:"handlers"`
+	TLS       bool      `json:"tls"`
 }
@@ -0,0 +1,241 @@
+package audit
+
+import (
+	"cmdproto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"service/cmdlog"
+	"service/cmds"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditConfig
+// the [audit] section. every request to any handler is appended to Path,
+// Sync fsyncs each record, Exclude lists handlers not audited, e.g. metrics
+// when it is scraped. QueryLimit caps the records one query returns.
+type AuditConfig struct {
+	Path       string   `toml:"path"`
+	Sync       bool     `toml:"sync"`
+	Exclude    []string `toml:"exclude"`
+	QueryLimit int      `toml:"query_limit"`
+}
+
+type AuditHandler struct {
+	*AuditConfig
+	cmdHandlers map[string]func(ah *AuditHandler, req *cmdproto.AuditRequest) (interface{}, error)
+	log         *auditLog
+	confLock    sync.RWMutex
+}
+
+func (ah *AuditHandler) register(op string, fn func(ah *AuditHandler, req *cmdproto.AuditRequest) (interface{}, error)) {
+	ah.cmdHandlers[op] = fn
+}
+
+func (ah *AuditHandler) ConfigStruct() interface{} {
+	return &AuditConfig{Path: "audit.log", QueryLimit: 1000}
+}
+
+func (ac *AuditConfig) validate() error {
+	if ac.Path == "" {
+		return errors.New("audit path is empty")
+	}
+	if ac.QueryLimit <= 0 {
+		ac.QueryLimit = 1000
+	}
+	return nil
+}
+
+func (ah *AuditHandler) Init(config interface{}) error {
+	ah.AuditConfig = config.(*AuditConfig)
+	cmdlog.Printf("AuditHandler Init config :(%+v)\n", ah.AuditConfig)
+	if err := ah.validate(); err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+	al, err := openLog(ah.Path, ah.Sync)
+	if err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+	ah.log = al
+	ah.cmdHandlers = make(map[string]func(ah *AuditHandler, req *cmdproto.AuditRequest) (interface{}, error))
+	ah.register("query", query)
+	ah.register("verify", verify)
+	cmds.ObserveRequests(ah.observe)
+	seq, hash := al.head()
+	cmdlog.Printf("AuditHandler Init ok, %s at seq %d %s\n", ah.Path, seq, hash)
+	return nil
+}
+
+// Reload
+// a new path closes the current log and continues in the new one.
+func (ah *AuditHandler) Reload(config interface{}) error {
+	newConf := config.(*AuditConfig)
+	if err := newConf.validate(); err != nil {
+		return err
+	}
+	ah.confLock.Lock()
+	defer ah.confLock.Unlock()
+	if newConf.Path != ah.Path || newConf.Sync != ah.Sync {
+		al, err := openLog(newConf.Path, newConf.Sync)
+		if err != nil {
+			return err
+		}
+		ah.log.close()
+		ah.log = al
+	}
+	ah.AuditConfig = newConf
+	return nil
+}
+
+func (ah *AuditHandler) current() (*AuditConfig, *auditLog) {
+	ah.confLock.RLock()
+	defer ah.confLock.RUnlock()
+	return ah.AuditConfig, ah.log
+}
+
+func (ah *AuditHandler) DescribeRequest(req *http.Request) (string, []string, error) {
+	data, err := cmds.PeekBody(req)
+	if err != nil {
+		return "", nil, err
+	}
+	auditReq := &cmdproto.AuditRequest{}
+	if err = json.Unmarshal(data, auditReq); err != nil {
+		return "", nil, err
+	}
+	var args []string
+	for _, filter := range [][2]string{{"from", auditReq.From}, {"to", auditReq.To},
+		{"caller", auditReq.Caller}, {"handler", auditReq.Handler}, {"cmd_op", auditReq.CmdOp}} {
+		if filter[1] != "" {
+			args = append(args, filter[0]+"="+filter[1])
+		}
+	}
+	return strings.ToLower(auditReq.Op), args, nil
+}
+
+// observe
+// turns a finished request into a record, the exit status comes from the
+// trailers syscmd sets.
+func (ah *AuditHandler) observe(info *cmds.RequestInfo) {
+	conf, al := ah.current()
+	for _, name := range conf.Exclude {
+		if name == info.Handler {
+			return
+		}
+	}
+	rec := &cmdproto.AuditRecord{Time: info.Start.UTC(), Caller: info.Caller, Remote: info.Remote,
+		Handler: info.Handler, Op: info.Op, Args: info.Args, Status: info.Status,
+		Duration: info.Elapsed.Seconds(), Bytes: info.Bytes}
+	if info.Header != nil {
+		rec.JobId = info.Header.Get("X-Job-Id")
+		if code, err := strconv.Atoi(info.Header.Get("X-Cmd-Exit-Code")); err == nil {
+			rec.ExitCode = &code
+		}
+		rec.Signal = info.Header.Get("X-Cmd-Signal")
+		rec.Limit = info.Header.Get("X-Cmd-Limit")
+	}
+	if err := al.append(rec); err != nil {
+		cmdlog.EPrintf("audit %s %s:%s from %s: %s\n", conf.Path, info.Handler, info.Op, info.Remote, err.Error())
+	}
+}
+
+func parseTime(name, val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return t, fmt.Errorf("bad %s time %s, RFC 3339 expected", name, val)
+	}
+	return t, nil
+}
+
+// query
+// the last limit records matching the filters, oldest first.
+func query(ah *AuditHandler, req *cmdproto.AuditRequest) (interface{}, error) {
+	from, err := parseTime("from", req.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseTime("to", req.To)
+	if err != nil {
+		return nil, err
+	}
+	conf, _ := ah.current()
+	limit := conf.QueryLimit
+	if req.Limit > 0 && req.Limit < limit {
+		limit = req.Limit
+	}
+	records := make([]*cmdproto.AuditRecord, 0, 64)
+	err = scan(conf.Path, func(rec *cmdproto.AuditRecord) {
+		switch {
+		case !from.IsZero() && rec.Time.Before(from):
+		case !to.IsZero() && !rec.Time.Before(to):
+		case req.Caller != "" && rec.Caller != req.Caller:
+		case req.Handler != "" && rec.Handler != req.Handler:
+		case req.CmdOp != "" && rec.Op != req.CmdOp:
+		default:
+			records = append(records, rec)
+			if len(records) >= 2*limit {
+				records = append(records[:0], records[len(records)-limit:]...)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	return records, nil
+}
+
+func verify(ah *AuditHandler, req *cmdproto.AuditRequest) (interface{}, error) {
+	conf, _ := ah.current()
+	return Verify(conf.Path)
+}
+
+func (ah *AuditHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auditReq := &cmdproto.AuditRequest{}
+	if err = json.Unmarshal(data, auditReq); err != nil {
+		cmdlog.EPrintf("%s\n", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	op := strings.ToLower(auditReq.Op)
+	handler, ok := ah.cmdHandlers[op]
+	if !ok {
+		http.Error(w, fmt.Sprintf("server do not support command %s", op), http.StatusNotImplemented)
+		return
+	}
+	res, err := handler(ah, auditReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+func init() {
+	auditHandler := &AuditHandler{}
+	cmds.RegisterCmd("audit", auditHandler)
+}
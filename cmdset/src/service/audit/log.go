@@ -0,0 +1,306 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"cmdproto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"service/cmdlog"
+	"strings"
+	"sync"
+)
+
+// every line ends with the hash of what comes before it.
+const hashField = `,"hash":"`
+
+var errNoHash = errors.New("record without hash")
+
+// auditLog
+// appends hash chained records to a file. the seq and hash of the last
+// record are also kept in <path>.head, so records cut off the end of the
+// log are detected as well.
+type auditLog struct {
+	path string
+	sync bool
+	file *os.File
+	seq  uint64
+	last string
+	lock sync.Mutex
+}
+
+// headState
+// the content of the head file.
+type headState struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// openLog
+// opens path for appending and continues the chain of its last record.
+func openLog(path string, syncWrites bool) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	al := &auditLog{path: path, sync: syncWrites, file: file}
+	line, err := lastLine(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if len(line) > 0 {
+		rec, hash, err := parseLine(line)
+		if err != nil {
+			// a new chain starts, verify reports where.
+			cmdlog.EPrintf("audit log %s: last record: %s, starting a new chain\n", path, err.Error())
+		} else {
+			al.seq, al.last = rec.Seq, hash
+		}
+	}
+	return al, nil
+}
+
+// lastLine
+// reads the file backwards up to the newline before its last line.
+func lastLine(file *os.File) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := info.Size()
+	var tail []byte
+	for end > 0 {
+		size := int64(64 * 1024)
+		if size > end {
+			size = end
+		}
+		chunk := make([]byte, size)
+		if _, err := file.ReadAt(chunk, end-size); err != nil && err != io.EOF {
+			return nil, err
+		}
+		end -= size
+		tail = append(chunk, tail...)
+		trimmed := bytes.TrimRight(tail, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+	}
+	return bytes.TrimRight(tail, "\n"), nil
+}
+
+func lineHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseLine
+// decodes a record and checks its hash against the line.
+func parseLine(line []byte) (*cmdproto.AuditRecord, string, error) {
+	i := bytes.LastIndex(line, []byte(hashField))
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return nil, "", errNoHash
+	}
+	hash := string(line[i+len(hashField) : len(line)-2])
+	body := append(append([]byte{}, line[:i]...), '}')
+	if lineHash(body) != hash {
+		return nil, "", fmt.Errorf("hash mismatch")
+	}
+	rec := &cmdproto.AuditRecord{}
+	if err := json.Unmarshal(line, rec); err != nil {
+		return nil, "", err
+	}
+	return rec, hash, nil
+}
+
+// append
+// chains rec to the last record and writes it.
+func (al *auditLog) append(rec *cmdproto.AuditRecord) error {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	rec.Seq, rec.Prev, rec.Hash = al.seq+1, al.last, ""
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	hash := lineHash(body)
+	line := make([]byte, 0, len(body)+len(hashField)+len(hash)+3)
+	line = append(line, body[:len(body)-1]...)
+	line = append(line, hashField...)
+	line = append(line, hash...)
+	line = append(line, "\"}\n"...)
+	if _, err = al.file.Write(line); err != nil {
+		return err
+	}
+	if al.sync {
+		if err = al.file.Sync(); err != nil {
+			return err
+		}
+	}
+	al.seq, al.last = rec.Seq, hash
+	return al.writeHead()
+}
+
+// writeHead
+// replaces the head file through a synced temp file, so a crash leaves
+// the old head or the new one, never a truncated one.
+func (al *auditLog) writeHead() error {
+	head, _ := json.Marshal(&headState{Seq: al.seq, Hash: al.last})
+	path := al.path + ".head"
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(head); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("audit head %s: %s", path, err.Error())
+	}
+	return nil
+}
+
+func (al *auditLog) head() (uint64, string) {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	return al.seq, al.last
+}
+
+func (al *auditLog) close() error {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	return al.file.Close()
+}
+
+// scan
+// calls fn with every record that parses, broken lines are skipped.
+func scan(path string, fn func(rec *cmdproto.AuditRecord)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if line = bytes.TrimRight(line, "\n"); len(line) > 0 {
+			if rec, _, perr := parseLine(line); perr == nil {
+				fn(rec)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// VerifyResult
+// what Verify found, Problems holds the first maxProblems breaks of the
+// chain by line number.
+type VerifyResult struct {
+	Path     string   `json:"path"`
+	Records  uint64   `json:"records"`
+	HeadSeq  uint64   `json:"head_seq"`
+	HeadHash string   `json:"head_hash"`
+	OK       bool     `json:"ok"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+const maxProblems = 100
+
+func (vr *VerifyResult) problem(format string, args ...interface{}) {
+	vr.OK = false
+	if len(vr.Problems) < maxProblems {
+		vr.Problems = append(vr.Problems, fmt.Sprintf(format, args...))
+	}
+}
+
+// Verify
+// walks the whole chain of the log at path and compares its end with the
+// head file. records edited, removed, reordered or cut off break it, a
+// rewrite of the chain from some point on does not, keep the head hash
+// somewhere else to catch that.
+func Verify(path string) (*VerifyResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	vr := &VerifyResult{Path: path, OK: true}
+	var prev string
+	var seq uint64
+	reader := bufio.NewReader(file)
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		if line[len(line)-1] != '\n' {
+			vr.problem("line %d: incomplete record", lineNo)
+		}
+		line = bytes.TrimRight(line, "\n")
+		rec, hash, perr := parseLine(line)
+		switch {
+		case perr != nil:
+			vr.problem("line %d: %s", lineNo, perr.Error())
+		case rec.Seq != seq+1:
+			vr.problem("line %d: seq %d follows %d", lineNo, rec.Seq, seq)
+		case rec.Prev != prev:
+			vr.problem("line %d: seq %d does not chain to the record before", lineNo, rec.Seq)
+		}
+		if perr == nil {
+			seq, prev = rec.Seq, hash
+			vr.Records++
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	vr.HeadSeq, vr.HeadHash = seq, prev
+
+	data, err := ioutil.ReadFile(path + ".head")
+	if os.IsNotExist(err) {
+		if seq > 0 {
+			vr.problem("head file %s.head is missing", path)
+		}
+		return vr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	head := &headState{}
+	if err = json.Unmarshal(data, head); err != nil {
+		vr.problem("head file: %s", err.Error())
+	} else if head.Seq != seq || head.Hash != prev {
+		vr.problem("head file at seq %d %s, log ends at seq %d %s", head.Seq, head.Hash, seq, prev)
+	}
+	return vr, nil
+}
+
+func (vr *VerifyResult) String() string {
+	if vr.OK {
+		return fmt.Sprintf("%s: ok, %d records, head seq %d %s", vr.Path, vr.Records, vr.HeadSeq, vr.HeadHash)
+	}
+	return fmt.Sprintf("%s: BROKEN, %d records, head seq %d %s\n%s", vr.Path, vr.Records, vr.HeadSeq,
+		vr.HeadHash, strings.Join(vr.Problems, "\n"))
+}
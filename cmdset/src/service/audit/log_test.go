@@ -0,0 +1,138 @@
+package audit
+
+import (
+	"bytes"
+	"cmdproto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeChain
+// writes n records to a new log in dir and returns its path.
+func writeChain(t *testing.T, dir string, n int) string {
+	path := filepath.Join(dir, "audit.log")
+	al, err := openLog(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer al.close()
+	for i := 0; i < n; i++ {
+		rec := &cmdproto.AuditRecord{Time: time.Unix(int64(i), 0).UTC(), Caller: "ops",
+			Remote: "127.0.0.1:1", Handler: "syscmd", Op: "syscmd", Args: []string{"uptime"}, Status: 200}
+		if err = al.append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func readLines(t *testing.T, path string) [][]byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.SplitAfter(data, []byte("\n"))
+}
+
+func writeLines(t *testing.T, path string, lines [][]byte) {
+	if err := ioutil.WriteFile(path, bytes.Join(lines, nil), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		records int
+		tamper  func(t *testing.T, path string)
+		ok      bool
+		problem string
+	}{
+		{name: "intact", records: 3, ok: true},
+		{name: "empty", records: 0, ok: true},
+		{name: "edited", records: 3, problem: "line 2: hash mismatch",
+			tamper: func(t *testing.T, path string) {
+				lines := readLines(t, path)
+				lines[1] = bytes.Replace(lines[1], []byte("uptime"), []byte("reboot"), 1)
+				writeLines(t, path, lines)
+			}},
+		{name: "removed", records: 3, problem: "line 2: seq 3 follows 1",
+			tamper: func(t *testing.T, path string) {
+				lines := readLines(t, path)
+				writeLines(t, path, append(lines[:1:1], lines[2:]...))
+			}},
+		{name: "reordered", records: 3, problem: "line 2: seq 3 follows 1",
+			tamper: func(t *testing.T, path string) {
+				lines := readLines(t, path)
+				lines[1], lines[2] = lines[2], lines[1]
+				writeLines(t, path, lines)
+			}},
+		{name: "cut off", records: 3, problem: "head file at seq 3",
+			tamper: func(t *testing.T, path string) {
+				writeLines(t, path, readLines(t, path)[:2])
+			}},
+		{name: "incomplete", records: 3, problem: "line 3: incomplete record",
+			tamper: func(t *testing.T, path string) {
+				lines := readLines(t, path)
+				lines[2] = lines[2][:len(lines[2])-1]
+				writeLines(t, path, lines)
+			}},
+		{name: "rehashed", records: 3, problem: "line 2: seq 2 does not chain",
+			tamper: func(t *testing.T, path string) {
+				lines := readLines(t, path)
+				rec, _, err := parseLine(bytes.TrimRight(lines[1], "\n"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				// a valid record of its own that does not chain to line 1.
+				rec.Prev = strings.Repeat("0", 64)
+				al := &auditLog{path: path + ".tmp", seq: rec.Seq - 1, last: rec.Prev}
+				if al.file, err = os.Create(al.path); err != nil {
+					t.Fatal(err)
+				}
+				if err = al.append(rec); err != nil {
+					t.Fatal(err)
+				}
+				al.close()
+				lines[1] = readLines(t, al.path)[0]
+				writeLines(t, path, lines)
+			}},
+		{name: "head missing", records: 2, problem: "head file ",
+			tamper: func(t *testing.T, path string) {
+				os.Remove(path + ".head")
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "audit")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := writeChain(t, dir, tt.records)
+			if tt.tamper != nil {
+				tt.tamper(t, path)
+			}
+			vr, err := Verify(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vr.OK != tt.ok {
+				t.Fatalf("ok %v, want %v: %v", vr.OK, tt.ok, vr.Problems)
+			}
+			if tt.problem == "" {
+				if len(vr.Problems) > 0 {
+					t.Fatalf("unexpected problems %v", vr.Problems)
+				}
+				return
+			}
+			if len(vr.Problems) == 0 || !strings.HasPrefix(vr.Problems[0], tt.problem) {
+				t.Fatalf("problems %v, want the first to start with %q", vr.Problems, tt.problem)
+			}
+		})
+	}
+}
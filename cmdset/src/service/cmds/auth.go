@@ -0,0 +1,273 @@
+package cmds
+
+import (
+	"bytes"
+	"cmdproto"
+	"context"
+	"crypto/hmac"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"io/ioutil"
+	"net/http"
+	"service/cmdlog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestDescriber
+// implemented by handlers that can tell which op a request invokes, the
+// auth layer authorizes on it. handlers reading the body should use PeekBody.
+type RequestDescriber interface {
+	DescribeRequest(req *http.Request) (op string, args []string, err error)
+}
+
+// AuthConfig
+// the [auth] section, requests are either signed with a token secret
+// (X-Cmd-Key, X-Cmd-Timestamp, X-Cmd-Nonce, X-Cmd-Signature headers),
+// carry "Authorization: Bearer <token>", or come with a verified client
+// certificate listed in Certs.
+type AuthConfig struct {
+	Enabled bool                `toml:"enabled"`
+	MaxSkew Duration            `toml:"max_skew"`
+	MaxBody int64               `toml:"max_body"`
+	Tokens  []AuthToken         `toml:"tokens"`
+	Certs   []AuthCert          `toml:"certs"`
+	Roles   map[string]AuthRole `toml:"roles"`
+}
+
+// AuthCert
+// grants roles to the client certificate with common name CN.
+type AuthCert struct {
+	CN    string   `toml:"cn"`
+	Roles []string `toml:"roles"`
+}
+
+type AuthToken struct {
+	Name   string   `toml:"name"`
+	Token  string   `toml:"token"`
+	Secret string   `toml:"secret"`
+	Roles  []string `toml:"roles"`
+}
+
+// AuthRole
+// Allow holds "handler:op" patterns, "*" matches any handler or op.
+type AuthRole struct {
+	Allow []string `toml:"allow"`
+}
+
+type authenticator struct {
+	*AuthConfig
+	nonceLock sync.Mutex
+	nonces    map[string]time.Time
+}
+
+type callerKey struct{}
+
+var auth *authenticator
+
+func InitAuthConf(confs map[string]toml.Primitive, md *toml.MetaData) error {
+	config := &AuthConfig{MaxSkew: Duration{5 * time.Minute}, MaxBody: 64 << 20}
+	if conf, ok := confs["auth"]; ok {
+		if err := md.PrimitiveDecode(conf, config); err != nil {
+			cmdlog.EPrintln(err.Error())
+			return err
+		}
+	}
+	if !config.Enabled {
+		cmdlog.Printf("auth disabled, every request is allowed\n")
+		return nil
+	}
+	for _, cert := range config.Certs {
+		config.Tokens = append(config.Tokens, AuthToken{Name: "cert:" + cert.CN, Roles: cert.Roles})
+	}
+	for _, token := range config.Tokens {
+		if token.Name == "" || (token.Token == "" && token.Secret == "" && !strings.HasPrefix(token.Name, "cert:")) {
+			err := fmt.Errorf("auth token %q without name, token or secret", token.Name)
+			cmdlog.EPrintln(err.Error())
+			return err
+		}
+		for _, role := range token.Roles {
+			if _, ok := config.Roles[role]; !ok {
+				err := fmt.Errorf("auth token %s refers to unknown role %s", token.Name, role)
+				cmdlog.EPrintln(err.Error())
+				return err
+			}
+		}
+	}
+	auth = &authenticator{AuthConfig: config, nonces: make(map[string]time.Time)}
+	cmdlog.Printf("auth enabled, %d tokens, %d roles\n", len(config.Tokens), len(config.Roles))
+	return nil
+}
+
+// Caller
+// returns the authenticated caller of req, empty if auth is disabled.
+func Caller(req *http.Request) string {
+	if caller, ok := req.Context().Value(callerKey{}).(string); ok {
+		return caller
+	}
+	return ""
+}
+
+// PeekBody
+// reads the whole request body and puts it back so it can be read again.
+func PeekBody(req *http.Request) ([]byte, error) {
+	data, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
+
+func authHandler(name string, handler CmdHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		info := requestInfo(req)
+		if auth == nil {
+			if peer := PeerIdentity(req); peer != "" {
+				info.Caller = "cert:" + peer
+				req = req.WithContext(context.WithValue(req.Context(), callerKey{}, info.Caller))
+			}
+			if len(requestObservers()) > 0 {
+				info.describe(handler, req)
+			}
+			handler.ServeHTTP(w, req)
+			return
+		}
+		token, err := auth.authenticate(req)
+		if err != nil {
+			cmdlog.EPrintf("auth deny %s %s: %s\n", req.RemoteAddr, name, err.Error())
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		info.Caller = token.Name
+		//bearer and certificate requests are not capped by verifySignature.
+		req.Body = http.MaxBytesReader(w, req.Body, auth.MaxBody)
+		op, err := info.describe(handler, req)
+		if err != nil {
+			cmdlog.EPrintf("auth deny %s %s %s: %s\n", req.RemoteAddr, token.Name, name, err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !auth.authorize(token, name, op) {
+			cmdlog.EPrintf("auth deny %s %s %s:%s: not permitted\n", req.RemoteAddr, token.Name, name, op)
+			http.Error(w, fmt.Sprintf("%s is not permitted to invoke %s:%s", token.Name, name, op),
+				http.StatusForbidden)
+			return
+		}
+		cmdlog.Printf("auth allow %s %s %s:%s\n", req.RemoteAddr, token.Name, name, op)
+		ctx := context.WithValue(req.Context(), callerKey{}, token.Name)
+		handler.ServeHTTP(w, req.WithContext(ctx))
+	}
+}
+
+func (a *authenticator) authenticate(req *http.Request) (*AuthToken, error) {
+	if authz := req.Header.Get("Authorization"); strings.HasPrefix(authz, "Bearer ") {
+		bearer := []byte(strings.TrimSpace(authz[len("Bearer "):]))
+		for i := range a.Tokens {
+			token := &a.Tokens[i]
+			if token.Token != "" && subtle.ConstantTimeCompare([]byte(token.Token), bearer) == 1 {
+				return token, nil
+			}
+		}
+		return nil, errors.New("invalid bearer token")
+	}
+	if key := req.Header.Get("X-Cmd-Key"); key != "" {
+		return a.verifySignature(req, key)
+	}
+	if peer := PeerIdentity(req); peer != "" {
+		for i := range a.Tokens {
+			if a.Tokens[i].Name == "cert:"+peer {
+				return &a.Tokens[i], nil
+			}
+		}
+		return nil, fmt.Errorf("client certificate %s is not allowed", peer)
+	}
+	return nil, errors.New("request without credentials")
+}
+
+func (a *authenticator) verifySignature(req *http.Request, key string) (*AuthToken, error) {
+	var token *AuthToken
+	for i := range a.Tokens {
+		if a.Tokens[i].Name == key && a.Tokens[i].Secret != "" {
+			token = &a.Tokens[i]
+			break
+		}
+	}
+	if token == nil {
+		return nil, fmt.Errorf("unknown key %s", key)
+	}
+	timestamp := req.Header.Get("X-Cmd-Timestamp")
+	nonce := req.Header.Get("X-Cmd-Nonce")
+	signature := req.Header.Get("X-Cmd-Signature")
+	if timestamp == "" || nonce == "" || signature == "" {
+		return nil, errors.New("incomplete request signature")
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid request timestamp")
+	}
+	skew := time.Since(time.Unix(sec, 0))
+	if skew > a.MaxSkew.Duration || -skew > a.MaxSkew.Duration {
+		return nil, errors.New("request timestamp out of range")
+	}
+
+	if req.ContentLength > a.MaxBody {
+		return nil, errors.New("request body too large to verify")
+	}
+	req.Body = http.MaxBytesReader(nil, req.Body, a.MaxBody)
+	body, err := PeekBody(req)
+	if err != nil {
+		return nil, err
+	}
+	expected := cmdproto.SignRequest(token.Secret, req.Method, req.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, errors.New("invalid request signature")
+	}
+	if !a.useNonce(key+":"+nonce, time.Unix(sec, 0)) {
+		return nil, errors.New("replayed request nonce")
+	}
+	return token, nil
+}
+
+// useNonce
+// records nonce and reports whether it was unused. nonces are kept as
+// long as their timestamp is within the skew window.
+func (a *authenticator) useNonce(nonce string, ts time.Time) bool {
+	a.nonceLock.Lock()
+	defer a.nonceLock.Unlock()
+	now := time.Now()
+	for n, t := range a.nonces {
+		if now.Sub(t) > a.MaxSkew.Duration {
+			delete(a.nonces, n)
+		}
+	}
+	if _, ok := a.nonces[nonce]; ok {
+		return false
+	}
+	a.nonces[nonce] = ts
+	return true
+}
+
+func matchPattern(pattern, val string) bool {
+	return pattern == "*" || strings.EqualFold(pattern, val)
+}
+
+func (a *authenticator) authorize(token *AuthToken, handler, op string) bool {
+	for _, roleName := range token.Roles {
+		for _, allow := range a.Roles[roleName].Allow {
+			parts := strings.SplitN(allow, ":", 2)
+			if len(parts) == 1 {
+				parts = append(parts, "*")
+			}
+			if matchPattern(parts[0], handler) && matchPattern(parts[1], op) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -3,21 +3,25 @@ package cmds
 import (
 	"github.com/BurntSushi/toml"
 	"net/http"
-	"net/smtp"
 	"runtime/debug"
 	"service/cmdlog"
-	"strings"
+	"sort"
 	"syscall"
+	"time"
 )
 
 type CmdHandler interface {
 	ServeHTTP(http.ResponseWriter, *http.Request)
 	Init(config interface{}) error
 	ConfigStruct() interface{}
+	// Reload validates config and applies it to the running handler, on
+	// error the handler keeps its old config.
+	Reload(config interface{}) error
 }
 
 var CmdServerMux = http.NewServeMux()
 var CmdHandlers map[string]CmdHandler
+var enabledHandlers []string
 
 func init() {
 	CmdHandlers = make(map[string]CmdHandler)
@@ -26,7 +30,7 @@ func init() {
 func RegisterCmd(name string, handler CmdHandler) {
 	CmdHandlers[name] = handler
 	pattern := "/" + name
-	CmdServerMux.Handle(pattern, handler)
+	CmdServerMux.Handle(pattern, observeHandler(name, handler, authHandler(name, handler)))
 }
 
 func InitHandlerConf(confs map[string]toml.Primitive, md *toml.MetaData) error {
@@ -45,11 +49,63 @@ func InitHandlerConf(confs map[string]toml.Primitive, md *toml.MetaData) error {
 				cmdlog.EPrintln(err.Error())
 				return err
 			}
+			enabledHandlers = append(enabledHandlers, k)
 		}
 	}
+	sort.Strings(enabledHandlers)
 	return err
 }
 
+// ReloadHandlerConf
+// hands every enabled handler its new config section, a handler that fails
+// to decode or validate it keeps running with the old one. it returns the
+// first error met.
+func ReloadHandlerConf(confs map[string]toml.Primitive, md *toml.MetaData) error {
+	var firstErr error
+	for _, k := range enabledHandlers {
+		handler := CmdHandlers[k]
+		conf, ok := confs[k]
+		if !ok {
+			cmdlog.EPrintf("reload %s: section removed, keeping old config\n", k)
+			continue
+		}
+		handlerConf := handler.ConfigStruct()
+		err := md.PrimitiveDecode(conf, handlerConf)
+		if err == nil {
+			err = handler.Reload(handlerConf)
+		}
+		if err != nil {
+			cmdlog.EPrintf("reload %s failed, keeping old config: %s\n", k, err.Error())
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		cmdlog.Printf("reload %s ok, config:(%+v)\n", k, handlerConf)
+	}
+	for k := range confs {
+		if _, ok := CmdHandlers[k]; ok && !isEnabled(k) {
+			cmdlog.EPrintf("reload %s: new section needs a restart\n", k)
+		}
+	}
+	return firstErr
+}
+
+func isEnabled(name string) bool {
+	for _, k := range enabledHandlers {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+// EnabledHandlers
+// names of the handlers initialized by InitHandlerConf.
+func EnabledHandlers() []string {
+	return enabledHandlers
+}
+
 func SafeHandler(handler http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		defer func() {
@@ -63,6 +119,16 @@ func SafeHandler(handler http.Handler) http.HandlerFunc {
 	}
 }
 
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
 type DiskStatus struct {
 	All  uint64 `json:"all"`
 	Used uint64 `json:"used"`
@@ -81,17 +147,3 @@ func DiskUsage(path string) (disk DiskStatus) {
 	disk.Used = disk.All - disk.Free
 	return
 }
-
-func SendMail(subject, body string) error {
-	user := "cxw_eric@126.com"
-	password := "abc123"
-	host := "smtp.126.com:25"
-	hp := strings.Split(host, ":")
-	auth := smtp.PlainAuth("", user, password, hp[0])
-	content_type := "Content-Type: text/plain" + "; charset=UTF-8"
-	to := "cxw_eric@126.com"
-	msg := []byte("To: " + to + "\r\nFrom: " + user + "\r\nSubject: " + subject + "\r\n" + content_type + "\r\n\r\n" + body)
-	send_to := strings.Split(to, ";")
-	err := smtp.SendMail(host, auth, user, send_to, msg)
-	return err
-}
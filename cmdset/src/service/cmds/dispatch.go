@@ -0,0 +1,154 @@
+package cmds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// TaskFunc
+// a named task handlers offer to run in process, e.g. for the scheduler.
+type TaskFunc func(args []string) (string, error)
+
+var (
+	tasks    = make(map[string]TaskFunc)
+	taskLock sync.RWMutex
+)
+
+// RegisterTask
+// makes fn runnable by name, names are "<handler>.<task>" by convention.
+func RegisterTask(name string, fn TaskFunc) {
+	taskLock.Lock()
+	tasks[name] = fn
+	taskLock.Unlock()
+}
+
+func Task(name string) (TaskFunc, bool) {
+	taskLock.RLock()
+	defer taskLock.RUnlock()
+	fn, ok := tasks[name]
+	return fn, ok
+}
+
+func TaskNames() []string {
+	taskLock.RLock()
+	defer taskLock.RUnlock()
+	names := make([]string, 0, len(tasks))
+	for name := range tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Permitted
+// whether caller may invoke handler:op, always true with auth disabled.
+func Permitted(caller, handler, op string) bool {
+	if auth == nil {
+		return true
+	}
+	for i := range auth.Tokens {
+		if auth.Tokens[i].Name == caller {
+			return auth.authorize(&auth.Tokens[i], handler, op)
+		}
+	}
+	return false
+}
+
+// DescribeBody
+// the op and args a request body to handler name invokes.
+func DescribeBody(name string, body []byte) (string, []string, error) {
+	handler, ok := CmdHandlers[name]
+	if !ok || !isEnabled(name) {
+		return "", nil, fmt.Errorf("handler %s is not enabled", name)
+	}
+	describer, ok := handler.(RequestDescriber)
+	if !ok {
+		return "", nil, nil
+	}
+	req, err := http.NewRequest(http.MethodPost, "/"+name, bytes.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+	return describer.DescribeRequest(req)
+}
+
+// DispatchResult
+// the response of a dispatched request, Output keeps its first bytes.
+type DispatchResult struct {
+	Status    int
+	Header    http.Header
+	Output    []byte
+	Truncated bool
+}
+
+// bufferWriter
+// collects a response in memory up to max bytes.
+type bufferWriter struct {
+	res *DispatchResult
+	buf bytes.Buffer
+	max int
+}
+
+func (bw *bufferWriter) Header() http.Header {
+	return bw.res.Header
+}
+
+func (bw *bufferWriter) WriteHeader(status int) {
+	if bw.res.Status == 0 {
+		bw.res.Status = status
+	}
+}
+
+func (bw *bufferWriter) Write(data []byte) (int, error) {
+	if bw.res.Status == 0 {
+		bw.res.Status = http.StatusOK
+	}
+	if room := bw.max - bw.buf.Len(); room < len(data) {
+		bw.res.Truncated = true
+		if room > 0 {
+			bw.buf.Write(data[:room])
+		}
+		return len(data), nil
+	}
+	return bw.buf.Write(data)
+}
+
+func (bw *bufferWriter) Flush() {}
+
+// Dispatch
+// serves body with the handler registered as name in process, on behalf of
+// caller who must be permitted to invoke the op. the request is observed
+// like any other, with remote as its remote address.
+func Dispatch(name, caller, remote string, body []byte, maxOutput int) (*DispatchResult, error) {
+	handler, ok := CmdHandlers[name]
+	if !ok || !isEnabled(name) {
+		return nil, fmt.Errorf("handler %s is not enabled", name)
+	}
+	op, _, err := DescribeBody(name, body)
+	if err != nil {
+		return nil, err
+	}
+	if !Permitted(caller, name, op) {
+		return nil, fmt.Errorf("%s is not permitted to invoke %s:%s", caller, name, op)
+	}
+	req, err := http.NewRequest(http.MethodPost, "/"+name, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.RemoteAddr = remote
+	req = req.WithContext(context.WithValue(req.Context(), callerKey{}, caller))
+	bw := &bufferWriter{res: &DispatchResult{Header: make(http.Header)}, max: maxOutput}
+	observeHandler(name, handler, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestInfo(req).Caller = caller
+		handler.ServeHTTP(w, req)
+	})).ServeHTTP(bw, req)
+	if bw.res.Status == 0 {
+		bw.res.Status = http.StatusOK
+	}
+	bw.res.Output = bw.buf.Bytes()
+	return bw.res, nil
+}
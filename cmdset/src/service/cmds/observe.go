@@ -0,0 +1,172 @@
+package cmds
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RequestInfo
+// what the cmds layer knows about a request once its handler returned.
+// Op and Args come from the handler's RequestDescriber, Caller is set when
+// the request was authenticated. Header holds the response header and
+// trailers, Bytes counts the response body written through the http
+// server.
+type RequestInfo struct {
+	Handler string
+	Op      string
+	Args    []string
+	Caller  string
+	Remote  string
+	Status  int
+	Start   time.Time
+	Elapsed time.Duration
+	Header  http.Header
+	Bytes   int64
+
+	described bool
+	descErr   error
+}
+
+// RequestObserver
+// is called after every request, from the goroutine serving it.
+type RequestObserver func(info *RequestInfo)
+
+// Metric
+// one sample reported by a StatsReporter, Type is "gauge" or "counter".
+type Metric struct {
+	Name   string
+	Help   string
+	Type   string
+	Labels map[string]string
+	Value  float64
+}
+
+// StatsReporter
+// implemented by handlers that export their own metrics, e.g. pool
+// occupancy or running jobs.
+type StatsReporter interface {
+	Stats() []Metric
+}
+
+type requestInfoKey struct{}
+
+var (
+	observers    []RequestObserver
+	observerLock sync.RWMutex
+)
+
+// ObserveRequests
+// adds obs to the observers called after every request.
+func ObserveRequests(obs RequestObserver) {
+	observerLock.Lock()
+	observers = append(observers, obs)
+	observerLock.Unlock()
+}
+
+func requestObservers() []RequestObserver {
+	observerLock.RLock()
+	defer observerLock.RUnlock()
+	return observers
+}
+
+// PoolStats
+// the occupancy of a pooled request channel as metrics.
+func PoolStats(handler string, pool int, free int) []Metric {
+	labels := map[string]string{"handler": handler}
+	return []Metric{
+		{Name: "cmdserver_request_pool_size", Help: "Requests the handler can serve at once.",
+			Type: "gauge", Labels: labels, Value: float64(pool)},
+		{Name: "cmdserver_request_pool_in_use", Help: "Pooled requests being served.",
+			Type: "gauge", Labels: labels, Value: float64(pool - free)},
+	}
+}
+
+// describe
+// runs the handler's RequestDescriber once per request.
+func (info *RequestInfo) describe(handler CmdHandler, req *http.Request) (string, error) {
+	if !info.described {
+		info.described = true
+		if describer, ok := handler.(RequestDescriber); ok {
+			info.Op, info.Args, info.descErr = describer.DescribeRequest(req)
+		}
+	}
+	return info.Op, info.descErr
+}
+
+func requestInfo(req *http.Request) *RequestInfo {
+	info, _ := req.Context().Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(data []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(data)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can not be hijacked")
+	}
+	if sw.status == 0 {
+		sw.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// observeHandler
+// records what the request did and hands it to the observers, it wraps
+// the auth layer so denied requests are observed too. the op is described
+// by the auth layer, so bodies of unauthenticated requests are never read.
+func observeHandler(name string, handler CmdHandler, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		info := &RequestInfo{Handler: name, Remote: req.RemoteAddr, Start: time.Now()}
+		obs := requestObservers()
+		sw := &statusWriter{ResponseWriter: w}
+		req = req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info))
+		defer func() {
+			info.Elapsed = time.Since(info.Start)
+			info.Status = sw.status
+			if info.Status == 0 {
+				info.Status = http.StatusOK
+			}
+			info.Header = w.Header()
+			info.Bytes = sw.bytes
+			for _, o := range obs {
+				o(info)
+			}
+		}()
+		next.ServeHTTP(sw, req)
+	}
+}
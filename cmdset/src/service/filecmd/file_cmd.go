@@ -0,0 +1,456 @@
+package filecmd
+
+import (
+	"cmdproto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"service/cmdlog"
+	"service/cmds"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// FileCmdConfig
+// the [file] section. only paths below one of Roots can be read or
+// written, symlinks are resolved before the check. MaxUpload is the
+// largest file accepted in bytes.
+type FileCmdConfig struct {
+	Roots     []string `toml:"roots"`
+	MaxUpload int64    `toml:"max_upload"`
+}
+
+// FileCmd
+// serves /file?op=upload|download|stat&path=<path>. an upload is the raw
+// request body, written to a temp file next to path and renamed over it
+// once complete, with optional mode, owner ("user[:group]"), sha256 (hex,
+// checked before the rename) and mkdir=1 to create missing parents.
+type FileCmd struct {
+	*FileCmdConfig
+	roots    []string
+	confLock sync.RWMutex
+}
+
+// fileError
+// an error with the http status it is answered with.
+type fileError struct {
+	code int
+	msg  string
+}
+
+func (fe *fileError) Error() string {
+	return fe.msg
+}
+
+func newFileError(code int, format string, args ...interface{}) error {
+	return &fileError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+func (fc *FileCmd) ConfigStruct() interface{} {
+	return &FileCmdConfig{MaxUpload: 1 << 30}
+}
+
+// resolveRoots
+// the configured roots with their symlinks resolved.
+func (conf *FileCmdConfig) resolveRoots() ([]string, error) {
+	if len(conf.Roots) == 0 {
+		return nil, errors.New("file roots are empty")
+	}
+	if conf.MaxUpload <= 0 {
+		return nil, errors.New("file max_upload must be positive")
+	}
+	roots := make([]string, 0, len(conf.Roots))
+	for _, root := range conf.Roots {
+		if !filepath.IsAbs(root) {
+			return nil, fmt.Errorf("file root %s is not absolute", root)
+		}
+		real, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return nil, fmt.Errorf("file root %s: %s", root, err.Error())
+		}
+		roots = append(roots, real)
+	}
+	return roots, nil
+}
+
+func (fc *FileCmd) Init(config interface{}) error {
+	fc.FileCmdConfig = config.(*FileCmdConfig)
+	cmdlog.Printf("FileCmd Init config :(%+v)\n", fc.FileCmdConfig)
+	roots, err := fc.resolveRoots()
+	if err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+	fc.roots = roots
+	cmdlog.Printf("FileCmd Init ok, roots %v\n", roots)
+	return nil
+}
+
+func (fc *FileCmd) Reload(config interface{}) error {
+	newConf := config.(*FileCmdConfig)
+	roots, err := newConf.resolveRoots()
+	if err != nil {
+		return err
+	}
+	fc.confLock.Lock()
+	defer fc.confLock.Unlock()
+	fc.FileCmdConfig, fc.roots = newConf, roots
+	return nil
+}
+
+func (fc *FileCmd) config() (*FileCmdConfig, []string) {
+	fc.confLock.RLock()
+	defer fc.confLock.RUnlock()
+	return fc.FileCmdConfig, fc.roots
+}
+
+func fileOp(req *http.Request, query url.Values) string {
+	if op := query.Get("op"); op != "" {
+		return strings.ToLower(op)
+	}
+	if req.Method == http.MethodPut || req.Method == http.MethodPost {
+		return "upload"
+	}
+	return "download"
+}
+
+func (fc *FileCmd) DescribeRequest(req *http.Request) (string, []string, error) {
+	query := req.URL.Query()
+	return fileOp(req, query), []string{query.Get("path")}, nil
+}
+
+func within(path string, roots []string) bool {
+	for _, root := range roots {
+		if root == "/" || path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve
+// the real path of an existing file, it must be below a root.
+func (fc *FileCmd) resolve(path string) (string, error) {
+	_, roots := fc.config()
+	if !filepath.IsAbs(path) {
+		return "", newFileError(http.StatusBadRequest, "path %s is not absolute", path)
+	}
+	real, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if os.IsNotExist(err) {
+		return "", newFileError(http.StatusNotFound, "%s not found", path)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !within(real, roots) {
+		return "", newFileError(http.StatusForbidden, "%s is outside the file roots", path)
+	}
+	return real, nil
+}
+
+// resolveTarget
+// the real path an upload to path is written to, the directory is resolved
+// and, with mkdir, created below the root.
+func (fc *FileCmd) resolveTarget(path string, mkdir bool) (string, error) {
+	if !filepath.IsAbs(path) || strings.HasSuffix(path, "/") {
+		return "", newFileError(http.StatusBadRequest, "path %s is not an absolute file path", path)
+	}
+	clean := filepath.Clean(path)
+	dir, base := filepath.Dir(clean), filepath.Base(clean)
+	existing, missing := dir, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		if !mkdir {
+			return "", newFileError(http.StatusNotFound, "directory %s not found", dir)
+		}
+		missing = filepath.Join(filepath.Base(existing), missing)
+		existing = filepath.Dir(existing)
+	}
+	realDir, err := fc.resolve(existing)
+	if err != nil {
+		return "", err
+	}
+	realDir = filepath.Join(realDir, missing)
+	if missing != "" {
+		if err = os.MkdirAll(realDir, 0755); err != nil {
+			return "", err
+		}
+	}
+	target := filepath.Join(realDir, base)
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		return "", newFileError(http.StatusBadRequest, "%s is a directory", path)
+	}
+	return target, nil
+}
+
+// lookupOwner
+// parses "user[:group]" or ":group", names or ids, -1 keeps the current.
+func lookupOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	name, group := owner, ""
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		name, group = owner[:i], owner[i+1:]
+	}
+	if name != "" {
+		if id, err := strconv.Atoi(name); err == nil {
+			uid = id
+		} else {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return 0, 0, newFileError(http.StatusBadRequest, "owner %s: %s", name, err.Error())
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+			if group == "" {
+				gid, _ = strconv.Atoi(u.Gid)
+			}
+		}
+	}
+	if group != "" {
+		if id, err := strconv.Atoi(group); err == nil {
+			gid = id
+		} else {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return 0, 0, newFileError(http.StatusBadRequest, "group %s: %s", group, err.Error())
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+func fileInfo(path string, info os.FileInfo, sum string) *cmdproto.FileInfo {
+	fi := &cmdproto.FileInfo{Path: path, Size: info.Size(), Mode: fmt.Sprintf("%04o", info.Mode().Perm()),
+		ModTime: info.ModTime().UTC(), Sha256: sum}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		fi.Uid, fi.Gid = int(st.Uid), int(st.Gid)
+	}
+	return fi
+}
+
+// upload
+// writes the body to a temp file in the target directory and renames it
+// over the target, the old file stays untouched on any error.
+func (fc *FileCmd) upload(req *http.Request, query url.Values) (*cmdproto.FileInfo, error) {
+	conf, _ := fc.config()
+	if req.ContentLength > conf.MaxUpload {
+		return nil, newFileError(http.StatusRequestEntityTooLarge, "upload of %d bytes exceeds %d",
+			req.ContentLength, conf.MaxUpload)
+	}
+	mode, keepMode := os.FileMode(0644), true
+	if val := query.Get("mode"); val != "" {
+		m, err := strconv.ParseUint(val, 8, 32)
+		if err != nil || m > 0777 {
+			return nil, newFileError(http.StatusBadRequest, "bad mode %s, octal permission bits expected", val)
+		}
+		mode, keepMode = os.FileMode(m), false
+	}
+	uid, gid := -1, -1
+	if owner := query.Get("owner"); owner != "" {
+		var err error
+		if uid, gid, err = lookupOwner(owner); err != nil {
+			return nil, err
+		}
+	}
+	target, err := fc.resolveTarget(query.Get("path"), query.Get("mkdir") == "1")
+	if err != nil {
+		return nil, err
+	}
+	if old, err := os.Lstat(target); err == nil && old.Mode().IsRegular() {
+		// a replaced file keeps its mode and owner unless asked otherwise.
+		if keepMode {
+			mode = old.Mode().Perm()
+		}
+		if st, ok := old.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+			if uid < 0 {
+				uid = int(st.Uid)
+			}
+			if gid < 0 {
+				gid = int(st.Gid)
+			}
+		}
+	}
+	expect := strings.ToLower(query.Get("sha256"))
+
+	tmp, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	done := false
+	defer func() {
+		if !done {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(req.Body, conf.MaxUpload+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > conf.MaxUpload {
+		return nil, newFileError(http.StatusRequestEntityTooLarge, "upload exceeds %d bytes", conf.MaxUpload)
+	}
+	if req.ContentLength >= 0 && n != req.ContentLength {
+		return nil, newFileError(http.StatusBadRequest, "got %d of %d bytes", n, req.ContentLength)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if expect != "" && expect != sum {
+		return nil, newFileError(http.StatusBadRequest, "sha256 mismatch, got %s expected %s", sum, expect)
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		return nil, err
+	}
+	if uid >= 0 || gid >= 0 {
+		if err = tmp.Chown(uid, gid); err != nil {
+			return nil, err
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		return nil, err
+	}
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmp.Name(), target); err != nil {
+		return nil, err
+	}
+	done = true
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+	cmdlog.Printf("file %s uploaded by %s, %d bytes sha256 %s\n", target, cmds.Caller(req), n, sum)
+	return fileInfo(target, info, sum), nil
+}
+
+func fileSum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// stat
+// the file info of path, sha256=1 also hashes its content.
+func (fc *FileCmd) stat(query url.Values) (*cmdproto.FileInfo, error) {
+	real, err := fc.resolve(query.Get("path"))
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return nil, err
+	}
+	sum := ""
+	if query.Get("sha256") == "1" && info.Mode().IsRegular() {
+		if sum, err = fileSum(real); err != nil {
+			return nil, err
+		}
+	}
+	return fileInfo(real, info, sum), nil
+}
+
+// download
+// streams a regular file, its sha256 follows in the X-File-Sha256 trailer.
+func (fc *FileCmd) download(w http.ResponseWriter, query url.Values) error {
+	real, err := fc.resolve(query.Get("path"))
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(real)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return newFileError(http.StatusBadRequest, "%s is not a regular file", real)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(real)))
+	w.Header().Set("X-File-Size", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("X-File-Mode", fmt.Sprintf("%04o", info.Mode().Perm()))
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("Trailer", "X-File-Sha256")
+	w.WriteHeader(http.StatusOK)
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(w, hash), file); err != nil {
+		cmdlog.EPrintf("file download %s: %s\n", real, err.Error())
+		return nil
+	}
+	w.Header().Set("X-File-Sha256", hex.EncodeToString(hash.Sum(nil)))
+	return nil
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if fe, ok := err.(*fileError); ok {
+		code = fe.code
+	} else if os.IsPermission(err) {
+		code = http.StatusForbidden
+	}
+	cmdlog.EPrintf("%s\n", err.Error())
+	http.Error(w, err.Error(), code)
+}
+
+func (fc *FileCmd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	query := req.URL.Query()
+	var res *cmdproto.FileInfo
+	var err error
+	switch op := fileOp(req, query); op {
+	case "upload":
+		if req.Method != http.MethodPut && req.Method != http.MethodPost {
+			http.Error(w, "upload needs PUT or POST", http.StatusMethodNotAllowed)
+			return
+		}
+		res, err = fc.upload(req, query)
+	case "stat":
+		res, err = fc.stat(query)
+	case "download":
+		if err = fc.download(w, query); err != nil {
+			writeError(w, err)
+		}
+		return
+	default:
+		cmdlog.EPrintln("method not implemented")
+		http.Error(w, fmt.Sprintf("server do not support command %s", op), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, string(data))
+}
+
+func init() {
+	fileCmd := &FileCmd{}
+	cmds.RegisterCmd("file", fileCmd)
+}
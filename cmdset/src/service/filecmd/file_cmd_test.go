@@ -0,0 +1,251 @@
+package filecmd
+
+import (
+	"bytes"
+	"cmdproto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"service/cmdlog"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	discard := log.New(ioutil.Discard, "", 0)
+	cmdlog.DefaultLogger = []*log.Logger{discard, discard}
+	os.Exit(m.Run())
+}
+
+// fileTree
+// a root srv/a next to srv/ab and outside, with symlinks out of and within
+// the root. the paths are real so they compare with what resolve returns.
+func fileTree(t *testing.T) (*FileCmd, string) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"srv/a/sub", "srv/ab", "outside"} {
+		if err = os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"srv/a/file", "srv/a/sub/file", "srv/ab/file", "outside/secret"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, file), []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"srv/a/out":    "../../outside",
+		"srv/a/secret": filepath.Join(dir, "outside/secret"),
+		"srv/a/in":     "sub",
+	}
+	for link, target := range links {
+		if err = os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fc := &FileCmd{}
+	if err = fc.Init(&FileCmdConfig{Roots: []string{filepath.Join(dir, "srv/a")}, MaxUpload: 100}); err != nil {
+		t.Fatal(err)
+	}
+	return fc, dir
+}
+
+func errCode(err error) int {
+	if fe, ok := err.(*fileError); ok {
+		return fe.code
+	}
+	return 0
+}
+
+func TestWithin(t *testing.T) {
+	tests := []struct {
+		path  string
+		roots []string
+		ok    bool
+	}{
+		{"/srv/a", []string{"/srv/a"}, true},
+		{"/srv/a/x/y", []string{"/srv/a"}, true},
+		{"/srv/ab", []string{"/srv/a"}, false},
+		{"/srv/ab/x", []string{"/srv/a"}, false},
+		{"/srv", []string{"/srv/a"}, false},
+		{"/srv/ab/x", []string{"/srv/a", "/srv/ab"}, true},
+		{"/etc/shadow", []string{"/"}, true},
+		{"/etc/shadow", nil, false},
+	}
+	for _, tt := range tests {
+		if ok := within(tt.path, tt.roots); ok != tt.ok {
+			t.Errorf("within(%s, %v) %v, want %v", tt.path, tt.roots, ok, tt.ok)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	fc, dir := fileTree(t)
+	tests := []struct {
+		path string
+		real string
+		code int
+	}{
+		{path: "srv/a/file", code: http.StatusBadRequest},
+		{path: "/srv/a/file", real: "/srv/a/file"},
+		{path: "/srv/a/./sub/../file", real: "/srv/a/file"},
+		{path: "/srv/a/in/file", real: "/srv/a/sub/file"},
+		{path: "/srv/a/missing", code: http.StatusNotFound},
+		{path: "/srv/a/out/secret", code: http.StatusForbidden},
+		{path: "/srv/a/secret", code: http.StatusForbidden},
+		{path: "/srv/a/../ab/file", code: http.StatusForbidden},
+		{path: "/srv/ab/file", code: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			path := tt.path
+			if filepath.IsAbs(path) {
+				path = dir + path
+			}
+			real, err := fc.resolve(path)
+			if tt.code != 0 {
+				if errCode(err) != tt.code {
+					t.Fatalf("error %v, want code %d", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if real != dir+tt.real {
+				t.Fatalf("real %s, want %s", real, dir+tt.real)
+			}
+		})
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	tests := []struct {
+		path    string
+		mkdir   bool
+		target  string
+		code    int
+		created string
+	}{
+		{path: "/srv/a/new", target: "/srv/a/new"},
+		{path: "/srv/a/in/new", target: "/srv/a/sub/new"},
+		{path: "/srv/a/secret", target: "/srv/a/secret"},
+		{path: "/srv/a/", code: http.StatusBadRequest},
+		{path: "/srv/a/sub", code: http.StatusBadRequest},
+		{path: "/srv/a/x/y/new", code: http.StatusNotFound},
+		{path: "/srv/a/x/y/new", mkdir: true, target: "/srv/a/x/y/new", created: "/srv/a/x/y"},
+		{path: "/srv/a/in/x/new", mkdir: true, target: "/srv/a/sub/x/new", created: "/srv/a/sub/x"},
+		{path: "/srv/a/out/new", code: http.StatusForbidden},
+		{path: "/srv/a/out/x/new", mkdir: true, code: http.StatusForbidden, created: "/outside/x"},
+		{path: "/srv/ab/x/new", mkdir: true, code: http.StatusForbidden, created: "/srv/ab/x"},
+		{path: "/srv/a/../ab/x/new", mkdir: true, code: http.StatusForbidden, created: "/srv/ab/x"},
+		{path: "/srv/x/new", mkdir: true, code: http.StatusForbidden, created: "/srv/x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			fc, dir := fileTree(t)
+			target, err := fc.resolveTarget(dir+tt.path, tt.mkdir)
+			_, statErr := os.Stat(dir + tt.created)
+			switch {
+			case tt.code != 0:
+				if errCode(err) != tt.code {
+					t.Fatalf("error %v, want code %d", err, tt.code)
+				}
+				if tt.created != "" && statErr == nil {
+					t.Fatalf("%s created outside the root", tt.created)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case target != dir+tt.target:
+				t.Fatalf("target %s, want %s", target, dir+tt.target)
+			case tt.created != "" && statErr != nil:
+				t.Fatalf("%s not created: %v", tt.created, statErr)
+			}
+		})
+	}
+}
+
+func TestUpload(t *testing.T) {
+	body := []byte("uploaded")
+	sum := sha256.Sum256(body)
+	hexSum := hex.EncodeToString(sum[:])
+	tests := []struct {
+		name   string
+		path   string
+		query  string
+		code   int
+		target string
+		mode   os.FileMode
+	}{
+		{name: "new file", path: "/srv/a/new", query: "mode=0600&sha256=" + hexSum,
+			code: http.StatusOK, target: "/srv/a/new", mode: 0600},
+		{name: "replaced file keeps its mode", path: "/srv/a/file", code: http.StatusOK,
+			target: "/srv/a/file", mode: 0644},
+		{name: "mkdir", path: "/srv/a/x/new", query: "mkdir=1&mode=0640", code: http.StatusOK,
+			target: "/srv/a/x/new", mode: 0640},
+		// the link itself is replaced, what it points to stays as it is.
+		{name: "over a symlink", path: "/srv/a/secret", query: "mode=0600", code: http.StatusOK,
+			target: "/srv/a/secret", mode: 0600},
+		{name: "symlinked parent", path: "/srv/a/out/secret", code: http.StatusForbidden},
+		{name: "mkdir out of the root", path: "/srv/ab/x/new", query: "mkdir=1", code: http.StatusForbidden},
+		{name: "sha256 mismatch", path: "/srv/a/file", query: "sha256=" + hexSum[1:] + "0",
+			code: http.StatusBadRequest},
+		{name: "bad mode", path: "/srv/a/file", query: "mode=999", code: http.StatusBadRequest},
+		{name: "relative", path: "srv/a/file", code: http.StatusBadRequest},
+		{name: "missing directory", path: "/srv/a/x/new", code: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc, dir := fileTree(t)
+			path := tt.path
+			if filepath.IsAbs(path) {
+				path = dir + path
+			}
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPut,
+				"/file?op=upload&path="+url.QueryEscape(path)+"&"+tt.query, bytes.NewReader(body))
+			fc.ServeHTTP(rec, req)
+			if rec.Code != tt.code {
+				t.Fatalf("code %d, want %d: %s", rec.Code, tt.code, rec.Body.String())
+			}
+			if secret, _ := ioutil.ReadFile(filepath.Join(dir, "outside/secret")); string(secret) != "outside/secret" {
+				t.Fatalf("file outside the root changed to %q", secret)
+			}
+			if tt.code != http.StatusOK {
+				if data, _ := ioutil.ReadFile(filepath.Join(dir, "srv/a/file")); string(data) != "srv/a/file" {
+					t.Fatalf("failed upload changed the file to %q", data)
+				}
+				return
+			}
+			res := &cmdproto.FileInfo{}
+			if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Path != dir+tt.target || res.Sha256 != hexSum {
+				t.Fatalf("path %s sha256 %s, want %s %s", res.Path, res.Sha256, dir+tt.target, hexSum)
+			}
+			info, err := os.Lstat(dir + tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.Mode().IsRegular() || info.Mode().Perm() != tt.mode {
+				t.Fatalf("mode %s, want a regular file of %s", info.Mode(), tt.mode)
+			}
+			data, err := ioutil.ReadFile(dir + tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sha256.Sum256(data); got != sum {
+				t.Fatalf("content %q, want %q", data, body)
+			}
+		})
+	}
+}
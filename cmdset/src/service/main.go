@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,15 +10,23 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"service/audit"
 	"service/cmdlog"
 	"service/cmds"
+	_ "service/filecmd"
+	_ "service/metrics"
 	_ "service/mgocmd"
+	"service/notify"
 	_ "service/sccmd"
+	_ "service/sched"
 	_ "service/syscmd"
-	"strings"
+	"syscall"
+	"time"
 )
 
 var configFileName *string = flag.String("config", "cmdconf.toml", "cmdset server configuration file name.")
+var verifyAudit *string = flag.String("verify_audit", "", "verify the hash chain of an audit log and exit.")
 
 var cmddConfig *CmddConfig
 var configClient *etcd.Client
@@ -34,6 +43,10 @@ func analyzeCmddConf(config map[string]toml.Primitive, md *toml.MetaData) error
 			return err
 		}
 		fmt.Printf("(%+v)\n", *cmddConfig)
+		if err = cmddConfig.validate(); err != nil {
+			fmt.Println(err.Error())
+			return err
+		}
 		return nil
 	} else {
 		fmt.Println("analyze cmddConfig failed")
@@ -41,36 +54,38 @@ func analyzeCmddConf(config map[string]toml.Primitive, md *toml.MetaData) error
 	}
 }
 
-func registerToConfigServer() error {
-	substrs := strings.SplitN(cmddConfig.ListenAddr, ":", 2)
-	ip, port := substrs[0], substrs[1]
-	if ip == "" {
-		conn, err := net.Dial("udp", "baidu.com:80")
-		if err != nil {
-			cmdlog.EPrintln(err.Error())
-			return err
-		}
-		//fmt.Printf("client addr :%s\n", conn.LocalAddr().String())
-		ip = strings.Split(conn.LocalAddr().String(), ":")[0] + ":" + port
-		conn.Close()
-	} else {
-		ip = ip + ":" + port
+// reloadCertificate
+// reloads the tls certificate and key, on SIGHUP.
+func reloadCertificate(reloader *cmds.CertReloader) {
+	if reloader == nil {
+		return
 	}
-	//todo:register to config server.
-	_, err := configClient.CreateDir(cmddConfig.ConfigDir, 0)
-	if err != nil {
-		cmdlog.EPrintln(err.Error())
+	if err := reloader.Reload(); err != nil {
+		cmdlog.EPrintf("reload certificate failed: %s\n", err.Error())
+		return
 	}
-	_, err = configClient.Set((cmddConfig.ConfigDir + "/" + ip), ip, 0)
+	cmdlog.Printf("certificate reloaded\n")
+}
+
+// verifyAuditLog
+// checks the audit log at path, the exit code is 0 only if it is intact.
+func verifyAuditLog(path string) int {
+	vr, err := audit.Verify(path)
 	if err != nil {
-		cmdlog.EPrintln(err.Error())
-		return err
+		fmt.Println(err.Error())
+		return 2
 	}
-
-	return nil
+	fmt.Println(vr.String())
+	if !vr.OK {
+		return 1
+	}
+	return 0
 }
 
 func main() {
+	if *verifyAudit != "" {
+		os.Exit(verifyAuditLog(*verifyAudit))
+	}
 	if configFileName == nil {
 		fmt.Println("without specifiy config file.")
 		os.Exit(1)
@@ -80,7 +95,10 @@ func main() {
 		os.Exit(1)
 	}
 	cmddConfig = &CmddConfig{BasicSvrConfig: BasicSvrConfig{ErrorLog: true, AccessLog: false},
-		ListenAddr: ":9000", ConfigDir: "/cmds"}
+		ListenAddr: ":9000", ConfigDir: "/cmds",
+		RegisterTTL:     cmds.Duration{Duration: 30 * time.Second},
+		Heartbeat:       cmds.Duration{Duration: 10 * time.Second},
+		ShutdownTimeout: cmds.Duration{Duration: 5 * time.Second}}
 	err = analyzeCmddConf(config, md)
 	if err != nil {
 		os.Exit(1)
@@ -91,7 +109,13 @@ func main() {
 		os.Exit(1)
 	}
 	configClient = etcd.NewClient(cmddConfig.ConfigServers)
-	err = registerToConfigServer()
+
+	err = cmds.InitAuthConf(config, md)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	err = notify.InitNotifyConf(config, md)
 	if err != nil {
 		os.Exit(1)
 	}
@@ -101,9 +125,63 @@ func main() {
 		os.Exit(1)
 	}
 
+	var reloader *cmds.CertReloader
 	cmdServer := &http.Server{Addr: cmddConfig.ListenAddr, Handler: cmds.CmdServerMux}
-	err = cmdServer.ListenAndServe()
+	if cmddConfig.TLSConfig.Enabled() {
+		cmdServer.TLSConfig, reloader, err = cmds.NewServerTLSConfig(&cmddConfig.TLSConfig)
+		if err != nil {
+			cmdlog.EPrintln(err.Error())
+			os.Exit(1)
+		}
+	}
+	ln, err := net.Listen("tcp", cmddConfig.ListenAddr)
 	if err != nil {
 		fmt.Printf("%s", err.Error())
+		os.Exit(1)
+	}
+	// register once the listener is up, so the agent is reachable when listed.
+	err = registerToConfigServer()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	stopWatch := make(chan bool)
+	if cmddConfig.WatchConfigKey != "" {
+		go watchConfigKey(cmddConfig.WatchConfigKey, stopWatch)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if cmdServer.TLSConfig != nil {
+			serveErr <- cmdServer.ServeTLS(ln, "", "")
+		} else {
+			serveErr <- cmdServer.Serve(ln)
+		}
+	}()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case s := <-c:
+			if s == syscall.SIGHUP {
+				reloadCertificate(reloader)
+				reloadConfigFile()
+				continue
+			}
+			cmdlog.Printf("Accept %s signal, quit server...\n", s.String())
+			close(stopWatch)
+			deregisterFromConfigServer()
+			ctx, cancel := context.WithTimeout(context.Background(), cmddConfig.ShutdownTimeout.Duration)
+			if err = cmdServer.Shutdown(ctx); err != nil {
+				cmdServer.Close()
+			}
+			cancel()
+			return
+		case err = <-serveErr:
+			fmt.Printf("%s", err.Error())
+			deregisterFromConfigServer()
+			os.Exit(1)
+		}
 	}
 }
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"service/cmds"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func gauge(name, help string, labels map[string]string, value float64) cmds.Metric {
+	return cmds.Metric{Name: name, Help: help, Type: "gauge", Labels: labels, Value: value}
+}
+
+// hostStats
+// disk, memory and load gauges of the host the agent runs on.
+func hostStats(mounts []string) []cmds.Metric {
+	res := []cmds.Metric{gauge("cmdserver_uptime_seconds", "Seconds since the agent started.",
+		nil, time.Since(startTime).Seconds())}
+	for _, mount := range mounts {
+		fs := syscall.Statfs_t{}
+		if err := syscall.Statfs(mount, &fs); err != nil {
+			continue
+		}
+		labels := map[string]string{"mountpoint": mount}
+		res = append(res,
+			gauge("cmdserver_host_disk_total_bytes", "Size of the filesystem.", labels,
+				float64(fs.Blocks)*float64(fs.Bsize)),
+			gauge("cmdserver_host_disk_free_bytes", "Free space of the filesystem.", labels,
+				float64(fs.Bfree)*float64(fs.Bsize)),
+			gauge("cmdserver_host_inodes_total", "Inodes of the filesystem.", labels, float64(fs.Files)),
+			gauge("cmdserver_host_inodes_free", "Free inodes of the filesystem.", labels, float64(fs.Ffree)))
+	}
+
+	if info, err := readMemInfo(); err == nil {
+		res = append(res,
+			gauge("cmdserver_host_memory_total_bytes", "MemTotal of /proc/meminfo.", nil, info["MemTotal"]),
+			gauge("cmdserver_host_memory_available_bytes", "MemAvailable of /proc/meminfo.", nil, info["MemAvailable"]),
+			gauge("cmdserver_host_swap_total_bytes", "SwapTotal of /proc/meminfo.", nil, info["SwapTotal"]),
+			gauge("cmdserver_host_swap_free_bytes", "SwapFree of /proc/meminfo.", nil, info["SwapFree"]))
+	}
+
+	if data, err := ioutil.ReadFile("/proc/loadavg"); err == nil {
+		fields := strings.Fields(string(data))
+		for i, period := range []string{"1", "5", "15"} {
+			if i >= len(fields) {
+				break
+			}
+			if load, err := strconv.ParseFloat(fields[i], 64); err == nil {
+				res = append(res, gauge("cmdserver_host_load", "Load average by period in minutes.",
+					map[string]string{"period": period}, load))
+			}
+		}
+	}
+	return res
+}
+
+// readMemInfo
+// /proc/meminfo in bytes.
+func readMemInfo() (map[string]float64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	res := make(map[string]float64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		val, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			val *= 1024
+		}
+		res[strings.TrimSuffix(fields[0], ":")] = val
+	}
+	return res, scanner.Err()
+}
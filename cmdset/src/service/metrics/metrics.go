@@ -0,0 +1,257 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"service/cmdlog"
+	"service/cmds"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsConfig
+// the [metrics] section, Mounts are the mountpoints exported as disk
+// gauges and Buckets the request latency histogram buckets in seconds.
+type MetricsConfig struct {
+	Mounts  []string  `toml:"mounts"`
+	Buckets []float64 `toml:"latency_buckets"`
+}
+
+type opKey struct {
+	handler string
+	op      string
+}
+
+type opStats struct {
+	codes   map[int]uint64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// MetricsHandler
+// serves the prometheus text format on /metrics.
+type MetricsHandler struct {
+	*MetricsConfig
+	lock     sync.Mutex
+	ops      map[opKey]*opStats
+	buckets  []float64
+	confLock sync.RWMutex
+}
+
+// ConfigStruct
+// slices are left nil, the toml decoder fails on preallocated slices
+// shorter than the configured array. defaults are filled in by setDefaults.
+func (mh *MetricsHandler) ConfigStruct() interface{} {
+	return &MetricsConfig{}
+}
+
+func (mc *MetricsConfig) setDefaults() {
+	if len(mc.Mounts) == 0 {
+		mc.Mounts = []string{"/"}
+	}
+	if len(mc.Buckets) == 0 {
+		mc.Buckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+	}
+}
+
+func (mh *MetricsHandler) Init(config interface{}) error {
+	mh.MetricsConfig = config.(*MetricsConfig)
+	mh.setDefaults()
+	cmdlog.Printf("MetricsHandler Init config :(%+v)\n", mh.MetricsConfig)
+	if !sort.Float64sAreSorted(mh.Buckets) {
+		err := errors.New("latency_buckets must be sorted")
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+	mh.ops = make(map[opKey]*opStats)
+	mh.buckets = mh.Buckets
+	cmds.ObserveRequests(mh.observe)
+	cmdlog.Printf("MetricsHandler Init ok\n")
+	return nil
+}
+
+// Reload
+// only mounts are applied, latency_buckets need a restart.
+func (mh *MetricsHandler) Reload(config interface{}) error {
+	newConf := config.(*MetricsConfig)
+	newConf.setDefaults()
+	mh.confLock.Lock()
+	defer mh.confLock.Unlock()
+	newConf.Buckets = mh.buckets
+	mh.MetricsConfig = newConf
+	return nil
+}
+
+func (mh *MetricsHandler) mounts() []string {
+	mh.confLock.RLock()
+	defer mh.confLock.RUnlock()
+	return mh.Mounts
+}
+
+// observe
+// counts a finished request, ops a handler does not support are folded
+// into "unsupported" and the ones of rejected requests into "rejected" so
+// clients can not blow up the label set.
+func (mh *MetricsHandler) observe(info *cmds.RequestInfo) {
+	key := opKey{info.Handler, info.Op}
+	switch info.Status {
+	case http.StatusNotImplemented:
+		key.op = "unsupported"
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestEntityTooLarge:
+		key.op = "rejected"
+	}
+	elapsed := info.Elapsed.Seconds()
+
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+	st, ok := mh.ops[key]
+	if !ok {
+		st = &opStats{codes: make(map[int]uint64), buckets: make([]uint64, len(mh.buckets))}
+		mh.ops[key] = st
+	}
+	st.codes[info.Status]++
+	for i, bound := range mh.buckets {
+		if elapsed <= bound {
+			st.buckets[i]++
+		}
+	}
+	st.sum += elapsed
+	st.count++
+}
+
+func (mh *MetricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	ioutil.ReadAll(req.Body)
+
+	var metrics []cmds.Metric
+	for name, handler := range cmds.CmdHandlers {
+		if !isEnabled(name) {
+			continue
+		}
+		if reporter, ok := handler.(cmds.StatsReporter); ok {
+			metrics = append(metrics, reporter.Stats()...)
+		}
+	}
+	metrics = append(metrics, hostStats(mh.mounts())...)
+
+	buf := &bytes.Buffer{}
+	writeMetrics(buf, metrics)
+	mh.writeRequestStats(buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+func isEnabled(name string) bool {
+	for _, k := range cmds.EnabledHandlers() {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (mh *MetricsHandler) writeRequestStats(buf *bytes.Buffer) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+	keys := make([]opKey, 0, len(mh.ops))
+	for key := range mh.ops {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].handler != keys[j].handler {
+			return keys[i].handler < keys[j].handler
+		}
+		return keys[i].op < keys[j].op
+	})
+
+	fmt.Fprintf(buf, "# HELP cmdserver_requests_total Requests served by handler, op and status code.\n")
+	fmt.Fprintf(buf, "# TYPE cmdserver_requests_total counter\n")
+	for _, key := range keys {
+		st := mh.ops[key]
+		codes := make([]int, 0, len(st.codes))
+		for code := range st.codes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(buf, "cmdserver_requests_total%s %d\n", formatLabels(map[string]string{
+				"handler": key.handler, "op": key.op, "code": strconv.Itoa(code)}), st.codes[code])
+		}
+	}
+
+	fmt.Fprintf(buf, "# HELP cmdserver_request_duration_seconds Request latency by handler and op.\n")
+	fmt.Fprintf(buf, "# TYPE cmdserver_request_duration_seconds histogram\n")
+	for _, key := range keys {
+		st := mh.ops[key]
+		labels := map[string]string{"handler": key.handler, "op": key.op}
+		for i, bound := range mh.buckets {
+			labels["le"] = strconv.FormatFloat(bound, 'g', -1, 64)
+			fmt.Fprintf(buf, "cmdserver_request_duration_seconds_bucket%s %d\n", formatLabels(labels), st.buckets[i])
+		}
+		labels["le"] = "+Inf"
+		fmt.Fprintf(buf, "cmdserver_request_duration_seconds_bucket%s %d\n", formatLabels(labels), st.count)
+		delete(labels, "le")
+		fmt.Fprintf(buf, "cmdserver_request_duration_seconds_sum%s %g\n", formatLabels(labels), st.sum)
+		fmt.Fprintf(buf, "cmdserver_request_duration_seconds_count%s %d\n", formatLabels(labels), st.count)
+	}
+}
+
+// writeMetrics
+// groups samples by name so every metric gets one HELP and TYPE line.
+func writeMetrics(buf *bytes.Buffer, metrics []cmds.Metric) {
+	byName := make(map[string][]cmds.Metric)
+	var names []string
+	for _, m := range metrics {
+		if _, ok := byName[m.Name]; !ok {
+			names = append(names, m.Name)
+		}
+		byName[m.Name] = append(byName[m.Name], m)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		samples := byName[name]
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, samples[0].Help)
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, samples[0].Type)
+		lines := make([]string, 0, len(samples))
+		for _, m := range samples {
+			lines = append(lines, fmt.Sprintf("%s%s %s", name, formatLabels(m.Labels),
+				strconv.FormatFloat(m.Value, 'g', -1, 64)))
+		}
+		sort.Strings(lines)
+		buf.WriteString(strings.Join(lines, "\n"))
+		buf.WriteString("\n")
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(labels[name])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var startTime = time.Now()
+
+func init() {
+	metricsHandler := &MetricsHandler{}
+	cmds.RegisterCmd("metrics", metricsHandler)
+}
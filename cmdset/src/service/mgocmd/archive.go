@@ -0,0 +1,470 @@
+package mgocmd
+
+import (
+	"bufio"
+	"bytes"
+	"cmdproto"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"service/cmdlog"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	archiveBSON  = "bson"
+	archiveJSONL = "jsonl"
+
+	manifestSuffix = ".manifest.json"
+	//documents of one insert on restore, bounded by restoreBatchBytes too.
+	restoreBatch      = 1000
+	restoreBatchBytes = 16 << 20
+	maxDocumentBytes  = 48 << 20
+)
+
+// ArchiveConfig
+// the [mongo.archive] section. with Dir set, every collection the retention
+// rules drop is first written to Dir/<target>/<db>, Dir/default/<db> for
+// the default target, as a gzipped stream of bson documents, or of
+// extended json lines with Format jsonl. jsonl is easier to read but
+// restores 32 bit integers as doubles and does not keep the order of
+// fields.
+type ArchiveConfig struct {
+	Dir    string `toml:"dir"`
+	Format string `toml:"format"`
+}
+
+func (ac *ArchiveConfig) validate() error {
+	switch ac.Format {
+	case "":
+		ac.Format = archiveBSON
+	case archiveBSON, archiveJSONL:
+	default:
+		return fmt.Errorf("archive format %s, bson or jsonl expected", ac.Format)
+	}
+	return nil
+}
+
+// hashWriter
+// counts and hashes what goes to the archive file.
+type hashWriter struct {
+	w    io.Writer
+	hash io.Writer
+	n    int64
+}
+
+func (hw *hashWriter) Write(data []byte) (int, error) {
+	n, err := hw.w.Write(data)
+	hw.hash.Write(data[:n])
+	hw.n += int64(n)
+	return n, err
+}
+
+// archiveName
+// refuses names that would leave the archive directory.
+func archiveName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/\\\x00") || strings.HasPrefix(name, ".") {
+		return newRequestError("bad archive name %q", name)
+	}
+	return nil
+}
+
+func writeManifest(dir string, manifest *cmdproto.ArchiveManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+manifest.Name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, manifest.Name+manifestSuffix))
+}
+
+// archiveCollection
+// streams db.coll to a new archive and writes its manifest once the file is
+// synced. the document count must match the collection count, so a
+// collection written to meanwhile is not archived, and then not dropped.
+func archiveCollection(session *mgo.Session, conf *ArchiveConfig, db, coll string) (*cmdproto.ArchiveManifest, error) {
+	if err := archiveName(coll); err != nil {
+		return nil, err
+	}
+	if err := archiveName(db); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(conf.Dir, db)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	manifest := &cmdproto.ArchiveManifest{Name: coll + "." + now.Format("20060102T150405Z"), DB: db,
+		Collection: coll, Format: conf.Format, Time: now}
+	manifest.File = manifest.Name + "." + conf.Format + ".gz"
+
+	c := session.DB(db).C(coll)
+	indexes, err := c.Indexes()
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		if index.Name == "_id_" {
+			continue
+		}
+		manifest.Indexes = append(manifest.Indexes, cmdproto.IndexSpec{Name: index.Name, Key: index.Key,
+			Unique: index.Unique, Sparse: index.Sparse, ExpireAfter: index.ExpireAfter.Seconds()})
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+manifest.Name+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	hw := &hashWriter{w: tmp, hash: hash}
+	gz := gzip.NewWriter(hw)
+	bw := bufio.NewWriter(gz)
+	iter := c.Find(nil).Iter()
+	var raw bson.Raw
+	for iter.Next(&raw) {
+		if conf.Format == archiveJSONL {
+			doc := bson.M{}
+			if err = raw.Unmarshal(&doc); err != nil {
+				iter.Close()
+				return nil, err
+			}
+			var line []byte
+			if line, err = bson.MarshalJSON(doc); err != nil {
+				iter.Close()
+				return nil, err
+			}
+			//MarshalJSON ends the document with a newline already.
+			_, err = bw.Write(line)
+		} else {
+			_, err = bw.Write(raw.Data)
+		}
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		manifest.Documents++
+		manifest.Bytes += int64(len(raw.Data))
+	}
+	if err = iter.Close(); err != nil {
+		return nil, err
+	}
+	if err = bw.Flush(); err != nil {
+		return nil, err
+	}
+	if err = gz.Close(); err != nil {
+		return nil, err
+	}
+	if err = tmp.Sync(); err != nil {
+		return nil, err
+	}
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+	count, err := c.Count()
+	if err != nil {
+		return nil, err
+	}
+	if int64(count) != manifest.Documents {
+		return nil, fmt.Errorf("%s.%s has %d documents, %d archived", db, coll, count, manifest.Documents)
+	}
+	manifest.Size = hw.n
+	manifest.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	if err = os.Rename(tmp.Name(), filepath.Join(dir, manifest.File)); err != nil {
+		return nil, err
+	}
+	if err = writeManifest(dir, manifest); err != nil {
+		os.Remove(filepath.Join(dir, manifest.File))
+		return nil, err
+	}
+	cmdlog.Printf("mongodb archived %d documents of %s.%s to %s\n", manifest.Documents, db, coll,
+		filepath.Join(dir, manifest.File))
+	return manifest, nil
+}
+
+func readManifest(dir, name string) (*cmdproto.ArchiveManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name+manifestSuffix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("archive %s not found", name)
+		}
+		return nil, err
+	}
+	manifest := &cmdproto.ArchiveManifest{}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("archive %s: bad manifest: %s", name, err.Error())
+	}
+	if err = archiveName(manifest.File); err != nil {
+		return nil, fmt.Errorf("archive %s: %s", name, err.Error())
+	}
+	return manifest, nil
+}
+
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// readDocument
+// the next document of a bson archive, io.EOF at the end.
+func readDocument(r *bufio.Reader) (bson.Raw, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("archive ends within a document")
+		}
+		return bson.Raw{}, err
+	}
+	size := int(binary.LittleEndian.Uint32(head[:]))
+	if size < 5 || size > maxDocumentBytes {
+		return bson.Raw{}, fmt.Errorf("bad document size %d", size)
+	}
+	data := make([]byte, size)
+	copy(data, head[:])
+	if _, err := io.ReadFull(r, data[4:]); err != nil {
+		return bson.Raw{}, errors.New("archive ends within a document")
+	}
+	return bson.Raw{Kind: 0x03, Data: data}, nil
+}
+
+// restoreArchive
+// imports archive name of db into the new collection coll of db, after
+// checking the file against its manifest. when an insert, the document
+// count or an index fails, coll is dropped again so the restore can be
+// retried.
+func restoreArchive(session *mgo.Session, conf *ArchiveConfig, db, name, coll string) (res string, err error) {
+	for _, val := range []string{db, name} {
+		if err := archiveName(val); err != nil {
+			return "", err
+		}
+	}
+	dir := filepath.Join(conf.Dir, db)
+	manifest, err := readManifest(dir, name)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, manifest.File)
+	sum, err := fileSha256(path)
+	if err != nil {
+		return "", err
+	}
+	if sum != manifest.Sha256 {
+		return "", fmt.Errorf("archive %s: sha256 %s, manifest has %s", name, sum, manifest.Sha256)
+	}
+	names, err := session.DB(db).CollectionNames()
+	if err != nil {
+		return "", err
+	}
+	for _, existing := range names {
+		if existing == coll {
+			return "", fmt.Errorf("collection %s.%s exists", db, coll)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	defer gz.Close()
+	r := bufio.NewReaderSize(gz, 1<<20)
+	c := session.DB(db).C(coll)
+	var (
+		batch      = make([]interface{}, 0, restoreBatch)
+		batchBytes int
+		restored   int64
+		created    bool
+	)
+	defer func() {
+		if err == nil || !created {
+			return
+		}
+		if dropErr := c.DropCollection(); dropErr != nil {
+			cmdlog.EPrintf("mongodb restore of %s: drop %s.%s: %s\n", name, db, coll, dropErr.Error())
+			return
+		}
+		err = fmt.Errorf("%s, %s.%s dropped", err.Error(), db, coll)
+	}()
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		created = true
+		if err := c.Insert(batch...); err != nil {
+			return err
+		}
+		restored += int64(len(batch))
+		batch, batchBytes = batch[:0], 0
+		return nil
+	}
+	for {
+		var doc interface{}
+		var size int
+		if manifest.Format == archiveJSONL {
+			line, err := r.ReadBytes('\n')
+			if err == io.EOF && len(line) == 0 {
+				break
+			}
+			if err != nil && err != io.EOF {
+				return "", err
+			}
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			m := bson.M{}
+			if err = bson.UnmarshalJSON(line, &m); err != nil {
+				return "", fmt.Errorf("archive %s document %d: %s", name, restored+int64(len(batch))+1, err.Error())
+			}
+			doc, size = m, len(line)
+		} else {
+			raw, err := readDocument(r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", fmt.Errorf("archive %s document %d: %s", name, restored+int64(len(batch))+1, err.Error())
+			}
+			doc, size = raw, len(raw.Data)
+		}
+		batch = append(batch, doc)
+		batchBytes += size
+		if len(batch) >= restoreBatch || batchBytes >= restoreBatchBytes {
+			if err = flush(); err != nil {
+				return "", err
+			}
+		}
+	}
+	if err = flush(); err != nil {
+		return "", err
+	}
+	if restored != manifest.Documents {
+		return "", fmt.Errorf("restored %d documents of %s into %s.%s, manifest has %d",
+			restored, name, db, coll, manifest.Documents)
+	}
+	for _, index := range manifest.Indexes {
+		err = c.EnsureIndex(mgo.Index{Name: index.Name, Key: index.Key, Unique: index.Unique, Sparse: index.Sparse,
+			ExpireAfter: time.Duration(index.ExpireAfter * float64(time.Second))})
+		if err != nil {
+			return "", fmt.Errorf("restored %d documents of %s into %s.%s, index %s: %s",
+				restored, name, db, coll, index.Name, err.Error())
+		}
+	}
+	cmdlog.Printf("mongodb restored %d documents of %s into %s.%s\n", restored, name, db, coll)
+	return fmt.Sprintf("restored %d documents of %s into %s.%s", restored, name, db, coll), nil
+}
+
+// listArchives
+// the manifests of db, or of every archived database when db is empty,
+// oldest first.
+func listArchives(conf *ArchiveConfig, db string) ([]*cmdproto.ArchiveManifest, error) {
+	dbs := []string{db}
+	if db == "" {
+		entries, err := ioutil.ReadDir(conf.Dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		dbs = dbs[:0]
+		for _, entry := range entries {
+			if entry.IsDir() {
+				dbs = append(dbs, entry.Name())
+			}
+		}
+	} else if err := archiveName(db); err != nil {
+		return nil, err
+	}
+	manifests := make([]*cmdproto.ArchiveManifest, 0, 16)
+	for _, db := range dbs {
+		dir := filepath.Join(conf.Dir, db)
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, manifestSuffix) {
+				continue
+			}
+			manifest, err := readManifest(dir, strings.TrimSuffix(name, manifestSuffix))
+			if err != nil {
+				cmdlog.EPrintln(err.Error())
+				continue
+			}
+			manifests = append(manifests, manifest)
+		}
+	}
+	sort.SliceStable(manifests, func(i, j int) bool {
+		return manifests[i].Time.Before(manifests[j].Time)
+	})
+	return manifests, nil
+}
+
+// restoreHandler
+// args are the archive name and the new collection of db to import it to.
+func restoreHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	if len(req.DBCmd.Args) != 2 {
+		return nil, newRequestError("restore needs the archive name and the new collection")
+	}
+	conf, err := mt.archiveConfig()
+	if err != nil {
+		return nil, err
+	}
+	session, err := mt.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	return restoreArchive(session, conf, req.DB, req.DBCmd.Args[0], req.DBCmd.Args[1])
+}
+
+func archivesHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	conf, err := mt.archiveConfig()
+	if err != nil {
+		return nil, err
+	}
+	manifests, err := listArchives(conf, req.DB)
+	if err != nil {
+		return nil, err
+	}
+	return marshalResult(manifests)
+}
@@ -0,0 +1,350 @@
+package mgocmd
+
+import (
+	"cmdproto"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// indexBuilds
+// the builds kept for the indexBuilds op.
+const indexBuilds = 50
+
+// createOptions
+// the options of createIndex, Background defaults to true.
+type createOptions struct {
+	Name        string  `json:"name"`
+	Unique      bool    `json:"unique"`
+	Sparse      bool    `json:"sparse"`
+	ExpireAfter float64 `json:"expire_after"`
+	Background  *bool   `json:"background"`
+}
+
+// collFilter
+// the names of db to list: a retention rule name of db selects the names
+// its pattern matches, anything else is a regexp.
+func (mt *mgoTarget) collFilter(db, filter string) (*regexp.Regexp, error) {
+	if filter == "" {
+		return nil, nil
+	}
+	for _, rule := range mt.retentionRules() {
+		if rule.DB == db && rule.Name == filter {
+			return rule.reg, nil
+		}
+	}
+	reg, err := regexp.Compile(filter)
+	if err != nil {
+		return nil, newRequestError("bad collection filter %s: %s", filter, err.Error())
+	}
+	return reg, nil
+}
+
+func collInfo(session *mgo.Session, db, name string) (*cmdproto.CollInfo, error) {
+	stats := bson.M{}
+	if err := session.DB(db).Run(bson.D{{Name: "collStats", Value: name}}, &stats); err != nil {
+		return nil, fmt.Errorf("collStats %s.%s: %s", db, name, err.Error())
+	}
+	info := &cmdproto.CollInfo{Name: name, IndexSizes: make(map[string]int64)}
+	for _, field := range []struct {
+		key string
+		val *int64
+	}{{"count", &info.Count}, {"size", &info.Size}, {"storageSize", &info.StorageSize},
+		{"avgObjSize", &info.AvgObjSize}, {"totalIndexSize", &info.TotalIndexSize}} {
+		v, _ := toFloat(stats[field.key])
+		*field.val = int64(v)
+	}
+	if sizes, ok := stats["indexSizes"].(bson.M); ok {
+		for index, size := range sizes {
+			v, _ := toFloat(size)
+			info.IndexSizes[index] = int64(v)
+		}
+	}
+	return info, nil
+}
+
+func collArg(req *cmdproto.MgoRequest, op string, n int) error {
+	if req.DB == "" {
+		return newRequestError("%s needs the db", op)
+	}
+	if len(req.DBCmd.Args) < n || req.DBCmd.Args[0] == "" {
+		return newRequestError("%s needs the collection", op)
+	}
+	return nil
+}
+
+// collectionsHandler
+// the collStats of the collections of db, system collections left out. the
+// optional arg filters the names, see collFilter.
+func collectionsHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	if req.DB == "" {
+		return nil, newRequestError("collections needs the db")
+	}
+	filter := ""
+	if len(req.DBCmd.Args) > 0 {
+		filter = req.DBCmd.Args[0]
+	}
+	reg, err := mt.collFilter(req.DB, filter)
+	if err != nil {
+		return nil, err
+	}
+	session, err := mt.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	names, err := session.DB(req.DB).CollectionNames()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	infos := make([]*cmdproto.CollInfo, 0, len(names))
+	for _, name := range names {
+		if strings.HasPrefix(name, "system.") || (reg != nil && !reg.MatchString(name)) {
+			continue
+		}
+		info, err := collInfo(session, req.DB, name)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return marshalResult(infos)
+}
+
+// indexesHandler
+// the indexes of the collection in the first arg with their sizes.
+func indexesHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	if err = collArg(req, "indexes", 1); err != nil {
+		return nil, err
+	}
+	coll := req.DBCmd.Args[0]
+	session, err := mt.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	indexes, err := session.DB(req.DB).C(coll).Indexes()
+	if err != nil {
+		return nil, err
+	}
+	info, err := collInfo(session, req.DB, coll)
+	if err != nil {
+		return nil, err
+	}
+	specs := make([]cmdproto.IndexSpec, 0, len(indexes))
+	for _, index := range indexes {
+		specs = append(specs, cmdproto.IndexSpec{Name: index.Name, Key: index.Key, Unique: index.Unique,
+			Sparse: index.Sparse, ExpireAfter: index.ExpireAfter.Seconds(), Size: info.IndexSizes[index.Name]})
+	}
+	return marshalResult(specs)
+}
+
+func (mt *mgoTarget) addBuild(build *cmdproto.IndexBuild) error {
+	mt.buildLock.Lock()
+	defer mt.buildLock.Unlock()
+	for _, running := range mt.builds {
+		if running.State == "running" && running.DB == build.DB && running.Collection == build.Collection &&
+			running.Index.Name == build.Index.Name {
+			return fmt.Errorf("index %s of %s.%s is being built", build.Index.Name, build.DB, build.Collection)
+		}
+	}
+	mt.builds = append(mt.builds, build)
+	if len(mt.builds) > indexBuilds {
+		//builds still running stay visible.
+		kept := mt.builds[:0]
+		drop := len(mt.builds) - indexBuilds
+		for _, b := range mt.builds {
+			if drop > 0 && b.State != "running" {
+				drop--
+				continue
+			}
+			kept = append(kept, b)
+		}
+		mt.builds = kept
+	}
+	return nil
+}
+
+func (mt *mgoTarget) buildIndex(session *mgo.Session, build *cmdproto.IndexBuild, index mgo.Index) error {
+	err := session.DB(build.DB).C(build.Collection).EnsureIndex(index)
+	now := time.Now()
+	mt.buildLock.Lock()
+	defer mt.buildLock.Unlock()
+	build.Finished = &now
+	if err != nil {
+		build.State, build.Error = "failed", err.Error()
+	} else {
+		build.State = "done"
+	}
+	return err
+}
+
+// indexName
+// the name mongod gives an index without one, like host_1_time_-1.
+func indexName(key []string) string {
+	parts := make([]string, 0, 2*len(key))
+	for _, field := range key {
+		order := "1"
+		if i := strings.IndexByte(field, ':'); i > 0 && strings.HasPrefix(field, "$") {
+			field, order = field[i+1:], field[1:i]
+		}
+		switch {
+		case strings.HasPrefix(field, "-"):
+			field, order = field[1:], "-1"
+		case strings.HasPrefix(field, "@"):
+			field, order = field[1:], "2d"
+		case strings.HasPrefix(field, "+"):
+			field = field[1:]
+		}
+		parts = append(parts, field, order)
+	}
+	return strings.Join(parts, "_")
+}
+
+// createIndexHandler
+// args are the collection and the key fields, - prefixed for descending.
+// background builds return at once, the indexBuilds op follows them.
+func createIndexHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	if err = collArg(req, "createIndex", 2); err != nil {
+		return nil, newRequestError("createIndex needs the db, the collection and the key fields")
+	}
+	opts := &createOptions{}
+	if len(req.DBCmd.Options) > 0 {
+		if err = json.Unmarshal(req.DBCmd.Options, opts); err != nil {
+			return nil, newRequestError("bad createIndex options: %s", err.Error())
+		}
+	}
+	if opts.ExpireAfter < 0 {
+		return nil, newRequestError("expire_after must not be negative")
+	}
+	background := opts.Background == nil || *opts.Background
+	key := append([]string(nil), req.DBCmd.Args[1:]...)
+	index := mgo.Index{Key: key, Name: opts.Name, Unique: opts.Unique, Sparse: opts.Sparse,
+		Background: background, ExpireAfter: time.Duration(opts.ExpireAfter * float64(time.Second))}
+	if index.Name == "" {
+		index.Name = indexName(key)
+	}
+	build := &cmdproto.IndexBuild{DB: req.DB, Collection: req.DBCmd.Args[0], Background: background,
+		State: "running", Started: time.Now(), Index: cmdproto.IndexSpec{Name: index.Name, Key: key,
+			Unique: opts.Unique, Sparse: opts.Sparse, ExpireAfter: opts.ExpireAfter}}
+	session, err := mt.acquire()
+	if err != nil {
+		return nil, err
+	}
+	if err = mt.addBuild(build); err != nil {
+		session.Close()
+		return nil, err
+	}
+	//a build may take far longer than any socket timeout.
+	session.SetSocketTimeout(0)
+	if !background {
+		defer session.Close()
+		if err = mt.buildIndex(session, build, index); err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("index %s of %s.%s built", index.Name, build.DB, build.Collection), nil
+	}
+	go func() {
+		defer session.Close()
+		mt.failed(mt.buildIndex(session, build, index))
+	}()
+	return fmt.Sprintf("index %s of %s.%s building in background", index.Name, build.DB, build.Collection), nil
+}
+
+// dropIndexHandler
+// args are the collection and the index name, _id_ is never dropped.
+func dropIndexHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	if err = collArg(req, "dropIndex", 2); err != nil || len(req.DBCmd.Args) != 2 {
+		return nil, newRequestError("dropIndex needs the db, the collection and the index name")
+	}
+	coll, name := req.DBCmd.Args[0], req.DBCmd.Args[1]
+	if name == "_id_" {
+		return nil, &deniedError{"the _id_ index cannot be dropped"}
+	}
+	session, err := mt.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	if err = session.DB(req.DB).C(coll).DropIndexName(name); err != nil {
+		return nil, err
+	}
+	return fmt.Sprintf("index %s of %s.%s dropped", name, req.DB, coll), nil
+}
+
+// buildProgress
+// the currentOp message and counts of the index builds running on ns.
+func buildProgress(session *mgo.Session) (map[string]bson.M, error) {
+	ops := struct {
+		Inprog []bson.M `bson:"inprog"`
+	}{}
+	if err := session.DB("admin").Run(bson.D{{Name: "currentOp", Value: 1}}, &ops); err != nil {
+		return nil, err
+	}
+	progress := make(map[string]bson.M)
+	for _, op := range ops.Inprog {
+		msg, _ := op["msg"].(string)
+		command, _ := op["command"].(bson.M)
+		if !strings.HasPrefix(msg, "Index Build") && (command == nil || command["createIndexes"] == nil) {
+			continue
+		}
+		ns, _ := op["ns"].(string)
+		if command != nil {
+			if coll, ok := command["createIndexes"].(string); ok {
+				ns = ns[:strings.IndexByte(ns+".", '.')] + "." + coll
+			}
+		}
+		//the op carrying the progress counts wins.
+		if _, ok := op["progress"]; ok || progress[ns] == nil {
+			progress[ns] = op
+		}
+	}
+	return progress, nil
+}
+
+// indexBuildsHandler
+// the builds started by createIndex, running ones with their progress.
+func indexBuildsHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	mt.buildLock.Lock()
+	builds := make([]cmdproto.IndexBuild, 0, len(mt.builds))
+	running := false
+	for _, build := range mt.builds {
+		if req.DB == "" || build.DB == req.DB {
+			builds = append(builds, *build)
+			running = running || build.State == "running"
+		}
+	}
+	mt.buildLock.Unlock()
+	if !running {
+		return marshalResult(builds)
+	}
+	session, err := mt.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	progress, err := buildProgress(session)
+	if err != nil {
+		return nil, err
+	}
+	for i := range builds {
+		build := &builds[i]
+		op := progress[build.DB+"."+build.Collection]
+		if build.State != "running" || op == nil {
+			continue
+		}
+		build.Progress, _ = op["msg"].(string)
+		if counts, ok := op["progress"].(bson.M); ok {
+			done, _ := toFloat(counts["done"])
+			total, _ := toFloat(counts["total"])
+			build.Done, build.Total = int64(done), int64(total)
+		}
+	}
+	return marshalResult(builds)
+}
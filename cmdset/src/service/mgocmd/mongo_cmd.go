@@ -3,15 +3,18 @@ package mgocmd
 import (
 	"cmdproto"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"regexp"
 	"service/cmdlog"
 	"service/cmds"
-	"sort"
+	"service/notify"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -26,21 +29,32 @@ func (d *duration) UnmarshalText(text []byte) error {
 	return err
 }
 
+// MgoCmdConfig
+// the [mongo] section, its TargetConfig fields are the default target and
+// Targets the further ones. the other settings apply to every target.
 type MgoCmdConfig struct {
-	MgoAddrs          []string `toml:"addr"`
-	MgoReqPoolSize    int      `toml:"request_pool_size"`
-	MgoLRUGate        int      `toml:"lru_percent"`
-	DiskCheckInterval duration `toml:"check_interval"`
+	TargetConfig
+	MgoReqPoolSize    int                     `toml:"request_pool_size"`
+	MgoLRUGate        int                     `toml:"lru_percent"`
+	DiskCheckInterval duration                `toml:"check_interval"`
+	StatsDBs          []string                `toml:"stats_dbs"`
+	Archive           ArchiveConfig           `toml:"archive"`
+	RSMon             RSMonConfig             `toml:"rsmon"`
+	RunAllow          []string                `toml:"run_allow"`
+	DialTimeout       duration                `toml:"dial_timeout"`
+	SocketTimeout     duration                `toml:"socket_timeout"`
+	ReadPreference    string                  `toml:"read_preference"`
+	ReconnectBackoff  duration                `toml:"reconnect_backoff"`
+	MaxBackoff        duration                `toml:"max_backoff"`
+	Targets           map[string]TargetConfig `toml:"targets"`
 }
 
 type MgoCmd struct {
 	*MgoCmdConfig
-	cmdHandlers   map[string]func(mc *MgoCmd, req *cmdproto.MgoRequest) (interface{}, error)
-	cmdReqPool    chan *cmdproto.MgoRequest
-	mgoSession    *mgo.Session
-	diskMonState  int32
-	stopDiskMonCh chan bool
-	dbMonState    int32
+	cmdHandlers map[string]func(mt *mgoTarget, req *cmdproto.MgoRequest) (interface{}, error)
+	cmdReqPool  chan *cmdproto.MgoRequest
+	confLock    sync.RWMutex
+	targets     map[string]*mgoTarget
 }
 
 func (mc *MgoCmd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -56,6 +70,7 @@ func (mc *MgoCmd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	mgoReq := mc.getAvalibleReq()
 
 	defer mc.recycle(mgoReq)
+	*mgoReq = cmdproto.MgoRequest{}
 	err = json.Unmarshal(data, mgoReq)
 	if err != nil {
 		cmdlog.EPrintf("%s\n", err.Error())
@@ -63,10 +78,34 @@ func (mc *MgoCmd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	if handler, ok := mc.cmdHandlers[mgoReq.DBCmd.DBCmd]; ok {
-		res, err := handler(mc, mgoReq)
+		mt, err := mc.lookupTarget(mgoReq.Target)
 		if err != nil {
 			cmdlog.EPrintf("%s\n", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		res, err := handler(mt, mgoReq)
+		if err != nil {
+			cmdlog.EPrintf("%s\n", err.Error())
+			status := http.StatusInternalServerError
+			switch err.(type) {
+			case *deniedError:
+				status = http.StatusForbidden
+			case *requestError:
+				status = http.StatusBadRequest
+			default:
+				if err == errNotConnected {
+					status = http.StatusServiceUnavailable
+				}
+				mt.failed(err)
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if data, ok := res.(jsonResult); ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(data)
 			return
 		}
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -89,44 +128,359 @@ func (mc *MgoCmd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (mc *MgoCmd) DescribeRequest(req *http.Request) (string, []string, error) {
+	data, err := cmds.PeekBody(req)
+	if err != nil {
+		return "", nil, err
+	}
+	mgoReq := &cmdproto.MgoRequest{}
+	if err = json.Unmarshal(data, mgoReq); err != nil {
+		return "", nil, err
+	}
+	db := mgoReq.DB
+	if mgoReq.Target != "" {
+		db = mgoReq.Target + ":" + db
+	}
+	return mgoReq.DBCmd.DBCmd, append([]string{db}, mgoReq.DBCmd.Args...), nil
+}
+
+// ConfigStruct
+// addr is left nil, the toml decoder sizes it to the configured array.
 func (mc *MgoCmd) ConfigStruct() interface{} {
 	return &MgoCmdConfig{
-		MgoAddrs:          make([]string, 100), //some risk if config array exceed 100.
 		MgoReqPoolSize:    100,
 		MgoLRUGate:        20,
 		DiskCheckInterval: duration{time.Minute * 30},
+		DialTimeout:       duration{5 * time.Second},
+		SocketTimeout:     duration{time.Minute},
+		ReadPreference:    "primary",
+		ReconnectBackoff:  duration{time.Second},
+		MaxBackoff:        duration{time.Minute},
+		RSMon: RSMonConfig{Interval: duration{30 * time.Second}, MaxLag: duration{30 * time.Second},
+			MaxConnPercent: 80, Failures: 3},
 	}
 }
 
 func (mc *MgoCmd) Init(config interface{}) (err error) {
 	mc.MgoCmdConfig = config.(*MgoCmdConfig)
 	cmdlog.Printf("MgoCmd Init config :(%+v)\n", mc.MgoCmdConfig)
+	confs, rules, err := targetConfigs(mc.MgoCmdConfig)
+	if err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+	if err = mc.Archive.validate(); err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+	if err = mc.RSMon.validate(); err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+	if mc.RunAllow == nil {
+		mc.RunAllow = defaultRunAllow
+	}
+	if err = mc.validateSession(); err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
 
-	mc.cmdHandlers = make(map[string]func(mc *MgoCmd, req *cmdproto.MgoRequest) (interface{}, error))
+	mc.cmdHandlers = make(map[string]func(mt *mgoTarget, req *cmdproto.MgoRequest) (interface{}, error))
 	mc.cmdReqPool = make(chan *cmdproto.MgoRequest, mc.MgoReqPoolSize)
 	//allocates fixed size request pool.
 	for i := 0; i < mc.MgoReqPoolSize; i++ {
 		mgoReq := &cmdproto.MgoRequest{}
 		mc.cmdReqPool <- mgoReq
 	}
-	dialInfo := &mgo.DialInfo{Addrs: mc.MgoAddrs, Timeout: (500 * time.Millisecond)}
-	mc.mgoSession, err = mgo.DialWithInfo(dialInfo)
-	if err != nil {
-		cmdlog.EPrintln(err.Error())
-		return err
+	mc.targets = make(map[string]*mgoTarget, len(confs))
+	for name, conf := range confs {
+		mc.targets[name] = newTarget(mc, name, conf, rules[name])
 	}
-	mc.stopDiskMonCh = make(chan bool)
+	startTargets(mc.targetList())
 	mc.register("dbStats", statsHandler)
+	mc.register("health", healthHandler)
 	mc.register("diskMonB", diskMonStartHandler)
 	mc.register("diskMonE", diskMonEndHandler)
 	mc.register("dbMonB", dbMonStartHandler)
-	//mc.register("dbMonE", dbMonEndHandler)
+	mc.register("dbMonE", dbMonEndHandler)
+	mc.register("rsMonB", rsMonStartHandler)
+	mc.register("rsMonE", rsMonEndHandler)
+	mc.register("rsMonStatus", rsMonStatusHandler)
+	mc.register("run", runHandler)
+	mc.register("collections", collectionsHandler)
+	mc.register("indexes", indexesHandler)
+	mc.register("createIndex", createIndexHandler)
+	mc.register("dropIndex", dropIndexHandler)
+	mc.register("indexBuilds", indexBuildsHandler)
+	mc.register("dry-run", dryRunHandler)
+	mc.register("report", reportHandler)
+	mc.register("restore", restoreHandler)
+	mc.register("archives", archivesHandler)
+	cmds.RegisterTask("mongo.retention", mc.retentionTask)
+	// schedules saved before retention replaced the lru drop.
+	cmds.RegisterTask("mongo.lru", mc.retentionTask)
 
 	cmdlog.Printf("MgoCmd Init ok\n")
 	return nil
 }
 
-func (mc *MgoCmd) register(cmd string, handler func(mc *MgoCmd, req *cmdproto.MgoRequest) (interface{}, error)) {
+// retentionTask
+// the mongo.retention task, also known as mongo.lru. args are the database
+// and the target, both optional. without a target it runs every target
+// with rules for the database.
+func (mc *MgoCmd) retentionTask(args []string) (string, error) {
+	if len(args) > 2 {
+		return "", errors.New("mongo.retention takes at most the database and the target")
+	}
+	db := ""
+	if len(args) > 0 {
+		db = args[0]
+	}
+	targets := mc.targetList()
+	if len(args) == 2 {
+		mt, err := mc.lookupTarget(args[1])
+		if err != nil {
+			return "", err
+		}
+		targets = []*mgoTarget{mt}
+	}
+	var reports []*cmdproto.RetentionReport
+	var failed []string
+	ran := false
+	for _, mt := range targets {
+		if len(targets) > 1 && !mt.hasRules(db) {
+			continue
+		}
+		ran = true
+		res, err := mt.retentionRun(db, false)
+		reports = append(reports, res...)
+		if err != nil {
+			failed = append(failed, mt.name+": "+err.Error())
+		}
+	}
+	if !ran {
+		return "", errors.New("no retention rules configured")
+	}
+	if len(failed) > 0 {
+		return "", fmt.Errorf("%s, failed %s", summarize(reports), strings.Join(failed, "; "))
+	}
+	return summarize(reports), nil
+}
+
+// Reload
+// validates the new config and dials a new session before switching when
+// the addresses, credentials, timeouts or read preference of a target
+// changed. added targets are dialed like on Init, removed ones stop their
+// monitors. running monitors pick up lru_percent, check_interval, the
+// retention rules and the rsmon thresholds on their next tick.
+func (mc *MgoCmd) Reload(config interface{}) error {
+	newConf := config.(*MgoCmdConfig)
+	if newConf.MgoLRUGate < 0 || newConf.MgoLRUGate > 100 {
+		return fmt.Errorf("lru_percent %d out of range 0-100", newConf.MgoLRUGate)
+	}
+	if newConf.DiskCheckInterval.Duration <= 0 {
+		return errors.New("check_interval must be positive")
+	}
+	confs, rules, err := targetConfigs(newConf)
+	if err != nil {
+		return err
+	}
+	if err = newConf.Archive.validate(); err != nil {
+		return err
+	}
+	if err = newConf.RSMon.validate(); err != nil {
+		return err
+	}
+	if newConf.RunAllow == nil {
+		newConf.RunAllow = defaultRunAllow
+	}
+	if err = newConf.validateSession(); err != nil {
+		return err
+	}
+
+	oldConf := mc.config()
+	if newConf.MgoReqPoolSize != oldConf.MgoReqPoolSize {
+		cmdlog.EPrintf("MgoCmd request_pool_size change needs a restart\n")
+		newConf.MgoReqPoolSize = oldConf.MgoReqPoolSize
+	}
+	newSessions := make(map[string]*mgo.Session)
+	for _, mt := range mc.targetList() {
+		conf, ok := confs[mt.name]
+		if !ok || sameSession(newConf, oldConf, conf, mt.targetConfig()) {
+			continue
+		}
+		session, err := dialMongo(newConf, conf)
+		if err != nil {
+			for _, session := range newSessions {
+				session.Close()
+			}
+			return fmt.Errorf("mongo target %s: %s", mt.name, err.Error())
+		}
+		newSessions[mt.name] = session
+	}
+
+	var added, removed []*mgoTarget
+	var oldSessions []*mgo.Session
+	mc.confLock.Lock()
+	mc.MgoCmdConfig = newConf
+	for name, mt := range mc.targets {
+		if _, ok := confs[name]; !ok {
+			removed = append(removed, mt)
+			delete(mc.targets, name)
+		}
+	}
+	for name, conf := range confs {
+		mt, ok := mc.targets[name]
+		if !ok {
+			mt = newTarget(mc, name, conf, rules[name])
+			mc.targets[name] = mt
+			added = append(added, mt)
+			continue
+		}
+		mt.conf, mt.retention = conf, rules[name]
+		if session, ok := newSessions[name]; ok {
+			if mt.mgoSession != nil {
+				oldSessions = append(oldSessions, mt.mgoSession)
+			}
+			mt.mgoSession = session
+		}
+	}
+	mc.confLock.Unlock()
+	for name := range newSessions {
+		if mt, err := mc.lookupTarget(name); err == nil {
+			mt.connected(true, nil)
+		}
+	}
+	for _, session := range oldSessions {
+		session.Close()
+	}
+	for _, mt := range removed {
+		cmdlog.Printf("mongo target %s removed\n", mt.name)
+		mt.close()
+	}
+	for _, mt := range added {
+		cmdlog.Printf("mongo target %s added\n", mt.name)
+	}
+	startTargets(added)
+	return nil
+}
+
+func (mc *MgoCmd) config() *MgoCmdConfig {
+	mc.confLock.RLock()
+	defer mc.confLock.RUnlock()
+	return mc.MgoCmdConfig
+}
+
+func sameAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Stats
+// pool occupancy and the metrics of every target, labeled with its name.
+func (mc *MgoCmd) Stats() []cmds.Metric {
+	res := cmds.PoolStats("mongo", cap(mc.cmdReqPool), len(mc.cmdReqPool))
+	for _, mt := range mc.targetList() {
+		res = append(res, mt.stats()...)
+	}
+	return res
+}
+
+// stats
+// selected serverStatus fields and the dbStats of the stats_dbs databases,
+// read with a short timeout so a stuck mongod does not stall the scrape.
+func (mt *mgoTarget) stats() []cmds.Metric {
+	var res []cmds.Metric
+	labels := func(kv ...string) map[string]string {
+		res := map[string]string{"target": mt.name}
+		for i := 0; i+1 < len(kv); i += 2 {
+			res[kv[i]] = kv[i+1]
+		}
+		return res
+	}
+	status := bson.M{}
+	up := 1.0
+	session, err := mt.acquire()
+	if err != nil {
+		up = 0
+	} else {
+		defer session.Close()
+		session.SetSocketTimeout(2 * time.Second)
+		if err = session.Run("serverStatus", &status); err != nil {
+			cmdlog.EPrintln(err.Error())
+			mt.failed(err)
+			up = 0
+		}
+	}
+	res = append(res, cmds.Metric{Name: "cmdserver_mongo_up", Help: "Whether serverStatus succeeded.",
+		Type: "gauge", Labels: labels(), Value: up})
+	if up == 0 {
+		return res
+	}
+	gauge := func(name, help string, labels map[string]string, val interface{}) {
+		if v, ok := toFloat(val); ok {
+			res = append(res, cmds.Metric{Name: name, Help: help, Type: "gauge", Labels: labels, Value: v})
+		}
+	}
+	gauge("cmdserver_mongo_uptime_seconds", "mongod uptime.", labels(), status["uptime"])
+	if conns, ok := status["connections"].(bson.M); ok {
+		gauge("cmdserver_mongo_connections", "mongod connections by state.",
+			labels("state", "current"), conns["current"])
+		gauge("cmdserver_mongo_connections", "mongod connections by state.",
+			labels("state", "available"), conns["available"])
+	}
+	if mem, ok := status["mem"].(bson.M); ok {
+		if v, ok := toFloat(mem["resident"]); ok {
+			gauge("cmdserver_mongo_resident_bytes", "mongod resident memory.", labels(), v*1024*1024)
+		}
+	}
+	if ops, ok := status["opcounters"].(bson.M); ok {
+		for op, val := range ops {
+			if v, ok := toFloat(val); ok {
+				res = append(res, cmds.Metric{Name: "cmdserver_mongo_ops_total", Help: "mongod opcounters.",
+					Type: "counter", Labels: labels("op", op), Value: v})
+			}
+		}
+	}
+
+	for _, db := range mt.config().StatsDBs {
+		stats := bson.M{}
+		if err := session.DB(db).Run("dbStats", &stats); err != nil {
+			cmdlog.EPrintln(err.Error())
+			continue
+		}
+		labels := labels("db", db)
+		gauge("cmdserver_mongo_db_data_bytes", "dbStats dataSize.", labels, stats["dataSize"])
+		gauge("cmdserver_mongo_db_storage_bytes", "dbStats storageSize.", labels, stats["storageSize"])
+		gauge("cmdserver_mongo_db_index_bytes", "dbStats indexSize.", labels, stats["indexSize"])
+		gauge("cmdserver_mongo_db_objects", "dbStats objects.", labels, stats["objects"])
+		gauge("cmdserver_mongo_db_collections", "dbStats collections.", labels, stats["collections"])
+	}
+	return res
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func (mc *MgoCmd) register(cmd string, handler func(mt *mgoTarget, req *cmdproto.MgoRequest) (interface{}, error)) {
 	if _, ok := mc.cmdHandlers[cmd]; ok {
 		cmdlog.EPrintf("duplicate mongo cmd %s handler registered!\n", cmd)
 		return
@@ -144,9 +498,14 @@ func (mc *MgoCmd) recycle(mgoReq *cmdproto.MgoRequest) {
 	mc.cmdReqPool <- mgoReq
 }
 
-func statsHandler(mc *MgoCmd, req *cmdproto.MgoRequest) (res interface{}, err error) {
+func statsHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	session, err := mt.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
 	result := make(map[string]interface{})
-	err = mc.mgoSession.DB(req.DB).Run(req.DBCmd.DBCmd, result)
+	err = session.DB(req.DB).Run(req.DBCmd.DBCmd, result)
 	if err != nil {
 		cmdlog.EPrintln(err.Error())
 		return
@@ -159,114 +518,102 @@ func statsHandler(mc *MgoCmd, req *cmdproto.MgoRequest) (res interface{}, err er
 	return
 }
 
-func filterCollNames(collNames []string) map[string][]string {
-	reg := regexp.MustCompile(`(?P<hid>.+)_\d+_\d+_\d+`)
-	resNames := make(map[string][]string)
-	for _, collName := range collNames {
-		res := reg.FindStringSubmatch(collName)
-		if res != nil {
-			hid := res[1]
-			if resNames[hid] == nil {
-				resNames[hid] = make([]string, 0)
-			}
-			resNames[hid] = append(resNames[hid], collName)
-		}
-	}
-	for _, v := range resNames {
-		sort.Strings(v)
-	}
-	return resNames
-}
-
-func diskMon(mc *MgoCmd, req *cmdproto.MgoRequest) {
-	ticker := time.NewTicker(mc.DiskCheckInterval.Duration)
+func diskMon(mt *mgoTarget, req *cmdproto.MgoRequest) {
+	interval := mt.config().DiskCheckInterval.Duration
+	ticker := time.NewTicker(interval)
 	stop := false
-	collDays := 0
-	collName := ""
-	percent := 100
-	var err1 error
-	atomic.StoreInt32(&mc.diskMonState, 1)
+	atomic.StoreInt32(&mt.diskMonState, 1)
 	for {
 		select {
-		case <-mc.stopDiskMonCh:
+		case <-mt.stopDiskMonCh:
 			stop = true
 		case <-ticker.C:
-			//check if need to lru.
-			ds := cmds.DiskUsage("/")
-			percent = int(float64(ds.Free) / float64(ds.All) * 100)
-			if percent < mc.MgoLRUGate {
-				//cmdlog.Printf("mongodb is lru...\n")
-				//do delete collections.
-				names, err := mc.mgoSession.DB(req.DB).CollectionNames()
-				if err != nil {
-					cmdlog.EPrintln(err.Error())
-					continue
-				}
-				resNames := filterCollNames(names)
-				for _, v := range resNames {
-					collDays = len(v)
-					for i := 0; i < collDays/3; i++ {
-						collName = v[i]
-						//cmdlog.Printf("mongodb drop collection %s\n", collName)
-						err1 = mc.mgoSession.DB(req.DB).C(collName).DropCollection()
-						if err1 != nil {
-							cmdlog.EPrintln(err1.Error())
-						}
-					}
-				}
+			conf := mt.config()
+			if conf.DiskCheckInterval.Duration != interval {
+				interval = conf.DiskCheckInterval.Duration
+				ticker.Reset(interval)
+			}
+			if reports, err := mt.retentionRun(req.DB, false); err != nil {
+				cmdlog.EPrintln(err.Error())
+			} else {
+				cmdlog.Printf("mongodb %s retention %s\n", mt.name, summarize(reports))
 			}
 		}
 		if stop == true {
 			ticker.Stop()
-			atomic.StoreInt32(&mc.diskMonState, 0)
+			atomic.StoreInt32(&mt.diskMonState, 0)
 			break
 		}
 	}
 }
 
-func diskMonStartHandler(mc *MgoCmd, req *cmdproto.MgoRequest) (res interface{}, err error) {
-	monitorState := atomic.LoadInt32(&mc.diskMonState)
+func diskMonStartHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	monitorState := atomic.LoadInt32(&mt.diskMonState)
 	if monitorState > 0 {
 		return "disk monitor has started.", nil
 	}
-	go diskMon(mc, req)
+	if !mt.hasRules(req.DB) {
+		if req.DB != "" {
+			return nil, fmt.Errorf("no retention rules for db %s", req.DB)
+		}
+		return nil, errors.New("no retention rules configured")
+	}
+	//a stop sent while the last monitor exited must not stop this one.
+	select {
+	case <-mt.stopDiskMonCh:
+	default:
+	}
+	go diskMon(mt, req)
 	return "disk monitor started", nil
 }
 
-func diskMonEndHandler(mc *MgoCmd, req *cmdproto.MgoRequest) (res interface{}, err error) {
-	mc.stopDiskMonCh <- true
-
+func diskMonEndHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	if atomic.LoadInt32(&mt.diskMonState) == 0 {
+		return "disk monitor is not running", nil
+	}
+	select {
+	case mt.stopDiskMonCh <- true:
+	default:
+	}
 	return "disk monitor stopped", nil
 }
 
-func dbMon(mc *MgoCmd, req *cmdproto.MgoRequest) {
-	atomic.StoreInt32(&mc.dbMonState, 1)
-	stop := false
+// dbMon
+// pings the seed list every two seconds, alerting when a whole burst of
+// pings failed and resolving once mongod answers again, until dbMonE.
+func dbMon(mt *mgoTarget, req *cmdproto.MgoRequest) {
+	atomic.StoreInt32(&mt.dbMonState, 1)
 
 	pingCount := 5
-	errCount := 0
+	down := false
 	var err error
 
 	ticker := time.NewTicker(time.Second * 2)
 
 	defer func() {
 		ticker.Stop()
-		atomic.StoreInt32(&mc.dbMonState, 0)
+		atomic.StoreInt32(&mt.dbMonState, 0)
 	}()
 
-	dialInfo := &mgo.DialInfo{Addrs: mc.MgoAddrs, Timeout: (10 * time.Second)}
+	tc := mt.targetConfig()
+	dialInfo := &mgo.DialInfo{Addrs: tc.MgoAddrs, Timeout: (10 * time.Second),
+		Username: tc.Username, Password: string(tc.Password), Source: tc.AuthSource}
 	mgoSession, err := mgo.DialWithInfo(dialInfo)
-	mgoSession.SetSocketTimeout(time.Second * 10)
 	addrs, _ := net.InterfaceAddrs()
 	if err != nil {
 		cmdlog.EPrintln(err.Error())
-		cmds.SendMail("mongod", fmt.Sprintf("[%s]---%+v---mongod ping failed, please notice!", time.Now().UTC().String(), addrs))
+		notify.Send(mt.mongodDown(addrs, err))
 		return
 	}
+	mgoSession.SetSocketTimeout(time.Second * 10)
+	defer mgoSession.Close()
 
 	for {
 		select {
+		case <-mt.stopDbMonCh:
+			return
 		case <-ticker.C:
+			errCount := 0
 			for i := 0; i < pingCount; i++ {
 				err = mgoSession.Ping()
 				if err != nil {
@@ -274,33 +621,51 @@ func dbMon(mc *MgoCmd, req *cmdproto.MgoRequest) {
 					errCount++
 				}
 			}
-			if errCount == pingCount {
-				for i := 0; i < 5; i++ {
-					cmds.SendMail("mongod", fmt.Sprintf("[%s]---%+v---mongod ping failed, please notice!", time.Now().UTC().String(), addrs))
-				}
-				errCount = 0
-				stop = true
+			switch {
+			case errCount == pingCount && !down:
+				down = true
+				notify.Send(mt.mongodDown(addrs, err))
+			case errCount < pingCount && down:
+				down = false
+				alert := mt.mongodDown(addrs, nil)
+				alert.State = notify.StateResolved
+				alert.Body = fmt.Sprintf("%+v---mongod answers pings again", addrs)
+				notify.Send(alert)
 			}
 		}
-		if stop == true {
-			break
-		}
 	}
 }
 
-func dbMonStartHandler(mc *MgoCmd, req *cmdproto.MgoRequest) (res interface{}, err error) {
-	monitorState := atomic.LoadInt32(&mc.dbMonState)
+func (mt *mgoTarget) mongodDown(addrs []net.Addr, err error) *notify.Alert {
+	return &notify.Alert{Key: mt.alertKey("mongo.ping"), Source: "mongo", Severity: "critical", Subject: "mongod",
+		State: notify.StateFiring, Time: time.Now(),
+		Body: fmt.Sprintf("%+v---mongod ping failed, please notice! %v", addrs, err)}
+}
+
+func dbMonStartHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	monitorState := atomic.LoadInt32(&mt.dbMonState)
 	if monitorState > 0 {
 		return "db monitor has started.", nil
 	}
-	go dbMon(mc, req)
+	//a stop sent while the last monitor exited must not stop this one.
+	select {
+	case <-mt.stopDbMonCh:
+	default:
+	}
+	go dbMon(mt, req)
 	return "db monitor started", nil
 }
 
-// func dbMonEndHandler(mc *MgoCmd, req *cmdproto.MgoRequest) (res interface{}, err error) {
-// 	mc.stopDbMonCh <- true
-// 	return "db  monitor stopped", nil
-// }
+func dbMonEndHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	if atomic.LoadInt32(&mt.dbMonState) == 0 {
+		return "db monitor is not running", nil
+	}
+	select {
+	case mt.stopDbMonCh <- true:
+	default:
+	}
+	return "db monitor stopped", nil
+}
 
 func init() {
 	mgoHandler := &MgoCmd{}
@@ -0,0 +1,421 @@
+package mgocmd
+
+import (
+	"cmdproto"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"regexp"
+	"service/cmdlog"
+	"service/cmds"
+	"service/notify"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetentionPattern    = `^(?P<group>.+)_(?P<date>\d+_\d+_\d+)$`
+	defaultRetentionDateFormat = "2006_1_2"
+	retentionReports           = 50
+)
+
+// RetentionRule
+// applies to the collections of DB whose names match Pattern. the date
+// group of Pattern (the last group when none is named date) is parsed with
+// DateFormat, a go time layout whose underscores are plain separators
+// rather than the _2 day. the group named group, or the name without the
+// date, groups the daily collections of one source. collections dated
+// more than KeepDays days ago are dropped, then the oldest ones until the
+// matched collections take at most MaxBytes of storage. the newest
+// MinKeep collections of each group, at least one, are never dropped.
+type RetentionRule struct {
+	Name       string `toml:"name"`
+	DB         string `toml:"db"`
+	Pattern    string `toml:"pattern"`
+	DateFormat string `toml:"date_format"`
+	KeepDays   int    `toml:"keep_days"`
+	MaxBytes   int64  `toml:"max_bytes"`
+	MinKeep    int    `toml:"min_keep"`
+}
+
+type retentionRule struct {
+	*RetentionRule
+	reg      *regexp.Regexp
+	layout   string
+	dateIdx  int
+	groupIdx int
+}
+
+// retentionColl
+// a collection matched by a rule.
+type retentionColl struct {
+	name    string
+	group   string
+	date    time.Time
+	bytes   int64
+	drop    bool
+	reason  string
+	protect bool
+}
+
+func compileRetention(rules []RetentionRule) ([]*retentionRule, error) {
+	res := make([]*retentionRule, 0, len(rules))
+	for i := range rules {
+		rule := &retentionRule{RetentionRule: &rules[i]}
+		if rule.Name == "" {
+			rule.Name = strconv.Itoa(i)
+		}
+		if rule.DB == "" {
+			return nil, fmt.Errorf("retention rule %s without db", rule.Name)
+		}
+		if rule.Pattern == "" {
+			rule.Pattern = defaultRetentionPattern
+		}
+		if rule.DateFormat == "" {
+			rule.DateFormat = defaultRetentionDateFormat
+		}
+		if rule.KeepDays < 0 || rule.MaxBytes < 0 {
+			return nil, fmt.Errorf("retention rule %s: keep_days and max_bytes must not be negative", rule.Name)
+		}
+		if rule.KeepDays == 0 && rule.MaxBytes == 0 {
+			return nil, fmt.Errorf("retention rule %s needs keep_days or max_bytes", rule.Name)
+		}
+		rule.layout = strings.Replace(rule.DateFormat, "_", "-", -1)
+		if rule.MinKeep < 1 {
+			rule.MinKeep = 1
+		}
+		var err error
+		if rule.reg, err = regexp.Compile(rule.Pattern); err != nil {
+			return nil, fmt.Errorf("retention rule %s: %s", rule.Name, err.Error())
+		}
+		if rule.reg.NumSubexp() == 0 {
+			return nil, fmt.Errorf("retention rule %s: pattern %s has no date group", rule.Name, rule.Pattern)
+		}
+		rule.dateIdx = rule.reg.NumSubexp()
+		for j, name := range rule.reg.SubexpNames() {
+			switch name {
+			case "date":
+				rule.dateIdx = j
+			case "group":
+				rule.groupIdx = j
+			}
+		}
+		res = append(res, rule)
+	}
+	return res, nil
+}
+
+// match
+// the group and date of a collection name, ok is false when the name does
+// not match. a matching name with a bad date is an error.
+func (rule *retentionRule) match(name string) (group string, date time.Time, ok bool, err error) {
+	loc := rule.reg.FindStringSubmatchIndex(name)
+	if loc == nil {
+		return "", time.Time{}, false, nil
+	}
+	start, end := loc[2*rule.dateIdx], loc[2*rule.dateIdx+1]
+	if start < 0 {
+		return "", time.Time{}, false, nil
+	}
+	date, err = time.ParseInLocation(rule.layout, strings.Replace(name[start:end], "_", "-", -1), time.Local)
+	if err != nil {
+		return "", time.Time{}, true, fmt.Errorf("collection %s: bad date %s for format %s",
+			name, name[start:end], rule.DateFormat)
+	}
+	if rule.groupIdx > 0 && loc[2*rule.groupIdx] >= 0 {
+		group = name[loc[2*rule.groupIdx]:loc[2*rule.groupIdx+1]]
+	} else {
+		group = name[:start] + name[end:]
+	}
+	return group, date, true, nil
+}
+
+// retentionDBs
+// the databases with retention rules, in config order.
+func retentionDBs(rules []*retentionRule) []string {
+	var dbs []string
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		if !seen[rule.DB] {
+			seen[rule.DB] = true
+			dbs = append(dbs, rule.DB)
+		}
+	}
+	return dbs
+}
+
+// hasRules
+// whether the target has retention rules for db, for any database when db
+// is empty.
+func (mt *mgoTarget) hasRules(db string) bool {
+	for _, rule := range mt.retentionRules() {
+		if db == "" || rule.DB == db {
+			return true
+		}
+	}
+	return false
+}
+
+func collBytes(session *mgo.Session, db, name string) (int64, error) {
+	stats := bson.M{}
+	if err := session.DB(db).Run(bson.D{{Name: "collStats", Value: name}}, &stats); err != nil {
+		return 0, err
+	}
+	size, _ := toFloat(stats["storageSize"])
+	return int64(size), nil
+}
+
+// planRetention
+// decides which collections of db the rules drop. a collection belongs to
+// the first rule it matches.
+func planRetention(session *mgo.Session, db string, rules []*retentionRule, now time.Time,
+	report *cmdproto.RetentionReport) (map[*retentionRule][]*retentionColl, error) {
+	names, err := session.DB(db).CollectionNames()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	claimed := make(map[string]bool)
+	plan := make(map[*retentionRule][]*retentionColl)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	for _, rule := range rules {
+		if rule.DB != db {
+			continue
+		}
+		var colls []*retentionColl
+		for _, name := range names {
+			if claimed[name] {
+				continue
+			}
+			group, date, ok, err := rule.match(name)
+			if !ok {
+				continue
+			}
+			claimed[name] = true
+			if err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+			colls = append(colls, &retentionColl{name: name, group: group, date: date})
+		}
+		sort.SliceStable(colls, func(i, j int) bool {
+			return colls[i].date.Before(colls[j].date)
+		})
+		//the newest collections of each group stay whatever the policy says.
+		perGroup := make(map[string]int)
+		for i := len(colls) - 1; i >= 0; i-- {
+			if perGroup[colls[i].group] < rule.MinKeep {
+				colls[i].protect = true
+			}
+			perGroup[colls[i].group]++
+		}
+		if rule.KeepDays > 0 {
+			cutoff := today.AddDate(0, 0, -rule.KeepDays)
+			for _, coll := range colls {
+				if !coll.protect && coll.date.Before(cutoff) {
+					coll.drop = true
+					coll.reason = fmt.Sprintf("older than %d days", rule.KeepDays)
+				}
+			}
+		}
+		if rule.MaxBytes > 0 {
+			var total int64
+			for _, coll := range colls {
+				if coll.bytes, err = collBytes(session, db, coll.name); err != nil {
+					return nil, err
+				}
+				if !coll.drop {
+					total += coll.bytes
+				}
+			}
+			for _, coll := range colls {
+				if total <= rule.MaxBytes {
+					break
+				}
+				if coll.drop || coll.protect {
+					continue
+				}
+				coll.drop = true
+				coll.reason = fmt.Sprintf("%d bytes over max_bytes %d", total-rule.MaxBytes, rule.MaxBytes)
+				total -= coll.bytes
+			}
+		} else {
+			for _, coll := range colls {
+				if coll.drop {
+					if coll.bytes, err = collBytes(session, db, coll.name); err != nil {
+						cmdlog.EPrintln(err.Error())
+					}
+				}
+			}
+		}
+		plan[rule] = colls
+	}
+	return plan, nil
+}
+
+// applyRetention
+// drops what the retention rules of db select, or only reports it when
+// dryRun is set. with an archive dir a collection is dropped only once it
+// is archived. falling below lru_percent free disk raises an alert, the
+// rules alone decide what is dropped.
+func (mt *mgoTarget) applyRetention(db string, dryRun bool) (*cmdproto.RetentionReport, error) {
+	conf, rules := mt.config(), mt.retentionRules()
+	ds := cmds.DiskUsage(mt.targetConfig().DiskPath)
+	report := &cmdproto.RetentionReport{Time: time.Now(), DB: db, DryRun: dryRun,
+		FreePercent: int(float64(ds.Free) / float64(ds.All) * 100), Dropped: []cmdproto.RetentionAction{}}
+	if !dryRun {
+		mt.diskAlert(db, report.FreePercent, conf.MgoLRUGate)
+	}
+	session, err := mt.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	plan, err := planRetention(session, db, rules, report.Time, report)
+	if err != nil {
+		cmdlog.EPrintln(err.Error())
+		return nil, err
+	}
+	for _, rule := range rules {
+		for _, coll := range plan[rule] {
+			if !coll.drop {
+				report.Kept++
+				continue
+			}
+			action := cmdproto.RetentionAction{Collection: coll.name, Rule: rule.Name,
+				Date: coll.date.Format("2006-01-02"), Bytes: coll.bytes, Reason: coll.reason}
+			if !dryRun && conf.Archive.Dir != "" {
+				archive, _ := mt.archiveConfig()
+				manifest, err := archiveCollection(session, archive, db, coll.name)
+				if err != nil {
+					cmdlog.EPrintln(err.Error())
+					action.Error = "archive failed, not dropped: " + err.Error()
+					report.Dropped = append(report.Dropped, action)
+					continue
+				}
+				action.Archive = manifest.Name
+			}
+			if !dryRun {
+				if err = session.DB(db).C(coll.name).DropCollection(); err != nil {
+					cmdlog.EPrintln(err.Error())
+					action.Error = err.Error()
+				} else {
+					cmdlog.Printf("mongodb %s retention rule %s dropped %s.%s, %s\n", mt.name, rule.Name, db, coll.name,
+						coll.reason)
+				}
+			}
+			report.Dropped = append(report.Dropped, action)
+		}
+	}
+	if !dryRun && (len(report.Dropped) > 0 || len(report.Errors) > 0) {
+		mt.addReport(report)
+	}
+	return report, nil
+}
+
+// diskAlert
+// fires while less than gate percent of the disk_path disk is free.
+func (mt *mgoTarget) diskAlert(db string, percent, gate int) {
+	alert := &notify.Alert{Key: mt.alertKey("mongo.disk"), Source: "mongo", Severity: "warning",
+		Subject: "mongod disk", Time: time.Now()}
+	mt.reportLock.Lock()
+	defer mt.reportLock.Unlock()
+	switch {
+	case percent < gate && !mt.diskLow:
+		mt.diskLow = true
+		alert.State = notify.StateFiring
+		alert.Body = fmt.Sprintf("disk %d%% free, below lru_percent %d, retention of %s drops only what its rules select",
+			percent, gate, db)
+		notify.Send(alert)
+	case percent >= gate && mt.diskLow:
+		mt.diskLow = false
+		alert.State = notify.StateResolved
+		alert.Body = fmt.Sprintf("disk %d%% free", percent)
+		notify.Send(alert)
+	}
+}
+
+func (mt *mgoTarget) addReport(report *cmdproto.RetentionReport) {
+	mt.reportLock.Lock()
+	defer mt.reportLock.Unlock()
+	mt.reports = append(mt.reports, report)
+	if len(mt.reports) > retentionReports {
+		mt.reports = append(mt.reports[:0], mt.reports[len(mt.reports)-retentionReports:]...)
+	}
+}
+
+// retentionRun
+// applies the rules of db, or of every database with rules when db is
+// empty, and returns the reports.
+func (mt *mgoTarget) retentionRun(db string, dryRun bool) ([]*cmdproto.RetentionReport, error) {
+	dbs := []string{db}
+	if db == "" {
+		dbs = retentionDBs(mt.retentionRules())
+	}
+	if len(dbs) == 0 {
+		return nil, errors.New("no retention rules configured")
+	}
+	reports := make([]*cmdproto.RetentionReport, 0, len(dbs))
+	for _, db := range dbs {
+		report, err := mt.applyRetention(db, dryRun)
+		if err != nil {
+			mt.failed(err)
+			return reports, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func summarize(reports []*cmdproto.RetentionReport) string {
+	dropped, kept, failed := 0, 0, 0
+	for _, report := range reports {
+		for _, action := range report.Dropped {
+			if action.Error != "" {
+				failed++
+			} else {
+				dropped++
+			}
+		}
+		kept += report.Kept
+	}
+	return fmt.Sprintf("dropped %d collections, kept %d, %d drops failed", dropped, kept, failed)
+}
+
+// dryRunHandler
+// the collections the retention rules of the target for db (all databases
+// when empty) would drop now.
+func dryRunHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	reports, err := mt.retentionRun(req.DB, true)
+	if err != nil {
+		return nil, err
+	}
+	return marshalResult(reports)
+}
+
+// reportHandler
+// the last retention runs that dropped collections, of db when given. the
+// first arg limits the number of reports.
+func reportHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	limit := retentionReports
+	if len(req.DBCmd.Args) > 0 {
+		if limit, err = strconv.Atoi(req.DBCmd.Args[0]); err != nil || limit <= 0 {
+			return nil, newRequestError("bad report limit %s", req.DBCmd.Args[0])
+		}
+	}
+	mt.reportLock.Lock()
+	reports := make([]*cmdproto.RetentionReport, 0, len(mt.reports))
+	for _, report := range mt.reports {
+		if req.DB == "" || report.DB == req.DB {
+			reports = append(reports, report)
+		}
+	}
+	mt.reportLock.Unlock()
+	if len(reports) > limit {
+		reports = reports[len(reports)-limit:]
+	}
+	return marshalResult(reports)
+}
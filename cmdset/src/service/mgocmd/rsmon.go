@@ -0,0 +1,355 @@
+package mgocmd
+
+import (
+	"cmdproto"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"service/cmdlog"
+	"service/notify"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RSMonConfig
+// the [mongo.rsmon] section. every Interval the replica set monitor runs
+// replSetGetStatus and serverStatus. it alerts after Failures failed checks
+// in a row, when the set has no primary or the primary changed, a member is
+// unhealthy or lags more than MaxLag behind the primary, more than
+// MaxConnPercent of the connections are in use, or the operations exceed
+// MaxOpsPerSec (0 is no limit). every alert is resolved once it clears.
+type RSMonConfig struct {
+	Interval       duration `toml:"interval"`
+	MaxLag         duration `toml:"max_lag"`
+	MaxConnPercent float64  `toml:"max_conn_percent"`
+	MaxOpsPerSec   float64  `toml:"max_ops_per_sec"`
+	Failures       int      `toml:"failures"`
+}
+
+func (rc *RSMonConfig) validate() error {
+	if rc.Interval.Duration <= 0 || rc.MaxLag.Duration <= 0 {
+		return errors.New("rsmon interval and max_lag must be positive")
+	}
+	if rc.MaxConnPercent <= 0 || rc.MaxConnPercent > 100 {
+		return fmt.Errorf("rsmon max_conn_percent %g out of range 0-100", rc.MaxConnPercent)
+	}
+	if rc.MaxOpsPerSec < 0 {
+		return errors.New("rsmon max_ops_per_sec must not be negative")
+	}
+	if rc.Failures <= 0 {
+		rc.Failures = 1
+	}
+	return nil
+}
+
+// rsMonitor
+// the state of the replica set monitor of a target, status is what the
+// rsMonStatus op returns.
+type rsMonitor struct {
+	mt       *mgoTarget
+	lock     sync.Mutex
+	stop     chan bool
+	status   cmdproto.RSStatus
+	firing   map[string]bool
+	failures int
+	primary  string
+	opsAt    time.Time
+	ops      map[string]float64
+}
+
+// alert
+// sends the firing or resolved notice when the condition of key flipped.
+func (rm *rsMonitor) alert(key string, firing bool, severity, subject, body string) {
+	if firing == rm.firing[key] {
+		return
+	}
+	alert := &notify.Alert{Key: rm.mt.alertKey(key), Source: "mongo", Severity: severity, Subject: subject,
+		Body: body, Time: time.Now()}
+	if firing {
+		rm.firing[key] = true
+		alert.State = notify.StateFiring
+	} else {
+		delete(rm.firing, key)
+		alert.State = notify.StateResolved
+	}
+	notify.Send(alert)
+}
+
+// resolveAll
+// resolves the alerts with the given key prefix not in keep.
+func (rm *rsMonitor) resolveAll(prefix string, keep map[string]bool, subject string) {
+	for key := range rm.firing {
+		if strings.HasPrefix(key, prefix) && !keep[key] {
+			rm.alert(key, false, "warning", subject, key+" is gone")
+		}
+	}
+}
+
+// isNoReplSet
+// whether mongod runs without --replSet.
+func isNoReplSet(err error) bool {
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == 76 {
+		return true
+	}
+	return strings.Contains(err.Error(), "not running with --replSet")
+}
+
+// fail
+// records a failed check, alerting after conf.Failures in a row.
+func (rm *rsMonitor) fail(err error, conf *RSMonConfig) {
+	cmdlog.EPrintln(err.Error())
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	rm.status.Checked, rm.status.Error = time.Now(), err.Error()
+	rm.failures++
+	if rm.failures >= conf.Failures {
+		rm.alert("mongo.rs.check", true, "critical", "mongod status",
+			fmt.Sprintf("%d status checks failed in a row: %s", rm.failures, err.Error()))
+	}
+}
+
+// check
+// one round of the monitor, the alerts are sent while holding the lock so a
+// concurrent stop sees them settled.
+func (rm *rsMonitor) check(session *mgo.Session, conf *RSMonConfig) error {
+	rs, status := bson.M{}, bson.M{}
+	err := session.Run("replSetGetStatus", &rs)
+	standalone := err != nil && isNoReplSet(err)
+	if err == nil || standalone {
+		err = session.Run("serverStatus", &status)
+	}
+	if err != nil {
+		rm.fail(err, conf)
+		return err
+	}
+	now := time.Now()
+
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	st := &rm.status
+	st.Checked, st.Error = now, ""
+	rm.failures = 0
+	rm.alert("mongo.rs.check", false, "critical", "mongod status", "status checks succeed again")
+
+	if !standalone {
+		rm.checkMembers(rs, conf)
+	}
+	rm.checkServer(status, conf, now)
+	return nil
+}
+
+func (rm *rsMonitor) checkMembers(rs bson.M, conf *RSMonConfig) {
+	st := &rm.status
+	st.Set, _ = rs["set"].(string)
+	members, _ := rs["members"].([]interface{})
+	st.Members = st.Members[:0]
+	primary := ""
+	var primaryOptime time.Time
+	for _, m := range members {
+		doc, ok := m.(bson.M)
+		if !ok {
+			continue
+		}
+		member := cmdproto.RSMember{}
+		member.Name, _ = doc["name"].(string)
+		member.State, _ = doc["stateStr"].(string)
+		member.Health, _ = toFloat(doc["health"])
+		member.Optime, _ = doc["optimeDate"].(time.Time)
+		member.Self, _ = doc["self"].(bool)
+		if member.State == "PRIMARY" {
+			primary, primaryOptime = member.Name, member.Optime
+		}
+		st.Members = append(st.Members, member)
+	}
+
+	//a change through an election without primary counts as well.
+	prev := rm.primary
+	changed := prev != "" && primary != "" && prev != primary
+	if changed {
+		st.PrimaryChanges++
+	}
+	if primary != "" {
+		rm.primary = primary
+	}
+	switch {
+	case primary == "":
+		rm.alert("mongo.rs.primary", true, "critical", "replica set "+st.Set, "no primary")
+	case changed:
+		if rm.firing["mongo.rs.primary"] {
+			rm.alert("mongo.rs.primary", false, "critical", "replica set "+st.Set, "primary is "+primary)
+		}
+		rm.alert("mongo.rs.primary", true, "warning", "replica set "+st.Set,
+			fmt.Sprintf("primary changed from %s to %s", prev, primary))
+	default:
+		rm.alert("mongo.rs.primary", false, "warning", "replica set "+st.Set, "primary is "+primary)
+	}
+	st.Primary = primary
+
+	current := make(map[string]bool)
+	for i := range st.Members {
+		member := &st.Members[i]
+		healthKey, lagKey := "mongo.rs.member."+member.Name, "mongo.rs.lag."+member.Name
+		current[healthKey], current[lagKey] = true, true
+		switch member.State {
+		case "PRIMARY", "SECONDARY", "ARBITER":
+			rm.alert(healthKey, member.Health == 0, "critical", "replica set member "+member.Name,
+				fmt.Sprintf("%s is %s, health %g", member.Name, member.State, member.Health))
+		default:
+			rm.alert(healthKey, true, "critical", "replica set member "+member.Name,
+				fmt.Sprintf("%s is %s, health %g", member.Name, member.State, member.Health))
+		}
+		if member.State != "SECONDARY" || primary == "" || member.Optime.IsZero() {
+			rm.alert(lagKey, false, "warning", "replication lag of "+member.Name, member.Name+" is "+member.State)
+			continue
+		}
+		member.Lag = primaryOptime.Sub(member.Optime).Seconds()
+		rm.alert(lagKey, member.Lag > conf.MaxLag.Seconds(), "warning", "replication lag of "+member.Name,
+			fmt.Sprintf("%s is %.0fs behind %s, max_lag %s", member.Name, member.Lag, primary, conf.MaxLag.Duration))
+	}
+	//members removed from the set resolve their alerts.
+	rm.resolveAll("mongo.rs.member.", current, "replica set member")
+	rm.resolveAll("mongo.rs.lag.", current, "replication lag")
+}
+
+func (rm *rsMonitor) checkServer(status bson.M, conf *RSMonConfig, now time.Time) {
+	st := &rm.status
+	if conns, ok := status["connections"].(bson.M); ok {
+		current, _ := toFloat(conns["current"])
+		available, _ := toFloat(conns["available"])
+		st.Connections, st.Available = int64(current), int64(available)
+		if current+available > 0 {
+			percent := current / (current + available) * 100
+			rm.alert("mongo.connections", percent > conf.MaxConnPercent, "warning", "mongod connections",
+				fmt.Sprintf("%.0f of %.0f connections in use, %.0f%%, max_conn_percent %g",
+					current, current+available, percent, conf.MaxConnPercent))
+		}
+	}
+	ops, ok := status["opcounters"].(bson.M)
+	if !ok {
+		return
+	}
+	counters := make(map[string]float64, len(ops))
+	for op, val := range ops {
+		if v, ok := toFloat(val); ok {
+			counters[op] = v
+		}
+	}
+	if rm.ops != nil {
+		elapsed := now.Sub(rm.opsAt).Seconds()
+		st.OpsPerSec = make(map[string]float64, len(counters))
+		total := 0.0
+		for op, v := range counters {
+			//a restarted mongod starts counting again.
+			if prev, ok := rm.ops[op]; ok && v >= prev && elapsed > 0 {
+				st.OpsPerSec[op] = (v - prev) / elapsed
+				total += st.OpsPerSec[op]
+			}
+		}
+		rm.alert("mongo.ops", conf.MaxOpsPerSec > 0 && total > conf.MaxOpsPerSec, "warning", "mongod operations",
+			fmt.Sprintf("%.0f operations per second, max_ops_per_sec %g", total, conf.MaxOpsPerSec))
+	}
+	rm.ops, rm.opsAt = counters, now
+}
+
+func (rm *rsMonitor) snapshot() cmdproto.RSStatus {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+	st := rm.status
+	st.Members = append([]cmdproto.RSMember(nil), st.Members...)
+	st.Alerts = make([]string, 0, len(rm.firing))
+	for key := range rm.firing {
+		st.Alerts = append(st.Alerts, key)
+	}
+	sort.Strings(st.Alerts)
+	return st
+}
+
+func rsMon(mt *mgoTarget, rm *rsMonitor) {
+	conf := mt.config().RSMon
+	interval := conf.Interval.Duration
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	check := func() {
+		conf = mt.config().RSMon
+		session, err := mt.acquire()
+		if err != nil {
+			rm.fail(err, &conf)
+			return
+		}
+		defer session.Close()
+		//any member answers, so the monitor keeps reporting without a primary.
+		session.SetMode(mgo.Monotonic, false)
+		session.SetSocketTimeout(conf.Interval.Duration)
+		mt.failed(rm.check(session, &conf))
+	}
+	check()
+	for {
+		select {
+		case <-rm.stop:
+			return
+		case <-ticker.C:
+			check()
+			if conf.Interval.Duration != interval {
+				interval = conf.Interval.Duration
+				ticker.Stop()
+				ticker = time.NewTicker(interval)
+			}
+		}
+	}
+}
+
+// rsMonStartHandler
+// starts the replica set monitor of the target, it also watches a
+// standalone mongod.
+func rsMonStartHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	mt.rsMonLock.Lock()
+	defer mt.rsMonLock.Unlock()
+	if mt.rsMon != nil {
+		return "rs monitor has started.", nil
+	}
+	mt.rsMon = &rsMonitor{mt: mt, stop: make(chan bool), firing: make(map[string]bool)}
+	mt.rsMon.status.Target, mt.rsMon.status.Running = mt.name, true
+	go rsMon(mt, mt.rsMon)
+	return "rs monitor started", nil
+}
+
+// stopRSMon
+// stops the monitor, alerts still firing are left to the receiver.
+func (mt *mgoTarget) stopRSMon() bool {
+	mt.rsMonLock.Lock()
+	defer mt.rsMonLock.Unlock()
+	if mt.rsMon == nil {
+		return false
+	}
+	close(mt.rsMon.stop)
+	mt.rsMon.lock.Lock()
+	mt.rsMon.status.Running = false
+	mt.rsMon.lock.Unlock()
+	mt.lastRSMon, mt.rsMon = mt.rsMon, nil
+	return true
+}
+
+func rsMonEndHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	if !mt.stopRSMon() {
+		return "rs monitor is not running", nil
+	}
+	return "rs monitor stopped", nil
+}
+
+// rsMonStatusHandler
+// the last check of the running monitor, or of the stopped one.
+func rsMonStatusHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	mt.rsMonLock.Lock()
+	rm := mt.rsMon
+	if rm == nil {
+		rm = mt.lastRSMon
+	}
+	mt.rsMonLock.Unlock()
+	if rm == nil {
+		return nil, errors.New("rs monitor never started")
+	}
+	return marshalResult(rm.snapshot())
+}
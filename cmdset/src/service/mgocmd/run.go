@@ -0,0 +1,175 @@
+package mgocmd
+
+import (
+	"cmdproto"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// defaultRunAllow
+// the commands the run op allows without run_allow, all of them read only.
+var defaultRunAllow = []string{"buildInfo", "collStats", "connPoolStats", "currentOp", "dbStats",
+	"getLog", "hostInfo", "listDatabases", "replSetGetStatus", "serverStatus", "top"}
+
+// jsonResult
+// a handler result sent as application/json rather than text.
+type jsonResult []byte
+
+// deniedError
+// a request the mongo config does not allow, answered with 403.
+type deniedError struct {
+	msg string
+}
+
+func (de *deniedError) Error() string {
+	return de.msg
+}
+
+// requestError
+// a request missing or misusing its arguments, answered with 400. like a
+// denied request it says nothing about the connection.
+type requestError struct {
+	msg string
+}
+
+func newRequestError(format string, args ...interface{}) *requestError {
+	return &requestError{fmt.Sprintf(format, args...)}
+}
+
+func (re *requestError) Error() string {
+	return re.msg
+}
+
+func marshalResult(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return jsonResult(data), nil
+}
+
+// extendedResult
+// a command result in mongo extended json, the same syntax run options are
+// given in, so ObjectIds, dates and binary data survive the round trip.
+func extendedResult(doc bson.M) (interface{}, error) {
+	data, err := bson.MarshalJSON(extendFloats(doc))
+	if err != nil {
+		return nil, err
+	}
+	return jsonResult(data), nil
+}
+
+// extendFloats
+// replaces NaN and the infinities, which json can not hold, with their
+// {"$numberDouble": ..} form.
+func extendFloats(v interface{}) interface{} {
+	switch val := v.(type) {
+	case float64:
+		switch {
+		case math.IsNaN(val):
+			return bson.M{"$numberDouble": "NaN"}
+		case math.IsInf(val, 1):
+			return bson.M{"$numberDouble": "Infinity"}
+		case math.IsInf(val, -1):
+			return bson.M{"$numberDouble": "-Infinity"}
+		}
+	case bson.M:
+		for key, elem := range val {
+			val[key] = extendFloats(elem)
+		}
+	case bson.D:
+		for i := range val {
+			val[i].Value = extendFloats(val[i].Value)
+		}
+	case []interface{}:
+		for i, elem := range val {
+			val[i] = extendFloats(elem)
+		}
+	}
+	return v
+}
+
+// commandValue
+// the value of the command name field, numbers and booleans are taken as
+// such, e.g. "collStats" "logs" or "killOp" "1".
+func commandValue(arg string) interface{} {
+	if n, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(arg, 64); err == nil {
+		return f
+	}
+	if b, err := strconv.ParseBool(arg); err == nil {
+		return b
+	}
+	return arg
+}
+
+// buildCommand
+// the command document of a run request. the first arg is the command, the
+// second the value of its field (1 when missing), options are the further
+// fields in mongo extended json so ObjectIds and dates survive.
+func buildCommand(req *cmdproto.MgoRequest) (bson.D, error) {
+	args := req.DBCmd.Args
+	if len(args) == 0 || len(args) > 2 || args[0] == "" {
+		return nil, newRequestError("run needs the command and optionally its value")
+	}
+	cmd := bson.D{{Name: args[0], Value: 1}}
+	if len(args) == 2 {
+		cmd[0].Value = commandValue(args[1])
+	}
+	if len(req.DBCmd.Options) == 0 {
+		return cmd, nil
+	}
+	options := bson.M{}
+	if err := bson.UnmarshalJSON(req.DBCmd.Options, &options); err != nil {
+		return nil, newRequestError("bad run options: %s", err.Error())
+	}
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		if key == args[0] {
+			return nil, newRequestError("run option %s repeats the command", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		cmd = append(cmd, bson.DocElem{Name: key, Value: options[key]})
+	}
+	return cmd, nil
+}
+
+// runHandler
+// runs an allowed command against db (admin when empty) and returns its
+// result document in extended json.
+func runHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	cmd, err := buildCommand(req)
+	if err != nil {
+		return nil, err
+	}
+	allowed := false
+	for _, name := range mt.config().RunAllow {
+		allowed = allowed || name == cmd[0].Name
+	}
+	if !allowed {
+		return nil, &deniedError{fmt.Sprintf("mongo command %s is not in run_allow", cmd[0].Name)}
+	}
+	db := req.DB
+	if db == "" {
+		db = "admin"
+	}
+	session, err := mt.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	result := bson.M{}
+	if err = session.DB(db).Run(cmd, &result); err != nil {
+		return nil, err
+	}
+	return extendedResult(result)
+}
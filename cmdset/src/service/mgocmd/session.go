@@ -0,0 +1,246 @@
+package mgocmd
+
+import (
+	"cmdproto"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"io"
+	"net"
+	"service/cmdlog"
+	"sync"
+	"time"
+)
+
+var readPreferences = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primaryPreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondaryPreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+	"monotonic":          mgo.Monotonic,
+	"eventual":           mgo.Eventual,
+}
+
+// errNotConnected
+// answered with 503 while the handler has no session.
+var errNotConnected = errors.New("mongo is not connected, reconnecting")
+
+// connState
+// whether the session works, kept up to date by requests failing with
+// network errors and by the reconnect loop.
+type connState struct {
+	lock         sync.Mutex
+	connected    bool
+	reconnecting bool
+	since        time.Time
+	reconnects   int
+	lastErr      string
+}
+
+func (conf *MgoCmdConfig) validateSession() error {
+	if _, ok := readPreferences[conf.ReadPreference]; !ok {
+		return fmt.Errorf("unknown read_preference %s", conf.ReadPreference)
+	}
+	if conf.DialTimeout.Duration <= 0 || conf.SocketTimeout.Duration <= 0 {
+		return errors.New("dial_timeout and socket_timeout must be positive")
+	}
+	if conf.ReconnectBackoff.Duration <= 0 || conf.MaxBackoff.Duration < conf.ReconnectBackoff.Duration {
+		return errors.New("reconnect_backoff must be positive and at most max_backoff")
+	}
+	return nil
+}
+
+// sameSession
+// whether the target ta of a and tb of b dial the same session.
+func sameSession(a, b *MgoCmdConfig, ta, tb *TargetConfig) bool {
+	return sameAddrs(ta.MgoAddrs, tb.MgoAddrs) && ta.Username == tb.Username && ta.Password == tb.Password &&
+		ta.AuthSource == tb.AuthSource && a.DialTimeout == b.DialTimeout &&
+		a.SocketTimeout == b.SocketTimeout && a.ReadPreference == b.ReadPreference
+}
+
+func dialMongo(conf *MgoCmdConfig, tc *TargetConfig) (*mgo.Session, error) {
+	dialInfo := &mgo.DialInfo{Addrs: tc.MgoAddrs, Timeout: conf.DialTimeout.Duration,
+		Username: tc.Username, Password: string(tc.Password), Source: tc.AuthSource}
+	session, err := mgo.DialWithInfo(dialInfo)
+	if err != nil {
+		return nil, err
+	}
+	session.SetMode(readPreferences[conf.ReadPreference], true)
+	session.SetSocketTimeout(conf.SocketTimeout.Duration)
+	return session, nil
+}
+
+// isNetworkError
+// whether err means the connection rather than the request failed, resets
+// and broken pipes come as *net.OpError.
+func isNetworkError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == errNotConnected {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// serverReply
+// whether err is an answer of the server, which proves the connection.
+func serverReply(err error) bool {
+	switch err.(type) {
+	case *mgo.QueryError, *mgo.LastError, *mgo.BulkError:
+		return true
+	}
+	return err == mgo.ErrNotFound || err == mgo.ErrCursor
+}
+
+// acquire
+// a copy of the session for one request or check, the caller closes it.
+// copies take their own socket, so one broken socket fails one request.
+func (mt *mgoTarget) acquire() (*mgo.Session, error) {
+	session := mt.session()
+	if session == nil {
+		mt.reconnect(nil)
+		return nil, errNotConnected
+	}
+	return session.Copy(), nil
+}
+
+func (mt *mgoTarget) connected(connected bool, cause error) {
+	mt.conn.lock.Lock()
+	defer mt.conn.lock.Unlock()
+	if connected != mt.conn.connected {
+		mt.conn.connected, mt.conn.since = connected, time.Now()
+	}
+	if cause != nil {
+		mt.conn.lastErr = cause.Error()
+	}
+}
+
+// failed
+// starts reconnecting when err is a network error. mgo reports lost
+// servers and killed sockets with plain errors, for those a fresh copy of
+// the session is pinged to tell.
+func (mt *mgoTarget) failed(err error) {
+	switch {
+	case err == nil || serverReply(err):
+	case isNetworkError(err):
+		mt.reconnect(err)
+	default:
+		go func() {
+			session := mt.session()
+			if session == nil {
+				return
+			}
+			copied := session.Copy()
+			defer copied.Close()
+			if copied.Ping() != nil {
+				mt.reconnect(err)
+			}
+		}()
+	}
+}
+
+// reconnect
+// marks the session broken and starts the reconnect loop unless it runs,
+// cause is kept as the last error when given. errNotConnected only says
+// the loop runs, it would hide the dial error the loop recorded.
+func (mt *mgoTarget) reconnect(cause error) {
+	if mt.isRemoved() {
+		return
+	}
+	if cause == errNotConnected {
+		cause = nil
+	}
+	mt.connected(false, cause)
+	mt.conn.lock.Lock()
+	defer mt.conn.lock.Unlock()
+	if mt.conn.reconnecting {
+		return
+	}
+	mt.conn.reconnecting = true
+	go mt.reconnectLoop()
+}
+
+// reconnectLoop
+// pings the current session and dials a new one when that fails, waiting
+// from reconnect_backoff up to max_backoff between the tries, until the
+// target is removed from the config.
+func (mt *mgoTarget) reconnectLoop() {
+	backoff := mt.config().ReconnectBackoff.Duration
+	for !mt.isRemoved() {
+		err := mt.tryConnect()
+		if err == nil {
+			mt.connected(true, nil)
+			mt.conn.lock.Lock()
+			mt.conn.reconnecting = false
+			mt.conn.reconnects++
+			mt.conn.lock.Unlock()
+			cmdlog.Printf("mongo target %s connected to %v\n", mt.name, mt.targetConfig().MgoAddrs)
+			return
+		}
+		mt.connected(false, err)
+		cmdlog.EPrintf("mongo target %s reconnect: %s, next try in %s\n", mt.name, err.Error(), backoff)
+		time.Sleep(backoff)
+		conf := mt.config()
+		if backoff *= 2; backoff > conf.MaxBackoff.Duration {
+			backoff = conf.MaxBackoff.Duration
+		}
+	}
+}
+
+func (mt *mgoTarget) tryConnect() error {
+	if session := mt.session(); session != nil {
+		copied := session.Copy()
+		err := copied.Ping()
+		copied.Close()
+		if err == nil {
+			return nil
+		}
+	}
+	newSession, err := dialMongo(mt.config(), mt.targetConfig())
+	if err != nil {
+		return err
+	}
+	mt.mc.confLock.Lock()
+	if mt.isRemoved() {
+		mt.mc.confLock.Unlock()
+		newSession.Close()
+		return nil
+	}
+	oldSession := mt.mgoSession
+	mt.mgoSession = newSession
+	mt.mc.confLock.Unlock()
+	if oldSession != nil {
+		oldSession.Close()
+	}
+	return nil
+}
+
+// healthHandler
+// the session state of the target and a ping through a fresh copy, never
+// an error so a broken connection is reported rather than failing the
+// request.
+func healthHandler(mt *mgoTarget, req *cmdproto.MgoRequest) (res interface{}, err error) {
+	conf := mt.config()
+	health := &cmdproto.MgoHealth{Target: mt.name, Addrs: mt.targetConfig().MgoAddrs,
+		ReadPreference: conf.ReadPreference, PoolSize: cap(mt.mc.cmdReqPool), PoolFree: len(mt.mc.cmdReqPool),
+		LiveServers: []string{}}
+	session, err := mt.acquire()
+	if err != nil {
+		health.PingError = err.Error()
+	} else {
+		start := time.Now()
+		if err = session.Ping(); err != nil {
+			health.PingError = err.Error()
+			mt.failed(err)
+		} else {
+			health.Ping = time.Since(start).Seconds()
+		}
+		health.LiveServers = append(health.LiveServers, session.LiveServers()...)
+		session.Close()
+	}
+	mt.conn.lock.Lock()
+	health.Connected, health.Reconnecting = mt.conn.connected, mt.conn.reconnecting
+	health.Since, health.Reconnects, health.LastError = mt.conn.since, mt.conn.reconnects, mt.conn.lastErr
+	mt.conn.lock.Unlock()
+	return marshalResult(health)
+}
@@ -0,0 +1,267 @@
+package mgocmd
+
+import (
+	"cmdproto"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"path/filepath"
+	"service/cmdlog"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultTarget
+// the target of the requests without one.
+const defaultTarget = "default"
+
+// TargetConfig
+// one mongod or cluster of the host, like the config server or a shard.
+// the addr, credentials, disk_path and retention rules of [mongo] itself
+// make up the default target, every [mongo.targets.<name>] section another
+// one. AuthSource is the database of the credentials, admin when empty.
+// DiskPath holds the data files, retention checks its free space.
+type TargetConfig struct {
+	MgoAddrs   []string        `toml:"addr"`
+	Username   string          `toml:"username"`
+	Password   secret          `toml:"password"`
+	AuthSource string          `toml:"auth_source"`
+	DiskPath   string          `toml:"disk_path"`
+	Retention  []RetentionRule `toml:"retention"`
+}
+
+// secret
+// a config string kept out of the logs.
+type secret string
+
+func (s secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "******"
+}
+
+// mgoTarget
+// a target with its session and the state of its monitors, conf, retention
+// and mgoSession are guarded by the confLock of mc.
+type mgoTarget struct {
+	name          string
+	mc            *MgoCmd
+	conf          *TargetConfig
+	retention     []*retentionRule
+	mgoSession    *mgo.Session
+	conn          connState
+	removed       int32
+	diskMonState  int32
+	stopDiskMonCh chan bool
+	dbMonState    int32
+	stopDbMonCh   chan bool
+	reports       []*cmdproto.RetentionReport
+	diskLow       bool
+	reportLock    sync.Mutex
+	rsMon         *rsMonitor
+	lastRSMon     *rsMonitor
+	rsMonLock     sync.Mutex
+	builds        []*cmdproto.IndexBuild
+	buildLock     sync.Mutex
+}
+
+func (tc *TargetConfig) validate(name string) ([]*retentionRule, error) {
+	if len(tc.MgoAddrs) == 0 {
+		return nil, fmt.Errorf("mongo target %s has no addr", name)
+	}
+	for _, addr := range tc.MgoAddrs {
+		if addr == "" {
+			return nil, fmt.Errorf("mongo target %s has an empty addr", name)
+		}
+	}
+	if tc.Username == "" && tc.Password != "" {
+		return nil, fmt.Errorf("mongo target %s has a password without username", name)
+	}
+	if tc.DiskPath == "" {
+		tc.DiskPath = "/"
+	}
+	rules, err := compileRetention(tc.Retention)
+	if err != nil {
+		return nil, fmt.Errorf("mongo target %s: %s", name, err.Error())
+	}
+	return rules, nil
+}
+
+// targetConfigs
+// the targets of conf by name with their compiled retention rules.
+func targetConfigs(conf *MgoCmdConfig) (map[string]*TargetConfig, map[string][]*retentionRule, error) {
+	confs := make(map[string]*TargetConfig, len(conf.Targets)+1)
+	if len(conf.MgoAddrs) > 0 {
+		confs[defaultTarget] = &conf.TargetConfig
+	} else if len(conf.Retention) > 0 || conf.Username != "" {
+		return nil, nil, errors.New("mongo retention or credentials without addr")
+	}
+	for name := range conf.Targets {
+		if _, ok := confs[name]; ok {
+			return nil, nil, fmt.Errorf("mongo target %s is also the addr of [mongo]", name)
+		}
+		if name == "" || strings.ContainsAny(name, "/\\.") {
+			return nil, nil, fmt.Errorf("bad mongo target name %q", name)
+		}
+		tc := conf.Targets[name]
+		confs[name] = &tc
+	}
+	if len(confs) == 0 {
+		return nil, nil, errors.New("no mongo addr configured")
+	}
+	rules := make(map[string][]*retentionRule, len(confs))
+	for name, tc := range confs {
+		var err error
+		if rules[name], err = tc.validate(name); err != nil {
+			return nil, nil, err
+		}
+	}
+	return confs, rules, nil
+}
+
+func newTarget(mc *MgoCmd, name string, conf *TargetConfig, rules []*retentionRule) *mgoTarget {
+	return &mgoTarget{name: name, mc: mc, conf: conf, retention: rules,
+		stopDiskMonCh: make(chan bool, 1), stopDbMonCh: make(chan bool, 1)}
+}
+
+// start
+// dials the session of a new target, an unreachable mongod is retried in
+// the background rather than failing the config.
+func (mt *mgoTarget) start() {
+	mt.conn.since = time.Now()
+	session, err := dialMongo(mt.config(), mt.targetConfig())
+	if err != nil {
+		cmdlog.EPrintf("mongo target %s: %s\n", mt.name, err.Error())
+		mt.reconnect(err)
+		return
+	}
+	mt.mc.confLock.Lock()
+	mt.mgoSession = session
+	mt.mc.confLock.Unlock()
+	mt.connected(true, nil)
+}
+
+// startTargets
+// starts the targets at once, so unreachable ones do not add up their
+// dial timeouts.
+func startTargets(targets []*mgoTarget) {
+	var wg sync.WaitGroup
+	for _, mt := range targets {
+		wg.Add(1)
+		go func(mt *mgoTarget) {
+			defer wg.Done()
+			mt.start()
+		}(mt)
+	}
+	wg.Wait()
+}
+
+// lookupTarget
+// the target named name, the default one when empty.
+func (mc *MgoCmd) lookupTarget(name string) (*mgoTarget, error) {
+	if name == "" {
+		name = defaultTarget
+	}
+	mc.confLock.RLock()
+	defer mc.confLock.RUnlock()
+	mt, ok := mc.targets[name]
+	if !ok {
+		return nil, fmt.Errorf("mongo target %s not configured", name)
+	}
+	return mt, nil
+}
+
+// targetList
+// every target, sorted by name.
+func (mc *MgoCmd) targetList() []*mgoTarget {
+	mc.confLock.RLock()
+	defer mc.confLock.RUnlock()
+	res := make([]*mgoTarget, 0, len(mc.targets))
+	for _, mt := range mc.targets {
+		res = append(res, mt)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].name < res[j].name
+	})
+	return res
+}
+
+func (mt *mgoTarget) config() *MgoCmdConfig {
+	return mt.mc.config()
+}
+
+func (mt *mgoTarget) targetConfig() *TargetConfig {
+	mt.mc.confLock.RLock()
+	defer mt.mc.confLock.RUnlock()
+	return mt.conf
+}
+
+func (mt *mgoTarget) retentionRules() []*retentionRule {
+	mt.mc.confLock.RLock()
+	defer mt.mc.confLock.RUnlock()
+	return mt.retention
+}
+
+func (mt *mgoTarget) session() *mgo.Session {
+	mt.mc.confLock.RLock()
+	defer mt.mc.confLock.RUnlock()
+	return mt.mgoSession
+}
+
+// alertKey
+// key of an alert of the target, the default target keeps the plain keys
+// like mongo.disk, the others get their name inserted, mongo.shard1.disk.
+func (mt *mgoTarget) alertKey(key string) string {
+	if mt.name == defaultTarget {
+		return key
+	}
+	return "mongo." + mt.name + strings.TrimPrefix(key, "mongo")
+}
+
+// archiveConfig
+// the archive section with the dir of the target, dir/<target>. the
+// default target gets dir/default too, a database named like a target
+// would share its dir otherwise.
+func (mt *mgoTarget) archiveConfig() (*ArchiveConfig, error) {
+	conf := mt.config().Archive
+	if conf.Dir == "" {
+		return nil, errors.New("no mongo archive dir configured")
+	}
+	conf.Dir = filepath.Join(conf.Dir, mt.name)
+	return &conf, nil
+}
+
+// close
+// stops the monitors and the session of a target removed from the config.
+// index builds still running keep their own session copy.
+func (mt *mgoTarget) close() {
+	atomic.StoreInt32(&mt.removed, 1)
+	if atomic.LoadInt32(&mt.diskMonState) > 0 {
+		select {
+		case mt.stopDiskMonCh <- true:
+		default:
+		}
+	}
+	if atomic.LoadInt32(&mt.dbMonState) > 0 {
+		select {
+		case mt.stopDbMonCh <- true:
+		default:
+		}
+	}
+	mt.stopRSMon()
+	mt.mc.confLock.Lock()
+	session := mt.mgoSession
+	mt.mgoSession = nil
+	mt.mc.confLock.Unlock()
+	if session != nil {
+		session.Close()
+	}
+}
+
+func (mt *mgoTarget) isRemoved() bool {
+	return atomic.LoadInt32(&mt.removed) > 0
+}
@@ -0,0 +1,212 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+func newNotifier(bc *BackendConfig) (Notifier, error) {
+	switch bc.Type {
+	case "smtp":
+		if bc.Host == "" || bc.From == "" {
+			return nil, errors.New("smtp needs host and from")
+		}
+		if len(bc.To) == 0 {
+			return nil, errors.New("smtp without recipients")
+		}
+		if _, _, err := net.SplitHostPort(bc.Host); err != nil {
+			return nil, err
+		}
+		switch bc.TLS {
+		case "", "starttls", "tls", "none":
+		default:
+			return nil, fmt.Errorf("invalid tls %s", bc.TLS)
+		}
+		return &smtpNotifier{bc}, nil
+	case "webhook":
+		if bc.URL == "" {
+			return nil, errors.New("webhook needs url")
+		}
+		if bc.Method == "" {
+			bc.Method = "POST"
+		}
+		for _, header := range bc.Headers {
+			if !strings.Contains(header, ":") {
+				return nil, fmt.Errorf("header %s is not \"Name: value\"", header)
+			}
+		}
+		return &webhookNotifier{bc, &http.Client{Timeout: bc.Timeout.Duration}}, nil
+	case "file":
+		if bc.Path == "" {
+			return nil, errors.New("file needs path")
+		}
+		return &fileNotifier{BackendConfig: bc}, nil
+	case "exec":
+		if bc.Command == "" {
+			return nil, errors.New("exec needs command")
+		}
+		return &execNotifier{bc}, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", bc.Type)
+}
+
+type smtpNotifier struct {
+	*BackendConfig
+}
+
+func (n *smtpNotifier) Name() string { return n.BackendConfig.Name }
+
+func (n *smtpNotifier) Notify(alert *Alert) error {
+	host, _, _ := net.SplitHostPort(n.Host)
+	dialer := &net.Dialer{Timeout: n.Timeout.Duration}
+	var conn net.Conn
+	var err error
+	if n.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", n.Host, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", n.Host)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(n.Timeout.Duration))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if n.TLS == "" || n.TLS == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err = client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return err
+			}
+		} else if n.TLS == "starttls" {
+			return errors.New("server does not offer STARTTLS")
+		}
+	}
+	if n.Username != "" {
+		if err = client.Auth(smtp.PlainAuth("", n.Username, n.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(n.From); err != nil {
+		return err
+	}
+	for _, to := range n.To {
+		if err = client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("[%s] %s %s", strings.ToUpper(alert.State), alert.Host, alert.Subject)
+	msg := "To: " + strings.Join(n.To, ", ") + "\r\nFrom: " + n.From + "\r\nSubject: " + subject +
+		"\r\nDate: " + alert.Time.Format(time.RFC1123Z) +
+		"\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n" +
+		fmt.Sprintf("key: %s\r\nseverity: %s\r\nhost: %s\r\ntime: %s\r\n\r\n%s\r\n",
+			alert.Key, alert.Severity, alert.Host, alert.Time.Format(time.RFC3339), alert.Body)
+	if _, err = w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+type webhookNotifier struct {
+	*BackendConfig
+	client *http.Client
+}
+
+func (n *webhookNotifier) Name() string { return n.BackendConfig.Name }
+
+func (n *webhookNotifier) Notify(alert *Alert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(n.Method, n.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, header := range n.Headers {
+		kv := strings.SplitN(header, ":", 2)
+		req.Header.Set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+type fileNotifier struct {
+	*BackendConfig
+	lock sync.Mutex
+}
+
+func (n *fileNotifier) Name() string { return n.BackendConfig.Name }
+
+func (n *fileNotifier) Notify(alert *Alert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	file, err := os.OpenFile(n.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+type execNotifier struct {
+	*BackendConfig
+}
+
+func (n *execNotifier) Name() string { return n.BackendConfig.Name }
+
+func (n *execNotifier) Notify(alert *Alert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), n.Timeout.Duration)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, n.Command, n.Args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(), "ALERT_KEY="+alert.Key, "ALERT_STATE="+alert.State,
+		"ALERT_SEVERITY="+alert.Severity, "ALERT_SUBJECT="+alert.Subject)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package notify
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"os"
+	"regexp"
+	"service/cmdlog"
+	"service/cmds"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// Alert
+// Key identifies what the alert is about, e.g. "syscmd.disk./data", it is
+// what routes match on and what alerts are deduplicated and rate limited by.
+type Alert struct {
+	Key      string    `json:"key"`
+	Source   string    `json:"source"`
+	Severity string    `json:"severity"`
+	State    string    `json:"state"`
+	Subject  string    `json:"subject"`
+	Body     string    `json:"body"`
+	Host     string    `json:"host"`
+	Time     time.Time `json:"time"`
+}
+
+// Notifier
+// delivers an alert through one backend.
+type Notifier interface {
+	Name() string
+	Notify(alert *Alert) error
+}
+
+// NotifyConfig
+// the [notify] section. an alert goes to the backends of every matching
+// route, or to DefaultBackends when no route matches. the same key and state
+// is sent once per DedupWindow, and at most RateLimit times per RateWindow
+// unless the state changed.
+type NotifyConfig struct {
+	DedupWindow     cmds.Duration   `toml:"dedup_window"`
+	RateLimit       int             `toml:"rate_limit"`
+	RateWindow      cmds.Duration   `toml:"rate_window"`
+	DefaultBackends []string        `toml:"default_backends"`
+	Backends        []BackendConfig `toml:"backends"`
+	Routes          []RouteConfig   `toml:"routes"`
+}
+
+// BackendConfig
+// Type is smtp, webhook, file or exec, the other fields apply to the type
+// that uses them.
+type BackendConfig struct {
+	Name    string        `toml:"name"`
+	Type    string        `toml:"type"`
+	Timeout cmds.Duration `toml:"timeout"`
+
+	// smtp, TLS is "starttls" (default, when offered), "tls" or "none".
+	Host     string   `toml:"host"`
+	TLS      string   `toml:"tls"`
+	Username string   `toml:"username"`
+	Password string   `toml:"password"`
+	From     string   `toml:"from"`
+	To       []string `toml:"to"`
+
+	// webhook, the alert is posted as json.
+	URL     string   `toml:"url"`
+	Method  string   `toml:"method"`
+	Headers []string `toml:"headers"`
+
+	// file appends json lines to Path, exec runs Command with the alert as
+	// json on stdin.
+	Path    string   `toml:"path"`
+	Command string   `toml:"command"`
+	Args    []string `toml:"args"`
+}
+
+// RouteConfig
+// Match is a glob on the alert key where "*" also matches "/", Severity limits the route to the listed
+// severities when set.
+type RouteConfig struct {
+	Match    string   `toml:"match"`
+	Severity []string `toml:"severity"`
+	Backends []string `toml:"backends"`
+}
+
+type sentState struct {
+	state string
+	last  time.Time
+	times []time.Time
+}
+
+type dispatcher struct {
+	*NotifyConfig
+	backends map[string]Notifier
+	matches  []*regexp.Regexp
+	lock     sync.Mutex
+	sent     map[string]*sentState
+}
+
+var (
+	current  *dispatcher
+	curLock  sync.RWMutex
+	hostname string
+)
+
+func init() {
+	hostname, _ = os.Hostname()
+}
+
+// InitNotifyConf
+// builds the backends of the [notify] section, it is called again on
+// reload and keeps the old backends if the new section is invalid.
+func InitNotifyConf(confs map[string]toml.Primitive, md *toml.MetaData) error {
+	config := &NotifyConfig{DedupWindow: cmds.Duration{Duration: 10 * time.Minute}, RateLimit: 10,
+		RateWindow: cmds.Duration{Duration: time.Hour}}
+	conf, ok := confs["notify"]
+	if !ok {
+		cmdlog.Printf("notify not configured, alerts are only logged\n")
+		return nil
+	}
+	if err := md.PrimitiveDecode(conf, config); err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+	d, err := newDispatcher(config)
+	if err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+
+	curLock.Lock()
+	if current != nil {
+		// keep the dedup state across reloads.
+		current.lock.Lock()
+		d.sent = current.sent
+		current.lock.Unlock()
+	}
+	current = d
+	curLock.Unlock()
+	cmdlog.Printf("notify init ok, %d backends, %d routes\n", len(d.backends), len(config.Routes))
+	return nil
+}
+
+func newDispatcher(config *NotifyConfig) (*dispatcher, error) {
+	d := &dispatcher{NotifyConfig: config, backends: make(map[string]Notifier),
+		sent: make(map[string]*sentState)}
+	for i := range config.Backends {
+		bc := &config.Backends[i]
+		if bc.Name == "" {
+			return nil, fmt.Errorf("notify backend %d without name", i)
+		}
+		if _, ok := d.backends[bc.Name]; ok {
+			return nil, fmt.Errorf("duplicate notify backend %s", bc.Name)
+		}
+		if bc.Timeout.Duration <= 0 {
+			bc.Timeout.Duration = 10 * time.Second
+		}
+		n, err := newNotifier(bc)
+		if err != nil {
+			return nil, fmt.Errorf("notify backend %s: %s", bc.Name, err.Error())
+		}
+		d.backends[bc.Name] = n
+	}
+	names := append([]string{}, config.DefaultBackends...)
+	for _, route := range config.Routes {
+		d.matches = append(d.matches, globRegexp(route.Match))
+		names = append(names, route.Backends...)
+	}
+	for _, name := range names {
+		if _, ok := d.backends[name]; !ok {
+			return nil, fmt.Errorf("notify route refers to unknown backend %s", name)
+		}
+	}
+	return d, nil
+}
+
+// Send
+// routes alert to its backends, unless it repeats an alert sent within
+// the dedup window or its key is over the rate limit. the error is the
+// first backend failure, the other backends are still tried.
+func Send(alert *Alert) error {
+	if alert.Time.IsZero() {
+		alert.Time = time.Now().UTC()
+	}
+	if alert.Host == "" {
+		alert.Host = hostname
+	}
+	if alert.State == "" {
+		alert.State = StateFiring
+	}
+	cmdlog.EPrintf("alert %s %s %s: %s\n", alert.Key, alert.State, alert.Subject, alert.Body)
+
+	curLock.RLock()
+	d := current
+	curLock.RUnlock()
+	if d == nil {
+		return nil
+	}
+	if !d.admit(alert) {
+		return nil
+	}
+	var firstErr error
+	for _, name := range d.route(alert) {
+		if err := d.backends[name].Notify(alert); err != nil {
+			cmdlog.EPrintf("notify %s via %s failed: %s\n", alert.Key, name, err.Error())
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// admit
+// reports whether alert passes deduplication and rate limiting, a state
+// change (firing to resolved and back) always passes, so a rate limited
+// key still gets its resolved notice out.
+func (d *dispatcher) admit(alert *Alert) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	st, ok := d.sent[alert.Key]
+	if !ok {
+		st = &sentState{}
+		d.sent[alert.Key] = st
+	}
+	if st.state == alert.State && now.Sub(st.last) < d.DedupWindow.Duration {
+		cmdlog.Printf("alert %s %s suppressed as duplicate\n", alert.Key, alert.State)
+		return false
+	}
+	times := st.times[:0]
+	for _, t := range st.times {
+		if now.Sub(t) < d.RateWindow.Duration {
+			times = append(times, t)
+		}
+	}
+	st.times = times
+	if st.state == alert.State && d.RateLimit > 0 && len(st.times) >= d.RateLimit {
+		cmdlog.EPrintf("alert %s rate limited, %d sent within %s\n", alert.Key, len(st.times), d.RateWindow.Duration)
+		return false
+	}
+	st.state, st.last = alert.State, now
+	st.times = append(st.times, now)
+	return true
+}
+
+func (d *dispatcher) route(alert *Alert) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for i, route := range d.Routes {
+		if !d.matches[i].MatchString(alert.Key) {
+			continue
+		}
+		if len(route.Severity) > 0 && !contains(route.Severity, alert.Severity) {
+			continue
+		}
+		for _, name := range route.Backends {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return d.DefaultBackends
+	}
+	return names
+}
+
+// globRegexp
+// an empty glob matches every key.
+func globRegexp(glob string) *regexp.Regexp {
+	if glob == "" {
+		glob = "*"
+	}
+	expr := regexp.QuoteMeta(glob)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	return regexp.MustCompile("^" + expr + "$")
+}
+
+func contains(list []string, val string) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
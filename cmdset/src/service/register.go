@@ -0,0 +1,143 @@
+package main
+
+import (
+	"cmdproto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"service/cmdlog"
+	"service/cmds"
+	"strings"
+	"time"
+)
+
+// Version is stamped at build time with -ldflags "-X main.Version=...".
+var Version = "dev"
+
+type registration struct {
+	key   string
+	value string
+	ttl   uint64
+	stop  chan bool
+	done  chan bool
+}
+
+var agentRegistration *registration
+
+// advertiseIP
+// picks the address other hosts reach this agent on, without dialing out:
+// advertise_addr, then the first ipv4 address of advertise_iface, then the
+// first non loopback ipv4 address of any interface that is up.
+func advertiseIP() (string, error) {
+	if cmddConfig.AdvertiseAddr != "" {
+		return cmddConfig.AdvertiseAddr, nil
+	}
+	var ifaces []net.Interface
+	if cmddConfig.AdvertiseIface != "" {
+		iface, err := net.InterfaceByName(cmddConfig.AdvertiseIface)
+		if err != nil {
+			return "", err
+		}
+		ifaces = append(ifaces, *iface)
+	} else {
+		var err error
+		ifaces, err = net.Interfaces()
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				return ipnet.IP.String(), nil
+			}
+		}
+	}
+	return "", errors.New("no usable interface address found, set advertise_addr")
+}
+
+func registerToConfigServer() error {
+	substrs := strings.SplitN(cmddConfig.ListenAddr, ":", 2)
+	if len(substrs) != 2 {
+		return fmt.Errorf("invalid listen_addr %s", cmddConfig.ListenAddr)
+	}
+	ip, port := substrs[0], substrs[1]
+	if ip == "" {
+		var err error
+		ip, err = advertiseIP()
+		if err != nil {
+			cmdlog.EPrintln(err.Error())
+			return err
+		}
+	}
+	addr := ip
+	if !strings.Contains(addr, ":") {
+		addr = ip + ":" + port
+	}
+
+	info := &cmdproto.AgentInfo{Addr: addr, Version: Version, StartTime: time.Now().UTC(),
+		Handlers: cmds.EnabledHandlers(), TLS: cmddConfig.TLSConfig.Enabled()}
+	value, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, err = configClient.CreateDir(cmddConfig.ConfigDir, 0)
+	if err != nil {
+		cmdlog.EPrintln(err.Error())
+	}
+	reg := &registration{key: cmddConfig.ConfigDir + "/" + addr, value: string(value),
+		ttl: uint64(cmddConfig.RegisterTTL.Seconds()), stop: make(chan bool), done: make(chan bool)}
+	_, err = configClient.Set(reg.key, reg.value, reg.ttl)
+	if err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+	cmdlog.Printf("registered %s ttl %ds\n", reg.key, reg.ttl)
+	agentRegistration = reg
+	go reg.heartbeat(cmddConfig.Heartbeat.Duration)
+
+	return nil
+}
+
+// heartbeat
+// refreshes the key before its ttl runs out, a missed beat is retried on
+// the next tick.
+func (reg *registration) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer func() {
+		ticker.Stop()
+		close(reg.done)
+	}()
+	for {
+		select {
+		case <-reg.stop:
+			return
+		case <-ticker.C:
+			if _, err := configClient.Set(reg.key, reg.value, reg.ttl); err != nil {
+				cmdlog.EPrintf("heartbeat %s failed: %s\n", reg.key, err.Error())
+			}
+		}
+	}
+}
+
+func deregisterFromConfigServer() {
+	reg := agentRegistration
+	if reg == nil {
+		return
+	}
+	close(reg.stop)
+	<-reg.done
+	if _, err := configClient.Delete(reg.key, false); err != nil {
+		cmdlog.EPrintf("deregister %s failed: %s\n", reg.key, err.Error())
+		return
+	}
+	cmdlog.Printf("deregistered %s\n", reg.key)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/BurntSushi/toml"
+	"github.com/go-etcd/etcd"
+	"service/cmdlog"
+	"service/cmds"
+	"service/notify"
+	"time"
+)
+
+// reloadConfigFile
+// re-reads the config file and hands the handler sections to their
+// handlers, on SIGHUP. [notify] is rebuilt too, the [cmdd] and [auth]
+// sections need a restart.
+func reloadConfigFile() {
+	config, md, err := LoadCmdConfig(*configFileName)
+	if err != nil {
+		cmdlog.EPrintf("reload %s failed: %s\n", *configFileName, err.Error())
+		return
+	}
+	notify.InitNotifyConf(config, md)
+	cmds.ReloadHandlerConf(config, md)
+}
+
+func reloadConfigData(data string) {
+	config := make(map[string]toml.Primitive)
+	md, err := toml.Decode(data, config)
+	if err != nil {
+		cmdlog.EPrintf("reload %s failed: %s\n", cmddConfig.WatchConfigKey, err.Error())
+		return
+	}
+	notify.InitNotifyConf(config, &md)
+	cmds.ReloadHandlerConf(config, &md)
+}
+
+// watchConfigKey
+// reloads the handler sections whenever the toml document stored at
+// watch_config_key changes. a broken watch is restarted after a pause.
+func watchConfigKey(key string, stop chan bool) {
+	for {
+		receiver := make(chan *etcd.Response)
+		go func() {
+			for resp := range receiver {
+				if resp.Node == nil || resp.Node.Dir || resp.Action == "delete" || resp.Action == "expire" {
+					continue
+				}
+				cmdlog.Printf("config key %s changed, reloading\n", key)
+				reloadConfigData(resp.Node.Value)
+			}
+		}()
+		_, err := configClient.Watch(key, 0, false, receiver, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err != nil {
+			cmdlog.EPrintf("watch %s failed: %s\n", key, err.Error())
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,386 @@
+package sccmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"service/cmdlog"
+	"service/cmds"
+	"service/notify"
+	"strings"
+	"time"
+)
+
+const (
+	healthUnknown   = "unknown"
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+)
+
+// HealthConfig
+// the [sctl.services.<name>.health] section used by the monitor op. Type is
+// tcp (connect to Address), http (GET URL expecting ExpectStatus) or exec
+// (Command exits 0), without a type only the process is watched. after
+// Failures failed checks in a row, or when the process dies, the service is
+// restarted after Backoff, doubled per restart up to MaxBackoff. once
+// MaxRestarts restarts happened within RestartWindow the monitor gives up.
+// Auto attaches the monitor when the agent starts.
+type HealthConfig struct {
+	Type          string        `toml:"type"`
+	Address       string        `toml:"address"`
+	URL           string        `toml:"url"`
+	ExpectStatus  int           `toml:"expect_status"`
+	Command       string        `toml:"command"`
+	Args          []string      `toml:"args"`
+	Interval      cmds.Duration `toml:"interval"`
+	Timeout       cmds.Duration `toml:"timeout"`
+	Failures      int           `toml:"failures"`
+	Backoff       cmds.Duration `toml:"backoff"`
+	MaxBackoff    cmds.Duration `toml:"max_backoff"`
+	MaxRestarts   int           `toml:"max_restarts"`
+	RestartWindow cmds.Duration `toml:"restart_window"`
+	Auto          bool          `toml:"auto"`
+}
+
+// checkFunc
+// returns nil when the service is healthy.
+type checkFunc func(timeout time.Duration) error
+
+func (hc *HealthConfig) validate() error {
+	switch hc.Type {
+	case "":
+	case "tcp":
+		if hc.Address == "" {
+			return errors.New("tcp check without address")
+		}
+	case "http":
+		if hc.URL == "" {
+			return errors.New("http check without url")
+		}
+		if hc.ExpectStatus == 0 {
+			hc.ExpectStatus = http.StatusOK
+		}
+	case "exec":
+		if hc.Command == "" {
+			return errors.New("exec check without command")
+		}
+	default:
+		return fmt.Errorf("unknown check type %s", hc.Type)
+	}
+	if hc.Interval.Duration <= 0 {
+		hc.Interval.Duration = 10 * time.Second
+	}
+	if hc.Timeout.Duration <= 0 {
+		hc.Timeout.Duration = 3 * time.Second
+	}
+	if hc.Failures <= 0 {
+		hc.Failures = 3
+	}
+	if hc.Backoff.Duration <= 0 {
+		hc.Backoff.Duration = time.Second
+	}
+	if hc.MaxBackoff.Duration < hc.Backoff.Duration {
+		hc.MaxBackoff.Duration = 5 * time.Minute
+	}
+	if hc.MaxRestarts <= 0 {
+		hc.MaxRestarts = 5
+	}
+	if hc.RestartWindow.Duration <= 0 {
+		hc.RestartWindow.Duration = 10 * time.Minute
+	}
+	return nil
+}
+
+func (hc *HealthConfig) String() string {
+	switch hc.Type {
+	case "tcp":
+		return "tcp " + hc.Address
+	case "http":
+		return fmt.Sprintf("http %s expecting %d", hc.URL, hc.ExpectStatus)
+	case "exec":
+		return strings.Join(append([]string{"exec", hc.Command}, hc.Args...), " ")
+	}
+	return "process"
+}
+
+// healthCheck
+// the check of the monitor op args, the health section without args or
+// the named one of checks. requests only pick a check of the config, what
+// it connects to or runs is never taken from them.
+func (conf *ServiceConfig) healthCheck(args []string) (HealthConfig, error) {
+	switch len(args) {
+	case 0:
+		return conf.Health, nil
+	case 1:
+		hc, ok := conf.Checks[args[0]]
+		if !ok {
+			return hc, fmt.Errorf("no check %s configured", args[0])
+		}
+		return hc, nil
+	}
+	return HealthConfig{}, errors.New("monitor args are [check] or off")
+}
+
+func (hc *HealthConfig) checker() checkFunc {
+	switch hc.Type {
+	case "tcp":
+		return func(timeout time.Duration) error {
+			conn, err := net.DialTimeout("tcp", hc.Address, timeout)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+	case "http":
+		return func(timeout time.Duration) error {
+			client := &http.Client{Timeout: timeout}
+			resp, err := client.Get(hc.URL)
+			if err != nil {
+				return err
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != hc.ExpectStatus {
+				return fmt.Errorf("status %d, expected %d", resp.StatusCode, hc.ExpectStatus)
+			}
+			return nil
+		}
+	case "exec":
+		return func(timeout time.Duration) error {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			out, err := exec.CommandContext(ctx, hc.Command, hc.Args...).CombinedOutput()
+			if err != nil {
+				if msg := string(bytes.TrimSpace(out)); msg != "" {
+					return fmt.Errorf("%s: %s", err.Error(), msg)
+				}
+				return err
+			}
+			return nil
+		}
+	}
+	return func(time.Duration) error { return nil }
+}
+
+// healthMonitor
+// checks a service every interval and restarts it when it died or failed
+// too many checks in a row. everything but stop belongs to run.
+type healthMonitor struct {
+	svc      *service
+	conf     HealthConfig
+	check    checkFunc
+	stop     chan struct{}
+	fails    int
+	recent   []time.Time
+	alerting bool
+}
+
+// attach
+// starts a health monitor on the service.
+func (svc *service) attach(conf HealthConfig) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.monitor != nil {
+		return fmt.Errorf("service %s already monitored with %s", svc.name, svc.monitor.conf.String())
+	}
+	hm := &healthMonitor{svc: svc, conf: conf, check: conf.checker(), stop: make(chan struct{})}
+	svc.monitor, svc.health = hm, healthUnknown
+	svc.record("monitor", "detached", "attached", conf.String())
+	go hm.run()
+	cmdlog.Printf("service %s monitored with %s every %s\n", svc.name, conf.String(), conf.Interval.Duration)
+	return nil
+}
+
+// detach
+// stops the health monitor, a restart it scheduled is cancelled.
+func (svc *service) detach(reason string) bool {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	hm := svc.monitor
+	if hm == nil {
+		return false
+	}
+	svc.monitor, svc.health = nil, ""
+	svc.record("monitor", "attached", "detached", reason)
+	if svc.state == serviceBackoff {
+		svc.setState(serviceStopped, reason)
+	}
+	close(hm.stop)
+	cmdlog.Printf("service %s monitor detached, %s\n", svc.name, reason)
+	return true
+}
+
+// giveUp
+// detaches hm after a crash loop, the service is left as it is.
+func (svc *service) giveUp(hm *healthMonitor, reason string) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.monitor != hm {
+		return
+	}
+	svc.monitor, svc.health = nil, ""
+	svc.crashLoop = true
+	svc.record("monitor", "attached", "crashloop", reason)
+	if svc.state != serviceRunning && svc.state != serviceStopping {
+		svc.setState(serviceCrashLoop, reason)
+	}
+	cmdlog.EPrintf("service %s crash loop, monitor gave up: %s\n", svc.name, reason)
+}
+
+// recovered
+// clears the crash loop of the service, true when its alert fired.
+func (svc *service) recovered() bool {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	crashLoop := svc.crashLoop
+	svc.crashLoop = false
+	return crashLoop
+}
+
+func (svc *service) setHealth(health, reason string) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.health == health || svc.health == "" {
+		return
+	}
+	svc.record("health", svc.health, health, reason)
+	svc.health = health
+}
+
+// enterBackoff
+// marks a dead service as waiting for its restart, false when somebody
+// else already started or stopped it.
+func (svc *service) enterBackoff(reason string) bool {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	switch svc.state {
+	case serviceStopped, serviceExited, serviceFailed:
+		svc.setState(serviceBackoff, reason)
+		svc.restarts++
+		return true
+	}
+	return false
+}
+
+// watchState
+// the state, the exit reason and the channel closed when a running
+// service exits.
+func (svc *service) watchState() (string, string, chan struct{}) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.state == serviceRunning {
+		return svc.state, svc.lastExit, svc.done
+	}
+	return svc.state, svc.lastExit, nil
+}
+
+func (hm *healthMonitor) run() {
+	ticker := time.NewTicker(hm.conf.Interval.Duration)
+	defer ticker.Stop()
+	for {
+		state, lastExit, done := hm.svc.watchState()
+		if state == serviceExited || state == serviceFailed {
+			if !hm.restart("process " + lastExit) {
+				return
+			}
+			continue
+		}
+		select {
+		case <-hm.stop:
+			return
+		case <-done:
+		case <-ticker.C:
+			if state == serviceRunning && !hm.probe() {
+				if !hm.restart(fmt.Sprintf("%d failed checks", hm.fails)) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// probe
+// runs the check, false once it failed conf.Failures times in a row.
+func (hm *healthMonitor) probe() bool {
+	err := hm.check(hm.conf.Timeout.Duration)
+	if err == nil {
+		hm.fails = 0
+		hm.svc.setHealth(healthHealthy, hm.conf.String()+" passed")
+		if hm.svc.recovered() {
+			hm.alerting = true
+			hm.alert(notify.StateResolved, ".crashloop", fmt.Sprintf("service %s recovered from the crash loop", hm.svc.name))
+		}
+		if hm.alerting {
+			hm.alerting = false
+			hm.alert(notify.StateResolved, "", fmt.Sprintf("service %s is healthy again", hm.svc.name))
+		}
+		return true
+	}
+	hm.fails++
+	cmdlog.EPrintf("service %s check %s failed (%d/%d): %s\n", hm.svc.name, hm.conf.String(),
+		hm.fails, hm.conf.Failures, err.Error())
+	if hm.fails < hm.conf.Failures {
+		return true
+	}
+	hm.svc.setHealth(healthUnhealthy, fmt.Sprintf("%d failed checks, last: %s", hm.fails, err.Error()))
+	return false
+}
+
+// restart
+// stops the service if needed and starts it again after the backoff,
+// false when the monitor is done, detached or given up.
+func (hm *healthMonitor) restart(reason string) bool {
+	now := time.Now()
+	window := hm.conf.RestartWindow.Duration
+	recent := hm.recent[:0]
+	for _, t := range hm.recent {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	hm.recent = recent
+	if len(recent) >= hm.conf.MaxRestarts {
+		msg := fmt.Sprintf("%d restarts within %s, last because %s", len(recent), window, reason)
+		hm.svc.giveUp(hm, msg)
+		hm.alert(notify.StateFiring, ".crashloop", fmt.Sprintf("service %s is crash looping, %s", hm.svc.name, msg))
+		return false
+	}
+
+	delay := hm.conf.Backoff.Duration << uint(len(recent))
+	if delay > hm.conf.MaxBackoff.Duration || delay <= 0 {
+		delay = hm.conf.MaxBackoff.Duration
+	}
+	hm.recent = append(hm.recent, now)
+	hm.fails = 0
+	hm.alerting = true
+	hm.alert(notify.StateFiring, "", fmt.Sprintf("service %s restarting in %s, %s", hm.svc.name, delay, reason))
+
+	if hm.svc.running() {
+		if err := hm.svc.stop("health monitor restart, " + reason); err != nil {
+			cmdlog.EPrintf("service %s stop: %s\n", hm.svc.name, err.Error())
+		}
+	}
+	if !hm.svc.enterBackoff(fmt.Sprintf("restart in %s, %s", delay, reason)) {
+		return true
+	}
+	select {
+	case <-hm.stop:
+		return false
+	case <-time.After(delay):
+	}
+	if err := hm.svc.startFrom(serviceBackoff, "restarted by health monitor"); err != nil {
+		cmdlog.EPrintf("service %s restart: %s\n", hm.svc.name, err.Error())
+	}
+	return true
+}
+
+func (hm *healthMonitor) alert(state, suffix, body string) {
+	notify.Send(&notify.Alert{Key: "sctl." + hm.svc.name + suffix, Source: "sctl", Severity: "critical",
+		State: state, Subject: "service " + hm.svc.name, Body: body, Time: time.Now().UTC()})
+}
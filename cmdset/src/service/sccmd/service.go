@@ -0,0 +1,459 @@
+package sccmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"service/cmdlog"
+	"service/cmds"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	serviceStopped  = "stopped"
+	serviceRunning  = "running"
+	serviceStopping = "stopping"
+	serviceExited   = "exited"
+	serviceFailed   = "failed"
+	// waiting to be restarted by the health monitor.
+	serviceBackoff = "backoff"
+	// the health monitor gave up restarting it.
+	serviceCrashLoop = "crashloop"
+
+	maxTransitions = 100
+)
+
+// ServiceConfig
+// a [sctl.services.<name>] section. Env adds NAME=value pairs to the agent
+// environment, output goes to StdoutLog and StderrLog (appended) or is
+// discarded. stop sends StopSignal to the process group and kills it once
+// StopTimeout passed. Checks are named alternatives to Health the monitor
+// op can attach instead.
+type ServiceConfig struct {
+	Command     string                  `toml:"command"`
+	Args        []string                `toml:"args"`
+	Dir         string                  `toml:"dir"`
+	Env         []string                `toml:"env"`
+	User        string                  `toml:"user"`
+	PidFile     string                  `toml:"pidfile"`
+	StdoutLog   string                  `toml:"stdout_log"`
+	StderrLog   string                  `toml:"stderr_log"`
+	StopSignal  string                  `toml:"stop_signal"`
+	StopTimeout cmds.Duration           `toml:"stop_timeout"`
+	Health      HealthConfig            `toml:"health"`
+	Checks      map[string]HealthConfig `toml:"checks"`
+}
+
+// ServiceStatus
+// what the status op reports, Uptime is in seconds.
+type ServiceStatus struct {
+	Name         string     `json:"name"`
+	State        string     `json:"state"`
+	Pid          int        `json:"pid,omitempty"`
+	StartTime    *time.Time `json:"start_time,omitempty"`
+	Uptime       float64    `json:"uptime,omitempty"`
+	Adopted      bool       `json:"adopted,omitempty"`
+	LastExit     string     `json:"last_exit,omitempty"`
+	LastExitTime *time.Time `json:"last_exit_time,omitempty"`
+	Starts       int        `json:"starts"`
+	Monitored    bool       `json:"monitored"`
+	Health       string     `json:"health,omitempty"`
+	Restarts     int        `json:"restarts,omitempty"`
+}
+
+// Transition
+// a recorded change of the service state, Kind is "state", "health" or
+// "monitor".
+type Transition struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+var signals = map[string]syscall.Signal{
+	"HUP": syscall.SIGHUP, "INT": syscall.SIGINT, "QUIT": syscall.SIGQUIT, "KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1, "USR2": syscall.SIGUSR2, "TERM": syscall.SIGTERM,
+}
+
+func parseSignal(name string) (syscall.Signal, error) {
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %s", name)
+	}
+	return sig, nil
+}
+
+func lookupCredential(name string) (*syscall.Credential, error) {
+	if name == "" {
+		return nil, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// validate
+// fills in the defaults and checks what can be checked before starting.
+func (conf *ServiceConfig) validate(name string) error {
+	if conf.Command == "" {
+		return fmt.Errorf("service %s without command", name)
+	}
+	if conf.StopSignal == "" {
+		conf.StopSignal = "TERM"
+	}
+	if _, err := parseSignal(conf.StopSignal); err != nil {
+		return fmt.Errorf("service %s: %s", name, err.Error())
+	}
+	if conf.StopTimeout.Duration <= 0 {
+		conf.StopTimeout.Duration = 10 * time.Second
+	}
+	for _, kv := range conf.Env {
+		if !strings.Contains(kv, "=") {
+			return fmt.Errorf("service %s env %s is not NAME=value", name, kv)
+		}
+	}
+	if _, err := lookupCredential(conf.User); err != nil {
+		return fmt.Errorf("service %s: %s", name, err.Error())
+	}
+	if err := conf.Health.validate(); err != nil {
+		return fmt.Errorf("service %s health: %s", name, err.Error())
+	}
+	for check, hc := range conf.Checks {
+		if check == "off" {
+			return fmt.Errorf("service %s check can not be named off", name)
+		}
+		if err := hc.validate(); err != nil {
+			return fmt.Errorf("service %s check %s: %s", name, check, err.Error())
+		}
+		conf.Checks[check] = hc
+	}
+	return nil
+}
+
+type service struct {
+	name    string
+	mu      sync.Mutex
+	conf    *ServiceConfig
+	state   string
+	pid     int
+	start   time.Time
+	adopted bool
+	// done is closed when the running process exits.
+	done     chan struct{}
+	lastExit string
+	exitTime time.Time
+	starts   int
+	removed  bool
+	// monitor is the attached health monitor, health its last verdict and
+	// restarts how often it restarted the service. crashLoop is set while
+	// the crash loop alert fires.
+	monitor     *healthMonitor
+	health      string
+	restarts    int
+	crashLoop   bool
+	transitions []Transition
+}
+
+func newService(name string, conf *ServiceConfig) *service {
+	svc := &service{name: name, conf: conf, state: serviceStopped}
+	svc.adopt()
+	return svc
+}
+
+// adopt
+// takes over a process left running by a previous agent, found through
+// the pidfile.
+func (svc *service) adopt() {
+	if svc.conf.PidFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(svc.conf.PidFile)
+	if err != nil {
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 || syscall.Kill(pid, 0) != nil {
+		return
+	}
+	fi, err := os.Stat(svc.conf.PidFile)
+	if err == nil {
+		svc.start = fi.ModTime()
+	}
+	svc.pid, svc.adopted = pid, true
+	svc.setState(serviceRunning, fmt.Sprintf("adopted pid %d from %s", pid, svc.conf.PidFile))
+	svc.done = make(chan struct{})
+	go svc.watchAdopted(pid, svc.done)
+	cmdlog.Printf("service %s adopted pid %d from %s\n", svc.name, pid, svc.conf.PidFile)
+}
+
+// watchAdopted
+// polls an adopted process, it is not our child so it can not be waited.
+func (svc *service) watchAdopted(pid int, done chan struct{}) {
+	for syscall.Kill(pid, 0) == nil {
+		time.Sleep(time.Second)
+	}
+	svc.exited(done, "adopted process exited", false)
+}
+
+func openLog(path string) (*os.File, error) {
+	if path == "" {
+		return os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// record
+// appends a transition, the oldest are dropped past maxTransitions.
+func (svc *service) record(kind, from, to, reason string) {
+	if len(svc.transitions) >= maxTransitions {
+		svc.transitions = append(svc.transitions[:0], svc.transitions[1:]...)
+	}
+	svc.transitions = append(svc.transitions, Transition{Time: time.Now().UTC(), Kind: kind,
+		From: from, To: to, Reason: reason})
+}
+
+// setState
+// every state change goes through here so it is recorded, the caller
+// holds mu.
+func (svc *service) setState(state, reason string) {
+	if state == svc.state {
+		return
+	}
+	svc.record("state", svc.state, state, reason)
+	svc.state = state
+}
+
+func (svc *service) Start() error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	return svc.startLocked("start requested")
+}
+
+// startFrom
+// starts the service only if it is still in state, so a restart scheduled
+// by the health monitor does not override a stop requested meanwhile.
+func (svc *service) startFrom(state, reason string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.state != state {
+		return fmt.Errorf("service %s is %s", svc.name, svc.state)
+	}
+	return svc.startLocked(reason)
+}
+
+func (svc *service) startLocked(reason string) error {
+	if svc.state == serviceRunning || svc.state == serviceStopping {
+		return fmt.Errorf("service %s is %s, pid %d", svc.name, svc.state, svc.pid)
+	}
+	conf := svc.conf
+	cred, err := lookupCredential(conf.User)
+	if err != nil {
+		return err
+	}
+	stdout, err := openLog(conf.StdoutLog)
+	if err != nil {
+		return err
+	}
+	defer stdout.Close()
+	stderr := stdout
+	if conf.StderrLog != conf.StdoutLog {
+		if stderr, err = openLog(conf.StderrLog); err != nil {
+			return err
+		}
+		defer stderr.Close()
+	}
+
+	cmd := exec.Command(conf.Command, conf.Args...)
+	cmd.Dir = conf.Dir
+	cmd.Env = append(os.Environ(), conf.Env...)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	// own process group, so stop reaches the children and the service
+	// survives the agent being interrupted from a terminal.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: cred}
+	if err = cmd.Start(); err != nil {
+		svc.lastExit, svc.exitTime = "start failed: "+err.Error(), time.Now().UTC()
+		svc.setState(serviceFailed, svc.lastExit)
+		return err
+	}
+	svc.pid, svc.adopted = cmd.Process.Pid, false
+	svc.setState(serviceRunning, fmt.Sprintf("%s, pid %d", reason, svc.pid))
+	svc.start = time.Now().UTC()
+	svc.starts++
+	svc.done = make(chan struct{})
+	if conf.PidFile != "" {
+		if err := ioutil.WriteFile(conf.PidFile, []byte(strconv.Itoa(svc.pid)+"\n"), 0644); err != nil {
+			cmdlog.EPrintf("service %s pidfile: %s\n", svc.name, err.Error())
+		}
+	}
+	go func(done chan struct{}) {
+		reason, clean := exitReason(cmd.Wait())
+		svc.exited(done, reason, clean)
+	}(svc.done)
+	cmdlog.Printf("service %s started, pid %d\n", svc.name, svc.pid)
+	return nil
+}
+
+// exitReason
+// describes the result of Wait, clean is set for a zero exit code only.
+func exitReason(err error) (reason string, clean bool) {
+	if err == nil {
+		return "exited with code 0", true
+	}
+	ee, ok := err.(*exec.ExitError)
+	if !ok {
+		return err.Error(), false
+	}
+	if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return "killed by signal " + ws.Signal().String(), false
+	}
+	return fmt.Sprintf("exited with code %d", ee.ExitCode()), false
+}
+
+func (svc *service) exited(done chan struct{}, reason string, clean bool) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if svc.done != done {
+		return
+	}
+	switch {
+	case svc.state == serviceStopping:
+		reason = "stopped, " + reason
+		svc.setState(serviceStopped, reason)
+	case clean:
+		svc.setState(serviceExited, reason)
+	default:
+		svc.setState(serviceFailed, reason)
+	}
+	svc.lastExit, svc.exitTime = reason, time.Now().UTC()
+	svc.pid, svc.adopted = 0, false
+	if svc.conf.PidFile != "" {
+		os.Remove(svc.conf.PidFile)
+	}
+	close(done)
+	cmdlog.Printf("service %s %s\n", svc.name, reason)
+}
+
+// Stop
+// sends the stop signal and waits for the exit, the process group is
+// killed once stop_timeout passed. a pending restart of the health monitor
+// is cancelled.
+func (svc *service) Stop() error {
+	return svc.stop("stop requested")
+}
+
+func (svc *service) stop(reason string) error {
+	svc.mu.Lock()
+	if svc.state == serviceBackoff || svc.state == serviceCrashLoop {
+		svc.setState(serviceStopped, reason)
+		svc.mu.Unlock()
+		return nil
+	}
+	if svc.state != serviceRunning && svc.state != serviceStopping {
+		svc.mu.Unlock()
+		return fmt.Errorf("service %s is not running", svc.name)
+	}
+	sig, _ := parseSignal(svc.conf.StopSignal)
+	timeout := svc.conf.StopTimeout.Duration
+	pid, adopted, done := svc.pid, svc.adopted, svc.done
+	svc.setState(serviceStopping, reason)
+	svc.mu.Unlock()
+
+	target := -pid
+	if adopted {
+		target = pid
+	}
+	if err := syscall.Kill(target, sig); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+	cmdlog.EPrintf("service %s did not stop within %s, killing it\n", svc.name, timeout)
+	syscall.Kill(target, syscall.SIGKILL)
+	select {
+	case <-done:
+		return nil
+	case <-time.After(5 * time.Second):
+		return errors.New("service did not exit after SIGKILL")
+	}
+}
+
+func (svc *service) Status() ServiceStatus {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	st := ServiceStatus{Name: svc.name, State: svc.state, Pid: svc.pid, Adopted: svc.adopted,
+		LastExit: svc.lastExit, Starts: svc.starts, Monitored: svc.monitor != nil, Health: svc.health,
+		Restarts: svc.restarts}
+	if !svc.exitTime.IsZero() {
+		exitTime := svc.exitTime
+		st.LastExitTime = &exitTime
+	}
+	if svc.state == serviceRunning || svc.state == serviceStopping {
+		start := svc.start
+		st.StartTime = &start
+		st.Uptime = time.Since(svc.start).Seconds()
+	}
+	return st
+}
+
+func (svc *service) running() bool {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	return svc.state == serviceRunning || svc.state == serviceStopping
+}
+
+// setConfig
+// takes a new config, true when it brings back a removed service.
+func (svc *service) setConfig(conf *ServiceConfig) bool {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	readded := svc.removed
+	svc.conf, svc.removed = conf, false
+	return readded
+}
+
+func (svc *service) setRemoved() {
+	svc.mu.Lock()
+	svc.removed = true
+	svc.mu.Unlock()
+	svc.detach("service removed from config")
+}
+
+func (svc *service) isRemoved() bool {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	return svc.removed
+}
+
+func (svc *service) Transitions() []Transition {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	res := make([]Transition, len(svc.transitions))
+	copy(res, svc.transitions)
+	return res
+}
@@ -3,21 +3,27 @@ package sccmd
 import (
 	"cmdproto"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"service/cmdlog"
 	"service/cmds"
+	"sort"
+	"sync"
 )
 
 type ScCmdConfig struct {
-	ScRequestPoolSize int `toml:"request_pool_size"`
+	ScRequestPoolSize int                      `toml:"request_pool_size"`
+	Services          map[string]ServiceConfig `toml:"services"`
 }
 
 type ServiceCtrlCmd struct {
 	*ScCmdConfig
 	cmdHandlers map[string]func(scc *ServiceCtrlCmd, req *cmdproto.ScRequest) (interface{}, error)
 	cmdReqPool  chan *cmdproto.ScRequest
+	svcLock     sync.Mutex
+	services    map[string]*service
 }
 
 func (scc *ServiceCtrlCmd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -33,6 +39,7 @@ func (scc *ServiceCtrlCmd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	scReq := scc.getAvalibleReq()
 
 	defer scc.recycle(scReq)
+	*scReq = cmdproto.ScRequest{}
 	err = json.Unmarshal(data, scReq)
 	if err != nil {
 		cmdlog.EPrintf("%s\n", err.Error())
@@ -66,6 +73,18 @@ func (scc *ServiceCtrlCmd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (scc *ServiceCtrlCmd) DescribeRequest(req *http.Request) (string, []string, error) {
+	data, err := cmds.PeekBody(req)
+	if err != nil {
+		return "", nil, err
+	}
+	scReq := &cmdproto.ScRequest{}
+	if err = json.Unmarshal(data, scReq); err != nil {
+		return "", nil, err
+	}
+	return scReq.Op, append([]string{scReq.ServiceInfo.Service}, scReq.ServiceInfo.Args...), nil
+}
+
 func (scc *ServiceCtrlCmd) ConfigStruct() interface{} {
 	return &ScCmdConfig{ScRequestPoolSize: 100}
 }
@@ -73,6 +92,16 @@ func (scc *ServiceCtrlCmd) ConfigStruct() interface{} {
 func (scc *ServiceCtrlCmd) Init(config interface{}) (err error) {
 	scc.ScCmdConfig = config.(*ScCmdConfig)
 	cmdlog.Printf("ServiceCtrlCmd Init config :(%+v)\n", scc.ScCmdConfig)
+	if err = validateServices(scc.ScCmdConfig); err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+	scc.services = make(map[string]*service)
+	for name := range scc.Services {
+		conf := scc.Services[name]
+		scc.services[name] = newService(name, &conf)
+		autoMonitor(scc.services[name], &conf)
+	}
 
 	scc.cmdHandlers = make(map[string]func(scc *ServiceCtrlCmd, req *cmdproto.ScRequest) (interface{}, error))
 	scc.cmdReqPool = make(chan *cmdproto.ScRequest, scc.ScRequestPoolSize)
@@ -80,14 +109,118 @@ func (scc *ServiceCtrlCmd) Init(config interface{}) (err error) {
 	for i := 0; i < scc.ScRequestPoolSize; i++ {
 		scc.cmdReqPool <- new(cmdproto.ScRequest)
 	}
-	//todo:
 	scc.register("start", startHandler)
 	scc.register("stop", stopHandler)
+	scc.register("restart", restartHandler)
+	scc.register("status", statusHandler)
 	scc.register("monitor", monitorHandler)
+	scc.register("history", historyHandler)
 	cmdlog.Printf("ServiceCtrlCmd Init ok\n")
 	return nil
 }
 
+// Reload
+// new service settings apply from the next start, running services keep
+// their process. a removed service that is still running stays manageable
+// until it is stopped, added back meanwhile it is managed as before and
+// auto monitored again. an attached health monitor keeps its check until it
+// is attached again. request_pool_size only changes on restart.
+func (scc *ServiceCtrlCmd) Reload(config interface{}) error {
+	newConf := config.(*ScCmdConfig)
+	if err := validateServices(newConf); err != nil {
+		return err
+	}
+	scc.svcLock.Lock()
+	defer scc.svcLock.Unlock()
+	if newConf.ScRequestPoolSize != scc.ScRequestPoolSize {
+		cmdlog.EPrintf("ServiceCtrlCmd request_pool_size change needs a restart\n")
+		newConf.ScRequestPoolSize = scc.ScRequestPoolSize
+	}
+	for name, svc := range scc.services {
+		if _, ok := newConf.Services[name]; ok {
+			continue
+		}
+		if svc.running() {
+			cmdlog.EPrintf("service %s removed from config but still running\n", name)
+			svc.setRemoved()
+			continue
+		}
+		delete(scc.services, name)
+	}
+	for name := range newConf.Services {
+		conf := newConf.Services[name]
+		if svc, ok := scc.services[name]; ok {
+			if svc.setConfig(&conf) {
+				autoMonitor(svc, &conf)
+			}
+			continue
+		}
+		scc.services[name] = newService(name, &conf)
+		autoMonitor(scc.services[name], &conf)
+	}
+	scc.ScCmdConfig = newConf
+	return nil
+}
+
+func autoMonitor(svc *service, conf *ServiceConfig) {
+	if !conf.Health.Auto {
+		return
+	}
+	if err := svc.attach(conf.Health); err != nil {
+		cmdlog.EPrintln(err.Error())
+	}
+}
+
+func validateServices(conf *ScCmdConfig) error {
+	for name := range conf.Services {
+		svcConf := conf.Services[name]
+		if err := svcConf.validate(name); err != nil {
+			return err
+		}
+		conf.Services[name] = svcConf
+	}
+	return nil
+}
+
+// lookupServices
+// the services named by req, every service for "" or "all".
+func (scc *ServiceCtrlCmd) lookupServices(req *cmdproto.ScRequest) ([]*service, error) {
+	scc.svcLock.Lock()
+	defer scc.svcLock.Unlock()
+	name := req.ServiceInfo.Service
+	if name == "" || name == "all" {
+		names := make([]string, 0, len(scc.services))
+		for name := range scc.services {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		res := make([]*service, 0, len(names))
+		for _, name := range names {
+			res = append(res, scc.services[name])
+		}
+		return res, nil
+	}
+	svc, ok := scc.services[name]
+	if !ok {
+		return nil, fmt.Errorf("service %s not configured", name)
+	}
+	return []*service{svc}, nil
+}
+
+// forget
+// drops a service removed from the config once it stopped.
+func (scc *ServiceCtrlCmd) forget(svc *service) {
+	scc.svcLock.Lock()
+	defer scc.svcLock.Unlock()
+	if svc.isRemoved() && !svc.running() && scc.services[svc.name] == svc {
+		delete(scc.services, svc.name)
+	}
+}
+
+func (scc *ServiceCtrlCmd) Stats() []cmds.Metric {
+	return cmds.PoolStats("sctl", cap(scc.cmdReqPool), len(scc.cmdReqPool))
+}
+
 func (scc *ServiceCtrlCmd) register(cmd string, handler func(scc *ServiceCtrlCmd, req *cmdproto.ScRequest) (interface{}, error)) {
 	if _, ok := scc.cmdHandlers[cmd]; ok {
 		cmdlog.EPrintf("duplicate serive ctrl cmd %s handler registered!\n", cmd)
@@ -97,17 +230,119 @@ func (scc *ServiceCtrlCmd) register(cmd string, handler func(scc *ServiceCtrlCmd
 	scc.cmdHandlers[cmd] = handler
 }
 
+func singleService(scc *ServiceCtrlCmd, req *cmdproto.ScRequest) (*service, error) {
+	if req.ServiceInfo.Service == "" || req.ServiceInfo.Service == "all" {
+		return nil, errors.New("without specify service")
+	}
+	svcs, err := scc.lookupServices(req)
+	if err != nil {
+		return nil, err
+	}
+	return svcs[0], nil
+}
+
 func startHandler(scc *ServiceCtrlCmd, req *cmdproto.ScRequest) (interface{}, error) {
-	return nil, nil
+	svc, err := singleService(scc, req)
+	if err != nil {
+		return nil, err
+	}
+	if svc.isRemoved() {
+		return nil, fmt.Errorf("service %s removed from config", svc.name)
+	}
+	if err = svc.Start(); err != nil {
+		return nil, err
+	}
+	return fmt.Sprintf("service %s started, pid %d.", svc.name, svc.Status().Pid), nil
 }
 
 func stopHandler(scc *ServiceCtrlCmd, req *cmdproto.ScRequest) (interface{}, error) {
-	return nil, nil
+	svc, err := singleService(scc, req)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.Stop(); err != nil {
+		return nil, err
+	}
+	scc.forget(svc)
+	return fmt.Sprintf("service %s stopped.", svc.name), nil
+}
+
+func restartHandler(scc *ServiceCtrlCmd, req *cmdproto.ScRequest) (interface{}, error) {
+	svc, err := singleService(scc, req)
+	if err != nil {
+		return nil, err
+	}
+	if svc.running() {
+		if err = svc.Stop(); err != nil {
+			return nil, err
+		}
+	}
+	if svc.isRemoved() {
+		scc.forget(svc)
+		return nil, fmt.Errorf("service %s removed from config", svc.name)
+	}
+	if err = svc.Start(); err != nil {
+		return nil, err
+	}
+	return fmt.Sprintf("service %s restarted, pid %d.", svc.name, svc.Status().Pid), nil
 }
 
+func statusHandler(scc *ServiceCtrlCmd, req *cmdproto.ScRequest) (interface{}, error) {
+	svcs, err := scc.lookupServices(req)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]ServiceStatus, 0, len(svcs))
+	for _, svc := range svcs {
+		res = append(res, svc.Status())
+	}
+	return json.Marshal(res)
+}
+
+// monitorHandler
+// attaches the health check of the service config, or the check named by
+// the arg. "off" detaches the monitor.
 func monitorHandler(scc *ServiceCtrlCmd, req *cmdproto.ScRequest) (interface{}, error) {
-	return nil, nil
+	svc, err := singleService(scc, req)
+	if err != nil {
+		return nil, err
+	}
+	args := req.ServiceInfo.Args
+	if len(args) == 1 && args[0] == "off" {
+		if !svc.detach("monitor off requested") {
+			return nil, fmt.Errorf("service %s is not monitored", svc.name)
+		}
+		return fmt.Sprintf("service %s no longer monitored.", svc.name), nil
+	}
+	if svc.isRemoved() {
+		return nil, fmt.Errorf("service %s removed from config", svc.name)
+	}
+	svc.mu.Lock()
+	conf, err := svc.conf.healthCheck(args)
+	svc.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.attach(conf); err != nil {
+		return nil, err
+	}
+	return fmt.Sprintf("service %s monitored with %s every %s.", svc.name, conf.String(), conf.Interval.Duration), nil
 }
+
+// historyHandler
+// the recorded transitions by service name.
+func historyHandler(scc *ServiceCtrlCmd, req *cmdproto.ScRequest) (interface{}, error) {
+	svcs, err := scc.lookupServices(req)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string][]Transition, len(svcs))
+	for _, svc := range svcs {
+		res[svc.name] = svc.Transitions()
+	}
+	return json.Marshal(res)
+}
+
 func (scc *ServiceCtrlCmd) getAvalibleReq() *cmdproto.ScRequest {
 	return <-scc.cmdReqPool
 }
@@ -0,0 +1,177 @@
+package sched
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec
+// a parsed "minute hour day-of-month month day-of-week" expression, or a
+// fixed interval for "@every <duration>". each field is a bit set.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+	every                         time.Duration
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = cronField{name: "minute", min: 0, max: 59}
+	hourField   = cronField{name: "hour", min: 0, max: 23}
+	domField    = cronField{name: "day of month", min: 1, max: 31}
+	monthField  = cronField{name: "month", min: 1, max: 12, names: map[string]int{"jan": 1, "feb": 2,
+		"mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}}
+	dowField = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{"sun": 0, "mon": 1,
+		"tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron
+// accepts the five standard fields with *, lists, ranges, steps and month
+// or weekday names, the @hourly style macros and "@every <duration>".
+func parseCron(expr string) (*cronSpec, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		every, err := time.ParseDuration(strings.TrimSpace(expr[len("@every "):]))
+		if err != nil || every < time.Second {
+			return nil, fmt.Errorf("bad cron %q, @every needs a duration of at least 1s", expr)
+		}
+		return &cronSpec{every: every}, nil
+	}
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("bad cron %q, 5 fields expected", expr)
+	}
+	spec := &cronSpec{domStar: strings.HasPrefix(fields[2], "*"), dowStar: strings.HasPrefix(fields[4], "*")}
+	var err error
+	for i, f := range []struct {
+		field *cronField
+		bits  *uint64
+	}{{&minuteField, &spec.minute}, {&hourField, &spec.hour}, {&domField, &spec.dom},
+		{&monthField, &spec.month}, {&dowField, &spec.dow}} {
+		if *f.bits, err = f.field.parse(fields[i]); err != nil {
+			return nil, fmt.Errorf("bad cron %q: %s", expr, err.Error())
+		}
+	}
+	// 7 is sunday as well.
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	if spec.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("bad cron %q, it never matches", expr)
+	}
+	return spec, nil
+}
+
+func (cf *cronField) value(val string) (int, error) {
+	if n, ok := cf.names[strings.ToLower(val)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < cf.min || n > cf.max {
+		return 0, fmt.Errorf("%s %s out of range %d-%d", cf.name, val, cf.min, cf.max)
+	}
+	return n, nil
+}
+
+func (cf *cronField) parse(field string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad %s step %s", cf.name, part[i+1:])
+			}
+			step, part = n, part[:i]
+		}
+		lo, hi := cf.min, cf.max
+		switch {
+		case part == "*":
+		case strings.IndexByte(part, '-') > 0:
+			i := strings.IndexByte(part, '-')
+			var err error
+			if lo, err = cf.value(part[:i]); err != nil {
+				return 0, err
+			}
+			if hi, err = cf.value(part[i+1:]); err != nil {
+				return 0, err
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("bad %s range %s", cf.name, part)
+			}
+		default:
+			n, err := cf.value(part)
+			if err != nil {
+				return 0, err
+			}
+			lo = n
+			if step == 1 {
+				hi = n
+			}
+		}
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+func (spec *cronSpec) dayMatches(t time.Time) bool {
+	domOK := spec.dom&(1<<uint(t.Day())) != 0
+	dowOK := spec.dow&(1<<uint(t.Weekday())) != 0
+	// like cron, a restricted day of month or day of week is enough.
+	if spec.domStar || spec.dowStar {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
+
+// next
+// the first matching time after t, zero if none within five years.
+func (spec *cronSpec) next(t time.Time) time.Time {
+	if spec.every > 0 {
+		return t.Add(spec.every)
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if spec.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !spec.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if spec.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if spec.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
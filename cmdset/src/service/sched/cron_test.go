@@ -0,0 +1,68 @@
+package sched
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	from := time.Date(2024, time.January, 31, 10, 30, 0, 0, time.UTC) // a wednesday
+	tests := []struct {
+		expr string
+		next string
+		err  string
+	}{
+		{expr: "* * * * *", next: "2024-01-31 10:31"},
+		{expr: "0 * * * *", next: "2024-01-31 11:00"},
+		{expr: "*/15 * * * *", next: "2024-01-31 10:45"},
+		{expr: "5-10/5 9,12 * * *", next: "2024-01-31 12:05"},
+		{expr: "0 3 * * sun", next: "2024-02-04 03:00"},
+		{expr: "0 3 * * 7", next: "2024-02-04 03:00"},
+		{expr: "0 0 * feb mon-tue", next: "2024-02-05 00:00"},
+		{expr: "0 0 29 2 *", next: "2024-02-29 00:00"},
+		// a restricted day of month or day of week is enough.
+		{expr: "0 0 1 * fri", next: "2024-02-01 00:00"},
+		{expr: "0 0 15 * *", next: "2024-02-15 00:00"},
+		{expr: "30 10 31 * *", next: "2024-03-31 10:30"},
+		{expr: " @daily ", next: "2024-02-01 00:00"},
+		{expr: "@hourly", next: "2024-01-31 11:00"},
+		{expr: "@yearly", next: "2025-01-01 00:00"},
+		{expr: "@every 90s", next: "2024-01-31 10:31:30"},
+		{expr: "", err: "5 fields expected"},
+		{expr: "* * * *", err: "5 fields expected"},
+		{expr: "60 * * * *", err: "minute 60 out of range 0-59"},
+		{expr: "* 24 * * *", err: "hour 24 out of range 0-23"},
+		{expr: "* * 0 * *", err: "day of month 0 out of range 1-31"},
+		{expr: "* * * 13 *", err: "month 13 out of range 1-12"},
+		{expr: "* * * * 8", err: "day of week 8 out of range 0-7"},
+		{expr: "* * * foo *", err: "month foo out of range"},
+		{expr: "10-5 * * * *", err: "bad minute range 10-5"},
+		{expr: "*/0 * * * *", err: "bad minute step 0"},
+		{expr: "0 0 30 2 *", err: "it never matches"},
+		{expr: "@every 500ms", err: "at least 1s"},
+		{expr: "@every soon", err: "at least 1s"},
+		{expr: "@sometimes", err: "5 fields expected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			spec, err := parseCron(tt.expr)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			layout := "2006-01-02 15:04"
+			if len(tt.next) > len(layout) {
+				layout += ":05"
+			}
+			if next := spec.next(from).Format(layout); next != tt.next {
+				t.Fatalf("next %s, want %s", next, tt.next)
+			}
+		})
+	}
+}
@@ -0,0 +1,668 @@
+package sched
+
+import (
+	"cmdproto"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"service/cmdlog"
+	"service/cmds"
+	"service/notify"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SchedConfig
+// the [sched] section. schedules are kept in StateFile, History runs of
+// each are kept in memory with the first MaxOutput bytes of their output.
+type SchedConfig struct {
+	StateFile string `toml:"state_file"`
+	History   int    `toml:"history"`
+	MaxOutput int    `toml:"max_output"`
+}
+
+// SchedCmd
+// runs syscmd and mongo requests or named tasks on cron schedules, in
+// process and on behalf of the caller that added them.
+type SchedCmd struct {
+	*SchedConfig
+	cmdHandlers map[string]func(s *SchedCmd, req *cmdproto.SchedRequest, caller string) (interface{}, error)
+	lock        sync.Mutex
+	schedules   map[string]*schedule
+	confLock    sync.RWMutex
+}
+
+// schedule
+// a schedule and its runs, everything but running is guarded by the
+// SchedCmd lock.
+type schedule struct {
+	cmdproto.Schedule
+	spec    *cronSpec
+	stop    chan struct{}
+	next    time.Time
+	runs    []cmdproto.SchedRun
+	running int32
+	failing bool
+}
+
+// ScheduleStatus
+// a schedule as listed, NextRun is unset while paused.
+type ScheduleStatus struct {
+	cmdproto.Schedule
+	NextRun *time.Time         `json:"next_run,omitempty"`
+	LastRun *cmdproto.SchedRun `json:"last_run,omitempty"`
+	Running bool               `json:"running"`
+}
+
+// deniedError
+// the owner may not invoke what the schedule runs, or the caller may not
+// manage the schedule.
+type deniedError struct {
+	msg string
+}
+
+func (de *deniedError) Error() string {
+	return de.msg
+}
+
+type stateFile struct {
+	Schedules []cmdproto.Schedule `json:"schedules"`
+}
+
+func (s *SchedCmd) ConfigStruct() interface{} {
+	return &SchedConfig{StateFile: "sched.json", History: 20, MaxOutput: 64 * 1024}
+}
+
+func (conf *SchedConfig) validate() error {
+	if conf.StateFile == "" {
+		return errors.New("sched state_file is empty")
+	}
+	if conf.History <= 0 {
+		conf.History = 20
+	}
+	if conf.MaxOutput <= 0 {
+		conf.MaxOutput = 64 * 1024
+	}
+	return nil
+}
+
+func (s *SchedCmd) Init(config interface{}) error {
+	s.SchedConfig = config.(*SchedConfig)
+	cmdlog.Printf("SchedCmd Init config :(%+v)\n", s.SchedConfig)
+	if err := s.validate(); err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+	s.cmdHandlers = make(map[string]func(s *SchedCmd, req *cmdproto.SchedRequest, caller string) (interface{}, error))
+	s.schedules = make(map[string]*schedule)
+	s.register("list", listHandler)
+	s.register("add", addHandler)
+	s.register("pause", pauseHandler)
+	s.register("resume", resumeHandler)
+	s.register("remove", removeHandler)
+	s.register("results", resultsHandler)
+	s.register("tasks", tasksHandler)
+
+	if err := s.load(); err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+	cmdlog.Printf("SchedCmd Init ok, %d schedules\n", len(s.schedules))
+	return nil
+}
+
+// Reload
+// history and max_output apply to the next runs, state_file needs a
+// restart.
+func (s *SchedCmd) Reload(config interface{}) error {
+	newConf := config.(*SchedConfig)
+	if err := newConf.validate(); err != nil {
+		return err
+	}
+	s.confLock.Lock()
+	defer s.confLock.Unlock()
+	if newConf.StateFile != s.StateFile {
+		cmdlog.EPrintf("SchedCmd state_file change needs a restart\n")
+		newConf.StateFile = s.StateFile
+	}
+	s.SchedConfig = newConf
+	return nil
+}
+
+func (s *SchedCmd) config() *SchedConfig {
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+	return s.SchedConfig
+}
+
+func (s *SchedCmd) register(op string, fn func(s *SchedCmd, req *cmdproto.SchedRequest, caller string) (interface{}, error)) {
+	if _, ok := s.cmdHandlers[op]; ok {
+		cmdlog.EPrintf("duplicate sched op %s handler registered!\n", op)
+		return
+	}
+	s.cmdHandlers[op] = fn
+}
+
+// load
+// starts the schedules of the state file, broken ones are dropped.
+func (s *SchedCmd) load() error {
+	data, err := ioutil.ReadFile(s.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := &stateFile{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return fmt.Errorf("sched state %s: %s", s.StateFile, err.Error())
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, sched := range state.Schedules {
+		spec, err := parseCron(sched.Cron)
+		if err != nil {
+			cmdlog.EPrintf("sched %s dropped: %s\n", sched.Id, err.Error())
+			continue
+		}
+		sc := &schedule{Schedule: sched, spec: spec}
+		s.schedules[sc.Id] = sc
+		if !sc.Paused {
+			s.startLocked(sc)
+		}
+	}
+	return nil
+}
+
+// saveLocked
+// writes the schedules to a temp file renamed over the state file.
+func (s *SchedCmd) saveLocked() error {
+	state := &stateFile{Schedules: make([]cmdproto.Schedule, 0, len(s.schedules))}
+	for _, sc := range s.schedules {
+		state.Schedules = append(state.Schedules, sc.Schedule)
+	}
+	sort.Slice(state.Schedules, func(i, j int) bool {
+		return state.Schedules[i].Created.Before(state.Schedules[j].Created)
+	})
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := s.config().StateFile
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("sched save %s: %s", path, err.Error())
+	}
+	return nil
+}
+
+func (s *SchedCmd) startLocked(sc *schedule) {
+	sc.stop, sc.next = make(chan struct{}), sc.spec.next(time.Now())
+	go s.loop(sc, sc.stop)
+}
+
+func (s *SchedCmd) stopLocked(sc *schedule) {
+	if sc.stop != nil {
+		close(sc.stop)
+		sc.stop = nil
+	}
+	sc.next = time.Time{}
+}
+
+// loop
+// waits for the next matching time and runs the schedule, a run still
+// going on when the next one is due makes that one skip.
+func (s *SchedCmd) loop(sc *schedule, stop chan struct{}) {
+	for {
+		now := time.Now()
+		next := sc.spec.next(now)
+		if next.IsZero() {
+			cmdlog.EPrintf("sched %s: cron %q never matches\n", sc.Id, sc.Cron)
+			return
+		}
+		s.lock.Lock()
+		if sc.stop != stop {
+			s.lock.Unlock()
+			return
+		}
+		sc.next = next
+		s.lock.Unlock()
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			go s.run(sc)
+		}
+	}
+}
+
+// target
+// the handler a sys or mgo schedule invokes and its request body.
+func target(sched *cmdproto.Schedule) (handler string, body []byte, err error) {
+	switch {
+	case sched.Sys != nil:
+		body, err = json.Marshal(sched.Sys)
+		return "syscmd", body, err
+	case sched.Mgo != nil:
+		body, err = json.Marshal(sched.Mgo)
+		return "mongo", body, err
+	}
+	return "", nil, nil
+}
+
+// taskOp
+// task names are "<handler>.<op>", the owner needs that permission.
+func taskOp(name string) (string, string) {
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+// check
+// validates what sched runs and that owner may invoke it.
+func check(sched *cmdproto.Schedule, owner string) error {
+	n := 0
+	for _, set := range []bool{sched.Sys != nil, sched.Mgo != nil, sched.Task != ""} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("a schedule runs exactly one of sys, mgo or task")
+	}
+	if sched.Task != "" {
+		if _, ok := cmds.Task(sched.Task); !ok {
+			return fmt.Errorf("unknown task %s", sched.Task)
+		}
+		handler, op := taskOp(sched.Task)
+		if !cmds.Permitted(owner, handler, op) {
+			return &deniedError{fmt.Sprintf("owner %q is not permitted to invoke %s:%s", owner, handler, op)}
+		}
+		return nil
+	}
+	handler, body, err := target(sched)
+	if err != nil {
+		return err
+	}
+	op, _, err := cmds.DescribeBody(handler, body)
+	if err != nil {
+		return err
+	}
+	if !cmds.Permitted(owner, handler, op) {
+		return &deniedError{fmt.Sprintf("owner %q is not permitted to invoke %s:%s", owner, handler, op)}
+	}
+	return nil
+}
+
+// run
+// dispatches the schedule once and records the outcome, failures fire an
+// alert resolved by the next good run.
+func (s *SchedCmd) run(sc *schedule) {
+	conf := s.config()
+	run := cmdproto.SchedRun{Start: time.Now().UTC()}
+	if !atomic.CompareAndSwapInt32(&sc.running, 0, 1) {
+		run.Skipped, run.Error = true, "previous run still running"
+		s.record(sc, run, conf.History)
+		return
+	}
+	defer atomic.StoreInt32(&sc.running, 0)
+
+	if sc.Task != "" {
+		handler, op := taskOp(sc.Task)
+		fn, ok := cmds.Task(sc.Task)
+		switch {
+		case !ok:
+			run.Error = "unknown task " + sc.Task
+		case !cmds.Permitted(sc.Owner, handler, op):
+			run.Error = fmt.Sprintf("owner %q is not permitted to invoke %s:%s", sc.Owner, handler, op)
+		default:
+			out, err := fn(sc.Args)
+			if len(out) > conf.MaxOutput {
+				out, run.Truncated = out[:conf.MaxOutput], true
+			}
+			run.Output = out
+			if err != nil {
+				run.Error = err.Error()
+			}
+		}
+	} else {
+		handler, body, err := target(&sc.Schedule)
+		var res *cmds.DispatchResult
+		if err == nil {
+			res, err = cmds.Dispatch(handler, sc.Owner, "sched:"+sc.Id, body, conf.MaxOutput)
+		}
+		if err != nil {
+			run.Error = err.Error()
+		} else {
+			run.Status, run.Output, run.Truncated = res.Status, string(res.Output), res.Truncated
+			if code, err := strconv.Atoi(res.Header.Get("X-Cmd-Exit-Code")); err == nil {
+				run.ExitCode = &code
+			}
+		}
+	}
+	run.Duration = time.Since(run.Start).Seconds()
+	s.record(sc, run, conf.History)
+}
+
+func failed(run *cmdproto.SchedRun) bool {
+	return run.Error != "" || run.Status >= http.StatusBadRequest || (run.ExitCode != nil && *run.ExitCode != 0)
+}
+
+func (s *SchedCmd) record(sc *schedule, run cmdproto.SchedRun, history int) {
+	s.lock.Lock()
+	sc.runs = append(sc.runs, run)
+	if len(sc.runs) > history {
+		sc.runs = append(sc.runs[:0], sc.runs[len(sc.runs)-history:]...)
+	}
+	wasFailing := sc.failing
+	if !run.Skipped {
+		sc.failing = failed(&run)
+	}
+	failing := sc.failing
+	s.lock.Unlock()
+
+	name := sc.Id
+	if sc.Name != "" {
+		name = sc.Name + " (" + sc.Id + ")"
+	}
+	switch {
+	case run.Skipped:
+		cmdlog.EPrintf("sched %s skipped, previous run still running\n", name)
+	case failing:
+		msg := run.Error
+		if msg == "" && run.ExitCode != nil {
+			msg = fmt.Sprintf("status %d exit code %d", run.Status, *run.ExitCode)
+		} else if msg == "" {
+			msg = fmt.Sprintf("status %d", run.Status)
+		}
+		cmdlog.EPrintf("sched %s failed: %s\n", name, msg)
+		notify.Send(&notify.Alert{Key: "sched." + sc.Id, Source: "sched", Severity: "warning",
+			State: notify.StateFiring, Subject: "schedule " + name, Body: "run failed, " + msg, Time: run.Start})
+	case wasFailing:
+		notify.Send(&notify.Alert{Key: "sched." + sc.Id, Source: "sched", Severity: "warning",
+			State: notify.StateResolved, Subject: "schedule " + name, Body: "run succeeded again", Time: run.Start})
+	default:
+		cmdlog.Printf("sched %s ran in %.3fs\n", name, run.Duration)
+	}
+}
+
+func newId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *SchedCmd) status(sc *schedule) ScheduleStatus {
+	st := ScheduleStatus{Schedule: sc.Schedule, Running: atomic.LoadInt32(&sc.running) == 1}
+	if !sc.next.IsZero() {
+		next := sc.next
+		st.NextRun = &next
+	}
+	if len(sc.runs) > 0 {
+		last := sc.runs[len(sc.runs)-1]
+		st.LastRun = &last
+	}
+	return st
+}
+
+// manages
+// whether caller may see the runs of sc and pause or remove it, its owner
+// or whoever may invoke what it runs.
+func manages(sc *schedule, caller string) bool {
+	return caller == sc.Owner || check(&sc.Schedule, caller) == nil
+}
+
+// lookupManaged
+// the schedule id if caller manages it.
+func (s *SchedCmd) lookupManaged(id, caller string) (*schedule, error) {
+	s.lock.Lock()
+	sc, err := s.lookupLocked(id)
+	s.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if !manages(sc, caller) {
+		return nil, &deniedError{fmt.Sprintf("schedule %s belongs to %s", id, sc.Owner)}
+	}
+	return sc, nil
+}
+
+// listHandler
+// every schedule, what the ones caller does not manage run and print is
+// left out.
+func listHandler(s *SchedCmd, req *cmdproto.SchedRequest, caller string) (interface{}, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]ScheduleStatus, 0, len(s.schedules))
+	for _, sc := range s.schedules {
+		st := s.status(sc)
+		if !manages(sc, caller) {
+			st.Sys, st.Mgo, st.Args = nil, nil, nil
+			if st.LastRun != nil {
+				st.LastRun.Output = ""
+			}
+		}
+		res = append(res, st)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Created.Before(res[j].Created) })
+	return res, nil
+}
+
+func addHandler(s *SchedCmd, req *cmdproto.SchedRequest, caller string) (interface{}, error) {
+	if req.Schedule == nil {
+		return nil, errors.New("add needs a schedule")
+	}
+	sched := *req.Schedule
+	spec, err := parseCron(sched.Cron)
+	if err != nil {
+		return nil, err
+	}
+	if err = check(&sched, caller); err != nil {
+		return nil, err
+	}
+	sched.Id, sched.Owner, sched.Created = newId(), caller, time.Now().UTC()
+	sc := &schedule{Schedule: sched, spec: spec}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.schedules[sc.Id] = sc
+	if err = s.saveLocked(); err != nil {
+		delete(s.schedules, sc.Id)
+		return nil, err
+	}
+	if !sc.Paused {
+		s.startLocked(sc)
+	}
+	cmdlog.Printf("sched %s added by %s, cron %q\n", sc.Id, caller, sc.Cron)
+	return s.status(sc), nil
+}
+
+func (s *SchedCmd) lookupLocked(id string) (*schedule, error) {
+	sc, ok := s.schedules[id]
+	if !ok {
+		return nil, fmt.Errorf("schedule %s not found", id)
+	}
+	return sc, nil
+}
+
+// setPaused
+// pauses or resumes a schedule, a pause does not stop a run going on.
+func (s *SchedCmd) setPaused(id string, paused bool) (interface{}, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sc, err := s.lookupLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	if sc.Paused == paused {
+		return s.status(sc), nil
+	}
+	sc.Paused = paused
+	if err = s.saveLocked(); err != nil {
+		sc.Paused = !paused
+		return nil, err
+	}
+	if paused {
+		s.stopLocked(sc)
+	} else {
+		s.startLocked(sc)
+	}
+	return s.status(sc), nil
+}
+
+func pauseHandler(s *SchedCmd, req *cmdproto.SchedRequest, caller string) (interface{}, error) {
+	if _, err := s.lookupManaged(req.Id, caller); err != nil {
+		return nil, err
+	}
+	return s.setPaused(req.Id, true)
+}
+
+// resumeHandler
+// checks the owner is still permitted before the schedule runs again.
+func resumeHandler(s *SchedCmd, req *cmdproto.SchedRequest, caller string) (interface{}, error) {
+	sc, err := s.lookupManaged(req.Id, caller)
+	if err != nil {
+		return nil, err
+	}
+	if err = check(&sc.Schedule, sc.Owner); err != nil {
+		return nil, err
+	}
+	return s.setPaused(req.Id, false)
+}
+
+func removeHandler(s *SchedCmd, req *cmdproto.SchedRequest, caller string) (interface{}, error) {
+	if _, err := s.lookupManaged(req.Id, caller); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sc, err := s.lookupLocked(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	delete(s.schedules, sc.Id)
+	if err = s.saveLocked(); err != nil {
+		s.schedules[sc.Id] = sc
+		return nil, err
+	}
+	s.stopLocked(sc)
+	cmdlog.Printf("sched %s removed by %s\n", sc.Id, caller)
+	return fmt.Sprintf("schedule %s removed", sc.Id), nil
+}
+
+func resultsHandler(s *SchedCmd, req *cmdproto.SchedRequest, caller string) (interface{}, error) {
+	sc, err := s.lookupManaged(req.Id, caller)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	runs := sc.runs
+	if req.Limit > 0 && req.Limit < len(runs) {
+		runs = runs[len(runs)-req.Limit:]
+	}
+	return append([]cmdproto.SchedRun{}, runs...), nil
+}
+
+func tasksHandler(s *SchedCmd, req *cmdproto.SchedRequest, caller string) (interface{}, error) {
+	return cmds.TaskNames(), nil
+}
+
+func (s *SchedCmd) DescribeRequest(req *http.Request) (string, []string, error) {
+	data, err := cmds.PeekBody(req)
+	if err != nil {
+		return "", nil, err
+	}
+	schedReq := &cmdproto.SchedRequest{}
+	if err = json.Unmarshal(data, schedReq); err != nil {
+		return "", nil, err
+	}
+	var args []string
+	if schedReq.Id != "" {
+		args = append(args, schedReq.Id)
+	}
+	if sched := schedReq.Schedule; sched != nil {
+		args = append(args, sched.Cron)
+		if sched.Task != "" {
+			args = append(append(args, sched.Task), sched.Args...)
+		} else if _, body, err := target(sched); err == nil {
+			args = append(args, string(body))
+		}
+	}
+	return strings.ToLower(schedReq.Op), args, nil
+}
+
+func (s *SchedCmd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		cmdlog.EPrintf("%s\n", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer req.Body.Close()
+	schedReq := &cmdproto.SchedRequest{}
+	if err = json.Unmarshal(data, schedReq); err != nil {
+		cmdlog.EPrintf("%s\n", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	op := strings.ToLower(schedReq.Op)
+	handler, ok := s.cmdHandlers[op]
+	if !ok {
+		cmdlog.EPrintln("method not implemented")
+		http.Error(w, fmt.Sprintf("server do not support command %s", op), http.StatusNotImplemented)
+		return
+	}
+	res, err := handler(s, schedReq, cmds.Caller(req))
+	if err != nil {
+		cmdlog.EPrintf("%s\n", err.Error())
+		if _, ok := err.(*deniedError); ok {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	switch res := res.(type) {
+	case string:
+		fmt.Fprintln(w, res)
+	default:
+		out, _ := json.Marshal(res)
+		fmt.Fprintln(w, string(out))
+	}
+}
+
+func init() {
+	schedCmd := &SchedCmd{}
+	cmds.RegisterCmd("sched", schedCmd)
+}
@@ -7,6 +7,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"service/cmds"
+	"time"
 )
 
 type BasicSvrConfig struct {
@@ -15,9 +17,34 @@ type BasicSvrConfig struct {
 }
 type CmddConfig struct {
 	BasicSvrConfig
-	ListenAddr    string   `toml:"listen_addr"`
-	ConfigServers []string `toml:"config_addrs"`
-	ConfigDir     string   `toml:"config_dir"`
+	cmds.TLSConfig
+	ListenAddr      string        `toml:"listen_addr"`
+	ConfigServers   []string      `toml:"config_addrs"`
+	ConfigDir       string        `toml:"config_dir"`
+	RegisterTTL     cmds.Duration `toml:"register_ttl"`
+	Heartbeat       cmds.Duration `toml:"heartbeat_interval"`
+	AdvertiseAddr   string        `toml:"advertise_addr"`
+	AdvertiseIface  string        `toml:"advertise_iface"`
+	ShutdownTimeout cmds.Duration `toml:"shutdown_timeout"`
+	WatchConfigKey  string        `toml:"watch_config_key"`
+}
+
+// validate
+// heartbeat_interval drives a ticker, which panics on a zero interval.
+// the ttl goes to etcd in whole seconds where 0 never expires, and the key
+// would expire between beats not shorter than it.
+func (conf *CmddConfig) validate() error {
+	if conf.Heartbeat.Duration <= 0 {
+		return fmt.Errorf("heartbeat_interval %s must be positive", conf.Heartbeat.Duration)
+	}
+	if conf.RegisterTTL.Duration < time.Second {
+		return fmt.Errorf("register_ttl %s must be at least 1s", conf.RegisterTTL.Duration)
+	}
+	if conf.Heartbeat.Duration >= conf.RegisterTTL.Duration {
+		return fmt.Errorf("heartbeat_interval %s must be shorter than register_ttl %s",
+			conf.Heartbeat.Duration, conf.RegisterTTL.Duration)
+	}
+	return nil
 }
 
 func LoadCmdConfig(configFileName string) (config map[string]toml.Primitive, md *toml.MetaData, err error) {
@@ -0,0 +1,504 @@
+package syscmd
+
+import (
+	"cmdproto"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"service/cmdlog"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	jobRunning  = "running"
+	jobExited   = "exited"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+	// killed for hitting one of its limits.
+	jobKilled = "killed"
+)
+
+const (
+	streamStdout = 1 << iota
+	streamStderr
+)
+
+type outputChunk struct {
+	stream int
+	data   []byte
+}
+
+// jobOutput
+// keeps the most recent output of a job, at most limit bytes.
+// chunks are addressed by sequence number so readers can resume.
+type jobOutput struct {
+	limit   int
+	size    int
+	first   int
+	chunks  []outputChunk
+	total   int64
+	dropped int64
+}
+
+func (o *jobOutput) append(stream int, p []byte) {
+	data := make([]byte, len(p))
+	copy(data, p)
+	o.chunks = append(o.chunks, outputChunk{stream: stream, data: data})
+	o.size += len(data)
+	o.total += int64(len(data))
+	for o.size > o.limit && len(o.chunks) > 1 {
+		o.size -= len(o.chunks[0].data)
+		o.dropped += int64(len(o.chunks[0].data))
+		o.chunks[0].data = nil
+		o.chunks = o.chunks[1:]
+		o.first++
+	}
+}
+
+func (o *jobOutput) bytes(mask int) []byte {
+	var buf []byte
+	for _, c := range o.chunks {
+		if c.stream&mask != 0 {
+			buf = append(buf, c.data...)
+		}
+	}
+	return buf
+}
+
+type Job struct {
+	Id        string
+	Args      []string
+	State     string
+	Pid       int
+	ExitCode  int
+	Signal    string
+	Error     string
+	Limit     string
+	StartTime time.Time
+	EndTime   time.Time
+	Rusage    *cmdproto.Rusage
+
+	cmd      *exec.Cmd
+	mu       sync.Mutex
+	cond     *sync.Cond
+	out      jobOutput
+	canceled bool
+	done     chan struct{}
+	limits   *jobLimits
+	cgroup   string
+	timer    *time.Timer
+}
+
+type JobStatus struct {
+	Id          string           `json:"id"`
+	Args        []string         `json:"args"`
+	State       string           `json:"state"`
+	Pid         int              `json:"pid"`
+	ExitCode    int              `json:"exit_code"`
+	Signal      string           `json:"signal,omitempty"`
+	Error       string           `json:"error,omitempty"`
+	Limit       string           `json:"limit,omitempty"`
+	StartTime   time.Time        `json:"start_time"`
+	EndTime     time.Time        `json:"end_time"`
+	WallTime    float64          `json:"wall_time"`
+	Rusage      *cmdproto.Rusage `json:"rusage,omitempty"`
+	OutputBytes int64            `json:"output_bytes"`
+	Truncated   bool             `json:"truncated"`
+}
+
+type JobResult struct {
+	JobStatus
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+}
+
+type jobWriter struct {
+	job    *Job
+	stream int
+}
+
+func (jw *jobWriter) Write(p []byte) (int, error) {
+	jw.job.mu.Lock()
+	jw.job.out.append(jw.stream, p)
+	over := jw.job.limits.maxOutput > 0 && jw.job.out.total > jw.job.limits.maxOutput
+	jw.job.mu.Unlock()
+	jw.job.cond.Broadcast()
+	if over {
+		jw.job.limitHit(limitMaxOutput)
+	}
+	return len(p), nil
+}
+
+func (job *Job) finished() bool {
+	select {
+	case <-job.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (job *Job) Status() JobStatus {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.status()
+}
+
+func (job *Job) status() JobStatus {
+	return JobStatus{Id: job.Id, Args: job.Args, State: job.State, Pid: job.Pid,
+		ExitCode: job.ExitCode, Signal: job.Signal, Error: job.Error, Limit: job.Limit,
+		StartTime: job.StartTime, EndTime: job.EndTime, WallTime: job.wallTime(),
+		Rusage: job.Rusage, OutputBytes: job.out.total, Truncated: job.out.dropped > 0}
+}
+
+func (job *Job) wallTime() float64 {
+	if job.EndTime.IsZero() {
+		return time.Since(job.StartTime).Seconds()
+	}
+	return job.EndTime.Sub(job.StartTime).Seconds()
+}
+
+func (job *Job) ExitStatus() cmdproto.ExitStatus {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	es := cmdproto.ExitStatus{State: job.State, ExitCode: job.ExitCode, Signal: job.Signal,
+		Limit: job.Limit, WallTime: job.wallTime()}
+	if job.Rusage != nil {
+		es.Rusage = *job.Rusage
+	}
+	return es
+}
+
+func (job *Job) Result() JobResult {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return JobResult{JobStatus: job.status(),
+		Stdout: string(job.out.bytes(streamStdout)),
+		Stderr: string(job.out.bytes(streamStderr))}
+}
+
+func (job *Job) Cancel() error {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.State != jobRunning {
+		return fmt.Errorf("job %s is %s", job.Id, job.State)
+	}
+	job.canceled = true
+	return job.killGroup()
+}
+
+// killGroup
+// kills the process group of the job, and its cgroup if it has one.
+// the caller holds job.mu.
+func (job *Job) killGroup() error {
+	if job.cgroup != "" {
+		ioutil.WriteFile(filepath.Join(job.cgroup, "cgroup.kill"), []byte("1"), 0644)
+	}
+	if err := syscall.Kill(-job.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// limitHit
+// kills the job for exceeding limit, only the first limit is reported.
+func (job *Job) limitHit(limit string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.State != jobRunning || job.Limit != "" || job.canceled {
+		return
+	}
+	job.Limit = limit
+	cmdlog.Printf("job %s exceeded its %s limit, killing process group %d\n", job.Id, limit, job.Pid)
+	job.killGroup()
+}
+
+func (job *Job) wait() {
+	err := job.cmd.Wait()
+	if job.timer != nil {
+		job.timer.Stop()
+	}
+	job.mu.Lock()
+	job.EndTime = time.Now()
+	switch {
+	case job.canceled:
+		job.State = jobCanceled
+	case job.Limit != "":
+		job.State = jobKilled
+	default:
+		job.State = jobExited
+	}
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			job.State = jobFailed
+			job.Error = err.Error()
+		}
+	}
+	if ps := job.cmd.ProcessState; ps != nil {
+		if ws, ok := ps.Sys().(syscall.WaitStatus); ok {
+			job.ExitCode = ws.ExitStatus()
+			if ws.Signaled() {
+				job.Signal = ws.Signal().String()
+			}
+		}
+		if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+			job.Rusage = &cmdproto.Rusage{
+				UserTime: time.Duration(syscall.TimevalToNsec(ru.Utime)).Seconds(),
+				SysTime:  time.Duration(syscall.TimevalToNsec(ru.Stime)).Seconds(),
+				MaxRSS:   int64(ru.Maxrss), MinFlt: int64(ru.Minflt), MajFlt: int64(ru.Majflt),
+				InBlock: int64(ru.Inblock), OuBlock: int64(ru.Oublock),
+				NvCsw: int64(ru.Nvcsw), NivCsw: int64(ru.Nivcsw)}
+		}
+	}
+	job.checkLimits()
+	close(job.done)
+	job.mu.Unlock()
+	job.cond.Broadcast()
+	if job.cgroup != "" {
+		removeCgroup(job.cgroup)
+	}
+	cmdlog.Printf("job %s %s, exit code %d %s %s\n", job.Id, job.State, job.ExitCode, job.Signal, job.Limit)
+}
+
+// checkLimits
+// finds the limits the kernel enforced: RLIMIT_CPU sends SIGXCPU, then
+// SIGKILL a second later, and the cgroup counts its oom kills. the caller
+// holds job.mu and removes the cgroup after releasing it.
+func (job *Job) checkLimits() {
+	if job.cgroup != "" && job.Limit == "" && cgroupOOM(job.cgroup) {
+		job.Limit = limitMemory
+	}
+	if job.Limit == "" && job.limits.cpuTime > 0 && job.Rusage != nil {
+		cpu := time.Duration((job.Rusage.UserTime + job.Rusage.SysTime) * float64(time.Second))
+		if job.Signal == syscall.SIGXCPU.String() ||
+			(job.Signal == syscall.SIGKILL.String() && cpu >= job.limits.cpuTime) {
+			job.Limit = limitCPUTime
+		}
+	}
+	if job.Limit != "" && job.State == jobExited {
+		job.State = jobKilled
+	}
+}
+
+// Follow
+// returns a reader of the job output selected by mask, starting from the
+// oldest output still kept. Reads block until more output arrives and
+// return io.EOF once the job has finished. footer asks the server to
+// append the exit status once the reader is drained.
+func (job *Job) Follow(mask int, footer bool) *jobReader {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return &jobReader{job: job, mask: mask, next: job.out.first, footer: footer, endsLine: true}
+}
+
+type jobReader struct {
+	job      *Job
+	mask     int
+	next     int
+	pending  []byte
+	closed   bool
+	footer   bool
+	endsLine bool
+}
+
+func (jr *jobReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	job := jr.job
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	for len(jr.pending) == 0 {
+		if jr.closed {
+			return 0, io.ErrClosedPipe
+		}
+		if jr.next < job.out.first {
+			jr.next = job.out.first
+		}
+		idx := jr.next - job.out.first
+		if idx < len(job.out.chunks) {
+			chunk := job.out.chunks[idx]
+			jr.next++
+			if chunk.stream&jr.mask != 0 {
+				jr.pending = chunk.data
+			}
+			continue
+		}
+		if job.finished() {
+			return 0, io.EOF
+		}
+		job.cond.Wait()
+	}
+	n := copy(p, jr.pending)
+	jr.pending = jr.pending[n:]
+	jr.endsLine = p[n-1] == '\n'
+	return n, nil
+}
+
+// endedLine
+// whether the output read so far ends with a newline.
+func (jr *jobReader) endedLine() bool {
+	jr.job.mu.Lock()
+	defer jr.job.mu.Unlock()
+	return jr.endsLine
+}
+
+// Close
+// detaches the reader, the job itself keeps running.
+func (jr *jobReader) Close() error {
+	jr.job.mu.Lock()
+	jr.closed = true
+	jr.job.mu.Unlock()
+	jr.job.cond.Broadcast()
+	return nil
+}
+
+type jobRegistry struct {
+	mu          sync.Mutex
+	jobs        map[string]*Job
+	maxJobs     int
+	outputLimit int
+	retain      time.Duration
+}
+
+func newJobRegistry(maxJobs, outputLimit int, retain time.Duration) *jobRegistry {
+	return &jobRegistry{jobs: make(map[string]*Job), maxJobs: maxJobs,
+		outputLimit: outputLimit, retain: retain}
+}
+
+func (jr *jobRegistry) setLimits(maxJobs, outputLimit int, retain time.Duration) {
+	jr.mu.Lock()
+	jr.maxJobs, jr.outputLimit, jr.retain = maxJobs, outputLimit, retain
+	jr.mu.Unlock()
+}
+
+func newJobId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// reap drops finished jobs older than the retain duration, and the oldest
+// finished jobs beyond maxJobs. caller must hold jr.mu.
+func (jr *jobRegistry) reap() {
+	var finished []*Job
+	for id, job := range jr.jobs {
+		if !job.finished() {
+			continue
+		}
+		if time.Since(job.Status().EndTime) > jr.retain {
+			delete(jr.jobs, id)
+			continue
+		}
+		finished = append(finished, job)
+	}
+	if len(jr.jobs) < jr.maxJobs {
+		return
+	}
+	sort.Sort(jobsByStart(finished))
+	for _, job := range finished {
+		if len(jr.jobs) < jr.maxJobs {
+			break
+		}
+		delete(jr.jobs, job.Id)
+	}
+}
+
+func (jr *jobRegistry) start(spec *execSpec, args []string, limits *jobLimits) (*Job, error) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	jr.reap()
+	if len(jr.jobs) >= jr.maxJobs {
+		return nil, fmt.Errorf("too many jobs running, limit %d", jr.maxJobs)
+	}
+
+	job := &Job{Id: newJobId(), Args: append([]string(nil), args...), State: jobRunning,
+		done: make(chan struct{}), limits: limits}
+	job.cond = sync.NewCond(&job.mu)
+	job.out.limit = jr.outputLimit
+	job.cmd = exec.Command(spec.Path, spec.Args...)
+	job.cmd.Args[0] = args[0]
+	job.cmd.Dir = spec.Dir
+	job.cmd.Env = spec.Env
+	// own process group, a limit or cancel kills the whole command.
+	job.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: spec.Cred}
+	cgroup, cgroupFd, err := limits.jobCgroup(job.Id)
+	if err != nil {
+		cmdlog.EPrintln(err.Error())
+		return nil, err
+	}
+	if cgroupFd != nil {
+		defer cgroupFd.Close()
+		job.cmd.SysProcAttr.UseCgroupFD = true
+		job.cmd.SysProcAttr.CgroupFD = int(cgroupFd.Fd())
+		job.cgroup = cgroup
+	}
+	job.cmd.Stdout = &jobWriter{job: job, stream: streamStdout}
+	job.cmd.Stderr = &jobWriter{job: job, stream: streamStderr}
+	job.StartTime = time.Now()
+	if err = job.cmd.Start(); err != nil {
+		cmdlog.EPrintln(err.Error())
+		if cgroup != "" {
+			removeCgroup(cgroup)
+		}
+		return nil, err
+	}
+	job.Pid = job.cmd.Process.Pid
+	if err = limits.apply(job.Pid, cgroup != ""); err != nil {
+		cmdlog.EPrintf("job %s limits: %s\n", job.Id, err.Error())
+		job.killGroup()
+		job.cmd.Wait()
+		if cgroup != "" {
+			removeCgroup(cgroup)
+		}
+		return nil, err
+	}
+	if limits.timeout > 0 {
+		job.timer = time.AfterFunc(limits.timeout, func() { job.limitHit(limitTimeout) })
+	}
+	jr.jobs[job.Id] = job
+	go job.wait()
+	cmdlog.Printf("job %s started, pid %d, args %v, rule %s, limits %+v\n", job.Id, job.Pid, job.Args,
+		spec.Rule, *limits)
+	return job, nil
+}
+
+func (jr *jobRegistry) get(id string) (*Job, error) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	if job, ok := jr.jobs[id]; ok {
+		return job, nil
+	}
+	return nil, fmt.Errorf("job %s not found", id)
+}
+
+func (jr *jobRegistry) list() []JobStatus {
+	jr.mu.Lock()
+	jr.reap()
+	jobs := make([]*Job, 0, len(jr.jobs))
+	for _, job := range jr.jobs {
+		jobs = append(jobs, job)
+	}
+	jr.mu.Unlock()
+	sort.Sort(jobsByStart(jobs))
+	res := make([]JobStatus, 0, len(jobs))
+	for _, job := range jobs {
+		res = append(res, job.Status())
+	}
+	return res
+}
+
+type jobsByStart []*Job
+
+func (js jobsByStart) Len() int           { return len(js) }
+func (js jobsByStart) Less(i, j int) bool { return js[i].StartTime.Before(js[j].StartTime) }
+func (js jobsByStart) Swap(i, j int)      { js[i], js[j] = js[j], js[i] }
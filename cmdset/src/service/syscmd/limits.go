@@ -0,0 +1,304 @@
+package syscmd
+
+import (
+	"cmdproto"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"service/cmds"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// limits a job can hit, reported in its status and the X-Cmd-Limit trailer.
+const (
+	limitTimeout   = "timeout"
+	limitCPUTime   = "cpu_time"
+	limitMemory    = "memory"
+	limitMaxOutput = "max_output"
+)
+
+// LimitsConfig
+// the [syscmd.limits] section, ceilings of what a request may ask for and
+// the limits of requests asking for none, zero means unlimited. Memory is
+// in bytes and becomes RLIMIT_AS, or memory.max when Cgroup is set. Cgroup
+// is a cgroup v2 directory the agent may create job groups in, it is
+// needed for CPUs (the cpu.max quota in cpus). Nice is the lowest nice
+// level and IONice ("best-effort:<0-7>" or "idle") the highest io priority
+// a job runs with.
+type LimitsConfig struct {
+	Timeout   cmds.Duration `toml:"timeout"`
+	CPUTime   cmds.Duration `toml:"cpu_time"`
+	Memory    int64         `toml:"memory"`
+	CPUs      float64       `toml:"cpus"`
+	MaxOutput int64         `toml:"max_output"`
+	Nice      int           `toml:"nice"`
+	IONice    string        `toml:"ionice"`
+	Cgroup    string        `toml:"cgroup"`
+}
+
+// jobLimits
+// what a job runs with once the request options met the ceilings.
+type jobLimits struct {
+	timeout   time.Duration
+	cpuTime   time.Duration
+	memory    int64
+	cpus      float64
+	maxOutput int64
+	nice      int
+	ioprio    int
+	cgroup    string
+}
+
+const (
+	ioprioClassBE   = 2
+	ioprioClassIdle = 3
+	ioprioClassBits = 13
+	ioprioWhoPgrp   = 2
+)
+
+// parseIONice
+// returns the ioprio value and a rank, higher ranks are lower priorities.
+func parseIONice(val string) (prio int, rank int, err error) {
+	if val == "" {
+		return 0, -1, nil
+	}
+	class, level := val, "4"
+	if i := strings.IndexByte(val, ':'); i >= 0 {
+		class, level = val[:i], val[i+1:]
+	}
+	switch class {
+	case "idle":
+		return ioprioClassIdle << ioprioClassBits, 8, nil
+	case "best-effort", "be":
+		n, err := strconv.Atoi(level)
+		if err != nil || n < 0 || n > 7 {
+			return 0, 0, fmt.Errorf("bad ionice level %s", level)
+		}
+		return ioprioClassBE<<ioprioClassBits | n, n, nil
+	}
+	return 0, 0, fmt.Errorf("bad ionice class %s, best-effort or idle", class)
+}
+
+func (lc *LimitsConfig) validate() error {
+	if lc.Timeout.Duration < 0 || lc.CPUTime.Duration < 0 || lc.Memory < 0 || lc.CPUs < 0 || lc.MaxOutput < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if lc.Nice < 0 || lc.Nice > 19 {
+		return fmt.Errorf("limits nice %d out of range 0-19", lc.Nice)
+	}
+	if _, _, err := parseIONice(lc.IONice); err != nil {
+		return err
+	}
+	if lc.CPUs > 0 && lc.Cgroup == "" {
+		return fmt.Errorf("limits cpus needs a cgroup")
+	}
+	return nil
+}
+
+// setupCgroup
+// creates the cgroup and enables the memory and cpu controllers for the
+// job groups, requests may ask for either even when the config sets no
+// ceiling. runs on Init and when a reload changes the cgroup.
+func (lc *LimitsConfig) setupCgroup() error {
+	if lc.Cgroup == "" {
+		return nil
+	}
+	if err := os.MkdirAll(lc.Cgroup, 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(lc.Cgroup, "cgroup.procs")); err != nil {
+		return fmt.Errorf("limits cgroup %s is not a cgroup v2 directory", lc.Cgroup)
+	}
+	// job groups need the controllers, the agent must not run in this group.
+	err := ioutil.WriteFile(filepath.Join(lc.Cgroup, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644)
+	if err != nil {
+		return fmt.Errorf("limits cgroup %s: enable memory and cpu: %s", lc.Cgroup, err.Error())
+	}
+	return nil
+}
+
+// ceiling
+// the requested value, or the ceiling when none was asked for.
+func ceiling(name string, req, max int64) (int64, error) {
+	if req < 0 {
+		return 0, fmt.Errorf("%s must not be negative", name)
+	}
+	if req == 0 {
+		return max, nil
+	}
+	if max > 0 && req > max {
+		return 0, &PolicyError{"limits", fmt.Sprintf("%s %d exceeds the ceiling %d", name, req, max)}
+	}
+	return req, nil
+}
+
+// resolveLimits
+// checks opts against the configured ceilings, exceeding one is a policy
+// denial.
+func resolveLimits(lc *LimitsConfig, opts *cmdproto.SysOptions) (*jobLimits, error) {
+	jl := &jobLimits{cgroup: lc.Cgroup, timeout: lc.Timeout.Duration}
+	if opts.Timeout != "" {
+		timeout, err := time.ParseDuration(opts.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("bad timeout %s", opts.Timeout)
+		}
+		if lc.Timeout.Duration > 0 && timeout > lc.Timeout.Duration {
+			return nil, &PolicyError{"limits", fmt.Sprintf("timeout %s exceeds the ceiling %s",
+				timeout, lc.Timeout.Duration)}
+		}
+		jl.timeout = timeout
+	}
+	// rounded up, a sub second ceiling must not become unlimited.
+	val, err := ceiling("cpu_time", opts.CPUTime, int64(math.Ceil(lc.CPUTime.Seconds())))
+	if err != nil {
+		return nil, err
+	}
+	jl.cpuTime = time.Duration(val) * time.Second
+	if jl.memory, err = ceiling("memory", opts.Memory, lc.Memory); err != nil {
+		return nil, err
+	}
+	if jl.maxOutput, err = ceiling("max_output", opts.MaxOutput, lc.MaxOutput); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case opts.CPUs < 0:
+		return nil, fmt.Errorf("cpus must not be negative")
+	case opts.CPUs == 0:
+		jl.cpus = lc.CPUs
+	case lc.Cgroup == "":
+		return nil, &PolicyError{"limits", "cpus needs a configured cgroup"}
+	case lc.CPUs > 0 && opts.CPUs > lc.CPUs:
+		return nil, &PolicyError{"limits", fmt.Sprintf("cpus %g exceeds the ceiling %g", opts.CPUs, lc.CPUs)}
+	default:
+		jl.cpus = opts.CPUs
+	}
+
+	jl.nice = lc.Nice
+	if opts.Nice != 0 {
+		if opts.Nice < lc.Nice || opts.Nice > 19 {
+			return nil, &PolicyError{"limits", fmt.Sprintf("nice %d out of range %d-19", opts.Nice, lc.Nice)}
+		}
+		jl.nice = opts.Nice
+	}
+	prio, minRank, _ := parseIONice(lc.IONice)
+	jl.ioprio = prio
+	if opts.IONice != "" {
+		reqPrio, rank, err := parseIONice(opts.IONice)
+		if err != nil {
+			return nil, err
+		}
+		if rank < minRank {
+			return nil, &PolicyError{"limits", fmt.Sprintf("ionice %s above %s", opts.IONice, lc.IONice)}
+		}
+		jl.ioprio = reqPrio
+	}
+	return jl, nil
+}
+
+// jobCgroup
+// creates the cgroup of a job, the job is cloned straight into it.
+func (jl *jobLimits) jobCgroup(id string) (string, *os.File, error) {
+	if jl.cgroup == "" || (jl.memory == 0 && jl.cpus == 0) {
+		return "", nil, nil
+	}
+	dir := filepath.Join(jl.cgroup, "job-"+id)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", nil, err
+	}
+	var err error
+	if jl.memory > 0 {
+		err = ioutil.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatInt(jl.memory, 10)), 0644)
+		if err == nil {
+			ioutil.WriteFile(filepath.Join(dir, "memory.swap.max"), []byte("0"), 0644)
+		}
+	}
+	if err == nil && jl.cpus > 0 {
+		quota := fmt.Sprintf("%d 100000", int64(jl.cpus*100000))
+		err = ioutil.WriteFile(filepath.Join(dir, "cpu.max"), []byte(quota), 0644)
+	}
+	var fd *os.File
+	if err == nil {
+		fd, err = os.Open(dir)
+	}
+	if err != nil {
+		os.Remove(dir)
+		return "", nil, fmt.Errorf("job cgroup: %s", err.Error())
+	}
+	return dir, fd, nil
+}
+
+func prlimit(pid, resource int, limit *syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource),
+		uintptr(unsafe.Pointer(limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// apply
+// sets the rlimits and priorities of a started job. it runs right after
+// the fork, so a command could do some work before they apply, the group
+// wide priorities also cover children it already forked.
+func (jl *jobLimits) apply(pid int, cgroup bool) error {
+	if jl.cpuTime > 0 {
+		secs := uint64(jl.cpuTime.Seconds())
+		// SIGXCPU at the soft limit, SIGKILL a second later.
+		if err := prlimit(pid, syscall.RLIMIT_CPU, &syscall.Rlimit{Cur: secs, Max: secs + 1}); err != nil {
+			return fmt.Errorf("cpu_time: %s", err.Error())
+		}
+	}
+	if jl.memory > 0 && !cgroup {
+		limit := uint64(jl.memory)
+		if err := prlimit(pid, syscall.RLIMIT_AS, &syscall.Rlimit{Cur: limit, Max: limit}); err != nil {
+			return fmt.Errorf("memory: %s", err.Error())
+		}
+	}
+	if jl.nice > 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PGRP, pid, jl.nice); err != nil {
+			return fmt.Errorf("nice: %s", err.Error())
+		}
+	}
+	if jl.ioprio != 0 {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, ioprioWhoPgrp, uintptr(pid), uintptr(jl.ioprio))
+		if errno != 0 {
+			return fmt.Errorf("ionice: %s", errno.Error())
+		}
+	}
+	return nil
+}
+
+// cgroupOOM
+// whether the kernel killed something in the job cgroup for memory.
+func cgroupOOM(dir string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" && fields[1] != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+// removeCgroup
+// kills what is left in the job cgroup and removes it.
+func removeCgroup(dir string) {
+	ioutil.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0644)
+	for i := 0; i < 10; i++ {
+		if err := os.Remove(dir); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,393 @@
+package syscmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"service/cmdlog"
+	"service/notify"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	monitorOk      = "ok"
+	monitorFiring  = "firing"
+	monitorUnknown = "unknown"
+)
+
+// sampleFunc
+// returns the current value of what a monitor watches.
+type sampleFunc func() (float64, error)
+
+// monitorType
+// Target is what the monitor watches when none is given, an empty Target
+// means the type takes none. newSampler validates the target and returns
+// its sampler, defaultThreshold may follow the handler config.
+type monitorType struct {
+	Name             string
+	Unit             string
+	Target           string
+	newSampler       func(target string) (sampleFunc, error)
+	defaultThreshold func(sc *SystemCmd) float64
+}
+
+var monitorTypes = make(map[string]*monitorType)
+
+func registerMonitorType(mt *monitorType) {
+	if _, ok := monitorTypes[mt.Name]; ok {
+		cmdlog.EPrintf("duplicate monitor type %s registered!\n", mt.Name)
+		return
+	}
+	monitorTypes[mt.Name] = mt
+}
+
+// MonitorStatus
+// a monitor as listed by the monitors op.
+type MonitorStatus struct {
+	Id        string    `json:"id"`
+	Type      string    `json:"type"`
+	Target    string    `json:"target,omitempty"`
+	Threshold float64   `json:"threshold"`
+	Unit      string    `json:"unit"`
+	Interval  string    `json:"interval"`
+	State     string    `json:"state"`
+	Value     float64   `json:"value"`
+	Since     time.Time `json:"since"`
+	LastCheck time.Time `json:"last_check,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type monitor struct {
+	sc         *SystemCmd
+	mtype      *monitorType
+	sample     sampleFunc
+	interval   time.Duration
+	useDefault bool
+	stop       chan bool
+	mu         sync.Mutex
+	status     MonitorStatus
+}
+
+type monitorRegistry struct {
+	mu       sync.Mutex
+	monitors map[string]*monitor
+}
+
+func newMonitorRegistry() *monitorRegistry {
+	return &monitorRegistry{monitors: make(map[string]*monitor)}
+}
+
+func monitorId(mtype, target string) string {
+	if target == "" {
+		return mtype
+	}
+	return mtype + ":" + target
+}
+
+// start
+// starts a monitor of mtype on target, started is false when the same
+// monitor is already running and m is that monitor.
+func (mr *monitorRegistry) start(sc *SystemCmd, mtype, target string, threshold float64,
+	interval time.Duration) (m *monitor, started bool, err error) {
+	mt, ok := monitorTypes[mtype]
+	if !ok {
+		return nil, false, fmt.Errorf("unknown monitor type %s", mtype)
+	}
+	if target == "" {
+		target = mt.Target
+	} else if mt.Target == "" {
+		return nil, false, fmt.Errorf("monitor %s takes no target", mtype)
+	}
+	if interval <= 0 {
+		return nil, false, errors.New("monitor interval must be positive")
+	}
+	sample, err := mt.newSampler(target)
+	if err != nil {
+		return nil, false, err
+	}
+	m = &monitor{sc: sc, mtype: mt, sample: sample, interval: interval,
+		useDefault: threshold == 0, stop: make(chan bool)}
+	if m.useDefault {
+		threshold = mt.defaultThreshold(sc)
+	}
+	m.status = MonitorStatus{Id: monitorId(mtype, target), Type: mtype, Target: target,
+		Threshold: threshold, Unit: mt.Unit, Interval: interval.String(),
+		State: monitorUnknown, Since: time.Now().UTC()}
+
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if running, ok := mr.monitors[m.status.Id]; ok {
+		return running, false, nil
+	}
+	mr.monitors[m.status.Id] = m
+	go m.run()
+	cmdlog.Printf("monitor %s started, threshold %g%s every %s\n", m.status.Id, threshold, mt.Unit, interval)
+	return m, true, nil
+}
+
+func (mr *monitorRegistry) stop(id string) error {
+	mr.mu.Lock()
+	m, ok := mr.monitors[id]
+	delete(mr.monitors, id)
+	mr.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("monitor %s not found", id)
+	}
+	close(m.stop)
+	cmdlog.Printf("monitor %s stopped\n", id)
+	return nil
+}
+
+func (mr *monitorRegistry) list() []MonitorStatus {
+	mr.mu.Lock()
+	res := make([]MonitorStatus, 0, len(mr.monitors))
+	for _, m := range mr.monitors {
+		res = append(res, m.Status())
+	}
+	mr.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Id < res[j].Id })
+	return res
+}
+
+func (m *monitor) Status() MonitorStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// run
+// samples every interval and alerts when the value crosses the threshold,
+// and again once it drops back below.
+func (m *monitor) run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.check()
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *monitor) check() {
+	value, err := m.sample()
+	now := time.Now().UTC()
+
+	m.mu.Lock()
+	st := &m.status
+	st.LastCheck = now
+	if err != nil {
+		st.Error = err.Error()
+		m.mu.Unlock()
+		cmdlog.EPrintf("monitor %s: %s\n", st.Id, err.Error())
+		return
+	}
+	if m.useDefault {
+		st.Threshold = m.mtype.defaultThreshold(m.sc)
+	}
+	st.Error, st.Value = "", value
+	state := monitorOk
+	if value >= st.Threshold {
+		state = monitorFiring
+	}
+	changed := state != st.State
+	prev := st.State
+	if changed {
+		st.State, st.Since = state, now
+	}
+	alert := &notify.Alert{Key: "syscmd." + st.Type, Source: "syscmd", Severity: "critical",
+		Subject: fmt.Sprintf("%s usage", st.Type), Time: now}
+	if st.Target != "" {
+		alert.Key += "." + st.Target
+		alert.Subject = fmt.Sprintf("%s usage of %s", st.Type, st.Target)
+	}
+	alert.Body = fmt.Sprintf("%s is %.1f%s, threshold %g%s", st.Id, value, st.Unit, st.Threshold, st.Unit)
+	m.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	switch {
+	case state == monitorFiring:
+		alert.State = notify.StateFiring
+		notify.Send(alert)
+	case prev == monitorFiring:
+		alert.State = notify.StateResolved
+		notify.Send(alert)
+	}
+}
+
+func readProcFields(path string) (map[string]uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	res := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if val, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			res[strings.TrimSuffix(fields[0], ":")] = val
+		}
+	}
+	return res, scanner.Err()
+}
+
+func usedPercent(total, free uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(total-free) / float64(total) * 100
+}
+
+func memSampler(string) (sampleFunc, error) {
+	return func() (float64, error) {
+		info, err := readProcFields("/proc/meminfo")
+		if err != nil {
+			return 0, err
+		}
+		return usedPercent(info["MemTotal"], info["MemAvailable"]), nil
+	}, nil
+}
+
+func swapSampler(string) (sampleFunc, error) {
+	return func() (float64, error) {
+		info, err := readProcFields("/proc/meminfo")
+		if err != nil {
+			return 0, err
+		}
+		return usedPercent(info["SwapTotal"], info["SwapFree"]), nil
+	}, nil
+}
+
+// readCPUTimes
+// the busy and total jiffies of the cpu line in /proc/stat.
+func readCPUTimes() (busy, total uint64, err error) {
+	data, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, errors.New("unexpected /proc/stat format")
+	}
+	for i, field := range fields[1:] {
+		val, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		total += val
+		// idle and iowait
+		if i != 3 && i != 4 {
+			busy += val
+		}
+	}
+	return busy, total, nil
+}
+
+// cpuSampler
+// reports the busy percentage since the previous sample.
+func cpuSampler(string) (sampleFunc, error) {
+	prevBusy, prevTotal, err := readCPUTimes()
+	if err != nil {
+		return nil, err
+	}
+	return func() (float64, error) {
+		busy, total, err := readCPUTimes()
+		if err != nil {
+			return 0, err
+		}
+		if total == prevTotal {
+			return 0, nil
+		}
+		res := float64(busy-prevBusy) / float64(total-prevTotal) * 100
+		prevBusy, prevTotal = busy, total
+		return res, nil
+	}, nil
+}
+
+func loadSampler(target string) (sampleFunc, error) {
+	var idx int
+	switch target {
+	case "1":
+		idx = 0
+	case "5":
+		idx = 1
+	case "15":
+		idx = 2
+	default:
+		return nil, fmt.Errorf("load target must be 1, 5 or 15, not %s", target)
+	}
+	return func() (float64, error) {
+		data, err := ioutil.ReadFile("/proc/loadavg")
+		if err != nil {
+			return 0, err
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) < 3 {
+			return 0, errors.New("unexpected /proc/loadavg format")
+		}
+		return strconv.ParseFloat(fields[idx], 64)
+	}, nil
+}
+
+func statfsSampler(target string, used func(fs *syscall.Statfs_t) float64) (sampleFunc, error) {
+	fs := syscall.Statfs_t{}
+	if err := syscall.Statfs(target, &fs); err != nil {
+		return nil, err
+	}
+	return func() (float64, error) {
+		fs := syscall.Statfs_t{}
+		if err := syscall.Statfs(target, &fs); err != nil {
+			return 0, err
+		}
+		return used(&fs), nil
+	}, nil
+}
+
+func diskSampler(target string) (sampleFunc, error) {
+	return statfsSampler(target, func(fs *syscall.Statfs_t) float64 {
+		return usedPercent(fs.Blocks, fs.Bfree)
+	})
+}
+
+func inodeSampler(target string) (sampleFunc, error) {
+	return statfsSampler(target, func(fs *syscall.Statfs_t) float64 {
+		return usedPercent(fs.Files, fs.Ffree)
+	})
+}
+
+func fixedThreshold(val float64) func(*SystemCmd) float64 {
+	return func(*SystemCmd) float64 { return val }
+}
+
+func init() {
+	registerMonitorType(&monitorType{Name: "mem", Unit: "%", newSampler: memSampler,
+		defaultThreshold: fixedThreshold(90)})
+	registerMonitorType(&monitorType{Name: "swap", Unit: "%", newSampler: swapSampler,
+		defaultThreshold: fixedThreshold(50)})
+	registerMonitorType(&monitorType{Name: "cpu", Unit: "%", newSampler: cpuSampler,
+		defaultThreshold: fixedThreshold(90)})
+	registerMonitorType(&monitorType{Name: "load", Target: "5", newSampler: loadSampler,
+		defaultThreshold: fixedThreshold(float64(runtime.NumCPU()) * 2)})
+	registerMonitorType(&monitorType{Name: "inode", Unit: "%", Target: "/", newSampler: inodeSampler,
+		defaultThreshold: fixedThreshold(90)})
+	// disk_left_notify is the free space left, the monitor alerts on used space.
+	registerMonitorType(&monitorType{Name: "disk", Unit: "%", Target: "/", newSampler: diskSampler,
+		defaultThreshold: func(sc *SystemCmd) float64 { return float64(100 - sc.config().DiskLeftNotify) }})
+}
@@ -0,0 +1,272 @@
+package syscmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// PolicyConfig
+// the [syscmd.policy] section. once any rule is configured only the listed
+// executables may run. Env lists the variables passed through from the agent
+// environment and SetEnv adds fixed NAME=value pairs, with neither set the
+// agent environment is inherited.
+type PolicyConfig struct {
+	WorkDir string       `toml:"workdir"`
+	Env     []string     `toml:"env"`
+	SetEnv  []string     `toml:"set_env"`
+	RunAs   string       `toml:"run_as"`
+	Rules   []PolicyRule `toml:"rules"`
+}
+
+// PolicyRule
+// Exe is a path or glob matched against the resolved executable. every
+// argument must match one of Args or ArgGlobs when any is given, and none
+// of DenyArgs. Args are regexps of the whole argument, as if wrapped in
+// ^(?:..)$, DenyArgs match anywhere in it.
+type PolicyRule struct {
+	Name     string   `toml:"name"`
+	Exe      string   `toml:"exe"`
+	Args     []string `toml:"args"`
+	ArgGlobs []string `toml:"arg_globs"`
+	DenyArgs []string `toml:"deny_args"`
+	MaxArgs  int      `toml:"max_args"`
+	WorkDir  string   `toml:"workdir"`
+	RunAs    string   `toml:"run_as"`
+}
+
+type PolicyError struct {
+	Rule   string
+	Reason string
+}
+
+func (pe *PolicyError) Error() string {
+	return fmt.Sprintf("denied by rule %s: %s", pe.Rule, pe.Reason)
+}
+
+type policyRule struct {
+	*PolicyRule
+	args     []*regexp.Regexp
+	denyArgs []*regexp.Regexp
+	cred     *syscall.Credential
+}
+
+type policy struct {
+	*PolicyConfig
+	rules []*policyRule
+	env   []string
+	cred  *syscall.Credential
+}
+
+// execSpec
+// what the policy allows to run for a request.
+type execSpec struct {
+	Path string
+	Args []string
+	Dir  string
+	Env  []string
+	Cred *syscall.Credential
+	Rule string
+}
+
+// compileRegexps
+// compiles exprs, anchored to the whole string when whole is set.
+func compileRegexps(exprs []string, whole bool) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		if whole {
+			expr = "^(?:" + expr + ")$"
+		}
+		reg, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, reg)
+	}
+	return res, nil
+}
+
+func lookupCredential(name string) (*syscall.Credential, error) {
+	if name == "" {
+		return nil, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+func newPolicy(config *PolicyConfig) (*policy, error) {
+	p := &policy{PolicyConfig: config}
+	var err error
+	for i := range config.Rules {
+		rule := &policyRule{PolicyRule: &config.Rules[i]}
+		if rule.Name == "" {
+			rule.Name = rule.Exe
+		}
+		if rule.Exe == "" {
+			return nil, fmt.Errorf("policy rule %d without exe", i)
+		}
+		if _, err = filepath.Match(rule.Exe, ""); err != nil {
+			return nil, fmt.Errorf("policy rule %s: %s", rule.Name, err.Error())
+		}
+		for _, glob := range rule.ArgGlobs {
+			if _, err = filepath.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("policy rule %s: %s", rule.Name, err.Error())
+			}
+		}
+		if rule.args, err = compileRegexps(rule.Args, true); err != nil {
+			return nil, fmt.Errorf("policy rule %s: %s", rule.Name, err.Error())
+		}
+		if rule.denyArgs, err = compileRegexps(rule.DenyArgs, false); err != nil {
+			return nil, fmt.Errorf("policy rule %s: %s", rule.Name, err.Error())
+		}
+		if rule.cred, err = lookupCredential(rule.RunAs); err != nil {
+			return nil, fmt.Errorf("policy rule %s: %s", rule.Name, err.Error())
+		}
+		p.rules = append(p.rules, rule)
+	}
+	if p.cred, err = lookupCredential(config.RunAs); err != nil {
+		return nil, err
+	}
+	if config.WorkDir != "" {
+		if fi, err := os.Stat(config.WorkDir); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("policy workdir %s is not a directory", config.WorkDir)
+		}
+	}
+
+	if len(config.Env) == 0 && len(config.SetEnv) == 0 {
+		p.env = nil
+	} else {
+		p.env = make([]string, 0)
+		for _, name := range config.Env {
+			if val, ok := os.LookupEnv(name); ok {
+				p.env = append(p.env, name+"="+val)
+			}
+		}
+		for _, kv := range config.SetEnv {
+			if !strings.Contains(kv, "=") {
+				return nil, fmt.Errorf("policy set_env %s is not NAME=value", kv)
+			}
+			p.env = append(p.env, kv)
+		}
+	}
+	return p, nil
+}
+
+func (p *policy) lookPath(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return filepath.Abs(name)
+	}
+	for _, kv := range p.env {
+		if strings.HasPrefix(kv, "PATH=") {
+			for _, dir := range filepath.SplitList(kv[len("PATH="):]) {
+				path := filepath.Join(dir, name)
+				if fi, err := os.Stat(path); err == nil && !fi.IsDir() && fi.Mode()&0111 != 0 {
+					return path, nil
+				}
+			}
+			return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+		}
+	}
+	return exec.LookPath(name)
+}
+
+func (rule *policyRule) matchExe(name, path string) bool {
+	if ok, _ := filepath.Match(rule.Exe, path); ok {
+		return true
+	}
+	if strings.Contains(rule.Exe, "/") {
+		return false
+	}
+	ok, _ := filepath.Match(rule.Exe, name)
+	return ok
+}
+
+func (rule *policyRule) checkArgs(args []string) *PolicyError {
+	if rule.MaxArgs > 0 && len(args) > rule.MaxArgs {
+		return &PolicyError{rule.Name, fmt.Sprintf("more than %d arguments", rule.MaxArgs)}
+	}
+	for _, arg := range args {
+		for _, reg := range rule.denyArgs {
+			if reg.MatchString(arg) {
+				return &PolicyError{rule.Name, fmt.Sprintf("argument %q matches denied pattern %s", arg, reg.String())}
+			}
+		}
+		if len(rule.args) == 0 && len(rule.ArgGlobs) == 0 {
+			continue
+		}
+		allowed := false
+		for _, reg := range rule.args {
+			if reg.MatchString(arg) {
+				allowed = true
+				break
+			}
+		}
+		for _, glob := range rule.ArgGlobs {
+			if ok, _ := filepath.Match(glob, arg); ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &PolicyError{rule.Name, fmt.Sprintf("argument %q is not allowed", arg)}
+		}
+	}
+	return nil
+}
+
+// check
+// resolves args into what may run, or returns a *PolicyError.
+func (p *policy) check(args []string) (*execSpec, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("without specify command")
+	}
+	path, err := p.lookPath(args[0])
+	if err != nil {
+		if len(p.rules) > 0 {
+			return nil, &PolicyError{"allowlist", fmt.Sprintf("executable %s not found", args[0])}
+		}
+		return nil, err
+	}
+	spec := &execSpec{Path: path, Args: args[1:], Dir: p.WorkDir, Env: p.env, Cred: p.cred}
+	if len(p.rules) == 0 {
+		return spec, nil
+	}
+	var denied *PolicyError
+	for _, rule := range p.rules {
+		if !rule.matchExe(args[0], path) {
+			continue
+		}
+		if denied = rule.checkArgs(args[1:]); denied != nil {
+			continue
+		}
+		spec.Rule = rule.Name
+		if rule.WorkDir != "" {
+			spec.Dir = rule.WorkDir
+		}
+		if rule.cred != nil {
+			spec.Cred = rule.cred
+		}
+		return spec, nil
+	}
+	if denied != nil {
+		return nil, denied
+	}
+	return nil, &PolicyError{"allowlist", fmt.Sprintf("executable %s is not allowed", path)}
+}
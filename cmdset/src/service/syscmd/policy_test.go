@@ -0,0 +1,132 @@
+package syscmd
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lookPaths
+// resolves the executables a test runs, skipping it when one is missing.
+func lookPaths(t *testing.T, names ...string) []string {
+	paths := make([]string, len(names))
+	for i, name := range names {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			t.Skipf("%s not found: %v", name, err)
+		}
+		paths[i] = path
+	}
+	return paths
+}
+
+func TestPolicyCheck(t *testing.T) {
+	paths := lookPaths(t, "ls", "sh", "cat", "echo")
+	ls, sh, cat := paths[0], paths[1], paths[2]
+	dirs := make([]string, len(paths))
+	for i, path := range paths {
+		dirs[i] = filepath.Dir(path)
+	}
+	pathEnv := "PATH=" + strings.Join(dirs, string(filepath.ListSeparator))
+	p, err := newPolicy(&PolicyConfig{WorkDir: "/", SetEnv: []string{pathEnv}, Rules: []PolicyRule{
+		{Name: "ls", Exe: ls, ArgGlobs: []string{"-l", "/tmp/*"}, MaxArgs: 2, WorkDir: "/tmp"},
+		{Name: "echo", Exe: "echo", Args: []string{`[a-z]+`}, DenyArgs: []string{`^rm$`}},
+		{Name: "cat", Exe: filepath.Join(filepath.Dir(cat), "c?t"), DenyArgs: []string{`^/etc/shadow$`}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args   []string
+		rule   string
+		dir    string
+		denied string
+		err    string
+	}{
+		{args: []string{"ls"}, rule: "ls", dir: "/tmp"},
+		{args: []string{"ls", "-l", "/tmp/x"}, rule: "ls", dir: "/tmp"},
+		{args: []string{ls, "/tmp/y"}, rule: "ls", dir: "/tmp"},
+		{args: []string{"ls", "-l", "/etc"}, denied: `denied by rule ls: argument "/etc" is not allowed`},
+		{args: []string{"ls", "-l", "-l", "/tmp/x"}, denied: "denied by rule ls: more than 2 arguments"},
+		{args: []string{"echo", "hello", "world"}, rule: "echo", dir: "/"},
+		{args: []string{"echo", "hello-world"}, denied: `denied by rule echo: argument "hello-world" is not allowed`},
+		{args: []string{"echo", "Hello"}, denied: `denied by rule echo: argument "Hello" is not allowed`},
+		{args: []string{"echo", "rm"}, denied: "denied by rule echo: argument \"rm\" matches denied pattern ^rm$"},
+		{args: []string{"cat", "/etc/hosts"}, rule: "cat", dir: "/"},
+		{args: []string{"cat", "/etc/shadow"}, denied: "denied by rule cat"},
+		{args: []string{"sh", "-c", "id"}, denied: "denied by rule allowlist: executable " + sh + " is not allowed"},
+		{args: []string{"no-such-command"}, denied: "denied by rule allowlist: executable no-such-command not found"},
+		{args: nil, err: "without specify command"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			spec, err := p.check(tt.args)
+			switch {
+			case tt.denied != "":
+				pe, ok := err.(*PolicyError)
+				if !ok || !strings.HasPrefix(pe.Error(), tt.denied) {
+					t.Fatalf("error %v, want a denial %q", err, tt.denied)
+				}
+			case tt.err != "":
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case spec.Rule != tt.rule || spec.Dir != tt.dir:
+				t.Fatalf("rule %s dir %s, want rule %s dir %s", spec.Rule, spec.Dir, tt.rule, tt.dir)
+			case spec.Env[0] != pathEnv || len(spec.Args) != len(tt.args)-1:
+				t.Fatalf("env %v args %v", spec.Env, spec.Args)
+			}
+		})
+	}
+}
+
+func TestPolicyArgsWhole(t *testing.T) {
+	ls := lookPaths(t, "ls")[0]
+	p, err := newPolicy(&PolicyConfig{Rules: []PolicyRule{
+		{Name: "log", Exe: ls, Args: []string{"-l", "/var/log", "-a|-t"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		arg string
+		ok  bool
+	}{
+		{"-l", true},
+		{"/var/log", true},
+		{"-t", true},
+		{"--exec=/bin/sh-l", false},
+		{"/etc/shadow#/var/log", false},
+		{"/var/log/../../etc/shadow", false},
+		{"-at", false},
+		{"-a-t", false},
+	}
+	for _, tt := range tests {
+		_, err := p.check([]string{ls, tt.arg})
+		if (err == nil) != tt.ok {
+			t.Errorf("argument %q: %v, want allowed %v", tt.arg, err, tt.ok)
+		}
+	}
+}
+
+func TestPolicyWithoutRules(t *testing.T) {
+	p, err := newPolicy(&PolicyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := p.check([]string{"sh", "-c", "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Rule != "" || spec.Env != nil {
+		t.Fatalf("rule %q env %v, want no rule and the agent environment", spec.Rule, spec.Env)
+	}
+	if _, err = p.check([]string{"no-such-command"}); err == nil {
+		t.Fatal("missing executable not reported")
+	} else if _, ok := err.(*PolicyError); ok {
+		t.Fatalf("missing executable reported as a denial: %v", err)
+	}
+}
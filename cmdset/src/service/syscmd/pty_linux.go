@@ -0,0 +1,67 @@
+package syscmd
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+type winsize struct {
+	Rows   uint16
+	Cols   uint16
+	Xpixel uint16
+	Ypixel uint16
+}
+
+// ioctl
+// goes through SyscallConn, Fd would switch the file to blocking mode and
+// a pending Read could then not be interrupted by Close.
+func ioctl(file *os.File, req, arg uintptr) error {
+	rc, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err = rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openPty
+// allocates a pseudo terminal through /dev/ptmx, the caller owns both ends.
+func openPty() (ptmx *os.File, tty *os.File, err error) {
+	ptmx, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unlock int32
+	if err = ioctl(ptmx, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+	var n uint32
+	if err = ioctl(ptmx, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+	tty, err = os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+	return ptmx, tty, nil
+}
+
+// setWinsize
+// resizes the terminal, the foreground process gets SIGWINCH.
+func setWinsize(ptmx *os.File, cols, rows int) error {
+	ws := &winsize{Rows: uint16(rows), Cols: uint16(cols)}
+	return ioctl(ptmx, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(ws)))
+}
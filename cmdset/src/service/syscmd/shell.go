@@ -0,0 +1,582 @@
+package syscmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"service/cmdlog"
+	"service/cmds"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// ShellConfig
+// the [shell] section. Shell is run when a session names no command, the
+// command must pass the syscmd policy either way. a session without input
+// for IdleTimeout is closed. sessions are recorded to RecordDir in the
+// asciicast v2 format when RecordAll is set or the client asks for it.
+// Origins lists the browser origins allowed to open sessions, like
+// https://console.example.com, requests with any other Origin header are
+// refused.
+type ShellConfig struct {
+	Shell       []string      `toml:"shell"`
+	Term        string        `toml:"term"`
+	IdleTimeout cmds.Duration `toml:"idle_timeout"`
+	MaxSessions int           `toml:"max_sessions"`
+	MaxMessage  int           `toml:"max_message"`
+	RecordDir   string        `toml:"record_dir"`
+	RecordAll   bool          `toml:"record_all"`
+	Origins     []string      `toml:"origins"`
+}
+
+// ShellCmd
+// interactive sessions on a pseudo terminal over a websocket,
+// GET /shell?args=bash&args=-l&cols=120&rows=40[&record=1]. binary messages
+// are terminal input, text messages are {"op":"resize","cols":..,"rows":..}
+// or {"op":"input","data":".."}. the output comes back as binary messages
+// and the session ends with {"op":"exit",..} and a close frame.
+// ?op=sessions lists the open sessions and ?op=kill&id= ends one, callers
+// only see and end their own sessions unless granted shell:admin.
+type ShellCmd struct {
+	*ShellConfig
+	sc       *SystemCmd
+	confLock sync.RWMutex
+	lock     sync.Mutex
+	sessions map[string]*shellSession
+}
+
+// SessionStatus
+// a session as listed by the sessions op, Idle is in seconds.
+type SessionStatus struct {
+	Id        string    `json:"id"`
+	Args      []string  `json:"args"`
+	Caller    string    `json:"caller,omitempty"`
+	Remote    string    `json:"remote"`
+	Pid       int       `json:"pid"`
+	StartTime time.Time `json:"start_time"`
+	Idle      float64   `json:"idle"`
+	Record    string    `json:"record,omitempty"`
+}
+
+// shellMessage
+// a control message, in either direction.
+type shellMessage struct {
+	Op       string `json:"op"`
+	Cols     int    `json:"cols,omitempty"`
+	Rows     int    `json:"rows,omitempty"`
+	Data     string `json:"data,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Signal   string `json:"signal,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type shellSession struct {
+	SessionStatus
+	cmd        *exec.Cmd
+	ptmx       *os.File
+	ws         *wsConn
+	rec        *recorder
+	idle       time.Duration
+	lastInput  int64
+	done       chan struct{}
+	outputDone chan struct{}
+	killOnce   sync.Once
+}
+
+func (sh *ShellCmd) ConfigStruct() interface{} {
+	return &ShellConfig{Term: "xterm",
+		IdleTimeout: cmds.Duration{Duration: 15 * time.Minute},
+		MaxSessions: 16,
+		MaxMessage:  1 << 20}
+}
+
+// validate
+// fills in Shell, left nil by ConfigStruct as the toml decoder fails on
+// preallocated slices shorter than the configured array.
+func (conf *ShellConfig) validate() error {
+	if len(conf.Shell) == 0 {
+		conf.Shell = []string{"/bin/sh"}
+	}
+	if conf.IdleTimeout.Duration <= 0 || conf.MaxSessions <= 0 || conf.MaxMessage <= 0 {
+		return errors.New("idle_timeout, max_sessions and max_message must be positive")
+	}
+	if conf.RecordAll && conf.RecordDir == "" {
+		return errors.New("record_all without record_dir")
+	}
+	if conf.RecordDir != "" {
+		if err := os.MkdirAll(conf.RecordDir, 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh *ShellCmd) Init(config interface{}) error {
+	sh.ShellConfig = config.(*ShellConfig)
+	if err := sh.validate(); err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+	cmdlog.Printf("ShellCmd Init config :(%+v)\n", sh.ShellConfig)
+	sh.sessions = make(map[string]*shellSession)
+	cmdlog.Printf("ShellCmd Init ok\n")
+	return nil
+}
+
+// Reload
+// applies to sessions opened afterwards.
+func (sh *ShellCmd) Reload(config interface{}) error {
+	newConf := config.(*ShellConfig)
+	if err := newConf.validate(); err != nil {
+		return err
+	}
+	sh.confLock.Lock()
+	sh.ShellConfig = newConf
+	sh.confLock.Unlock()
+	return nil
+}
+
+func (sh *ShellCmd) config() *ShellConfig {
+	sh.confLock.RLock()
+	defer sh.confLock.RUnlock()
+	return sh.ShellConfig
+}
+
+func shellOp(query url.Values) string {
+	if op := query.Get("op"); op != "" {
+		return strings.ToLower(op)
+	}
+	return "open"
+}
+
+func (sh *ShellCmd) DescribeRequest(req *http.Request) (string, []string, error) {
+	query := req.URL.Query()
+	op := shellOp(query)
+	switch op {
+	case "open":
+		args := query["args"]
+		if len(args) == 0 {
+			args = sh.config().Shell
+		}
+		return op, args, nil
+	case "kill":
+		return op, []string{query.Get("id")}, nil
+	}
+	return op, nil, nil
+}
+
+func (sh *ShellCmd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	ioutil.ReadAll(req.Body)
+
+	query := req.URL.Query()
+	switch op := shellOp(query); op {
+	case "open":
+		sh.open(w, req, query)
+	case "sessions":
+		data, _ := json.Marshal(sh.list(cmds.Caller(req)))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, string(data))
+	case "kill":
+		id := query.Get("id")
+		sh.lock.Lock()
+		s, ok := sh.sessions[id]
+		sh.lock.Unlock()
+		if !ok {
+			http.Error(w, fmt.Sprintf("session %s not found", id), http.StatusInternalServerError)
+			return
+		}
+		caller := cmds.Caller(req)
+		if !sessionAdmin(s, caller) {
+			http.Error(w, fmt.Sprintf("session %s belongs to %s", id, s.Caller), http.StatusForbidden)
+			return
+		}
+		s.kill("killed by " + caller)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "session %s killed\n", id)
+	default:
+		cmdlog.EPrintln("method not implemented")
+		http.Error(w, fmt.Sprintf("server do not support command %s", op), http.StatusNotImplemented)
+	}
+}
+
+func queryInt(query url.Values, name string, def int) (int, error) {
+	val := query.Get(name)
+	if val == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 || n > 0xffff {
+		return 0, fmt.Errorf("bad %s %s", name, val)
+	}
+	return n, nil
+}
+
+// open
+// checks the command against the syscmd policy, starts it on a new pty
+// and serves the session until it ends.
+func (sh *ShellCmd) open(w http.ResponseWriter, req *http.Request, query url.Values) {
+	conf := sh.config()
+	if err := checkOrigin(req, conf.Origins); err != nil {
+		cmdlog.EPrintf("shell from %s: %s\n", req.RemoteAddr, err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	args := query["args"]
+	if len(args) == 0 {
+		args = conf.Shell
+	}
+	spec, err := sh.sc.checkPolicy(args)
+	if err != nil {
+		if _, ok := err.(*PolicyError); ok {
+			cmdlog.EPrintf("%s, shell %v\n", err.Error(), args)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !isWebsocket(req) {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	cols, err := queryInt(query, "cols", 80)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows, err := queryInt(query, "rows", 24)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	record := conf.RecordAll
+	if val := query.Get("record"); val != "" && !record {
+		if record, err = strconv.ParseBool(val); err != nil {
+			http.Error(w, "bad record "+val, http.StatusBadRequest)
+			return
+		}
+		if record && conf.RecordDir == "" {
+			http.Error(w, "session recording is not configured", http.StatusBadRequest)
+			return
+		}
+	}
+
+	s := &shellSession{SessionStatus: SessionStatus{Id: newJobId(), Args: append([]string(nil), args...),
+		Caller: cmds.Caller(req), Remote: req.RemoteAddr, StartTime: time.Now().UTC()},
+		idle: conf.IdleTimeout.Duration, done: make(chan struct{}), outputDone: make(chan struct{})}
+	if record {
+		s.Record = filepath.Join(conf.RecordDir, s.StartTime.Format("20060102-150405")+"-"+s.Id+".cast")
+		if s.rec, err = newRecorder(s.Record, s, conf.Term, cols, rows); err != nil {
+			cmdlog.EPrintf("shell session %s record: %s\n", s.Id, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err = sh.start(s, spec, conf, cols, rows); err != nil {
+		cmdlog.EPrintf("shell %v: %s\n", args, err.Error())
+		s.rec.Close()
+		if s.rec != nil {
+			os.Remove(s.Record)
+		}
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer sh.remove(s)
+	if s.ws, err = wsUpgrade(w, req, conf.MaxMessage); err != nil {
+		cmdlog.EPrintf("shell session %s: %s\n", s.Id, err.Error())
+		s.kill("websocket upgrade failed")
+		<-s.done
+		s.rec.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cmdlog.Printf("shell session %s opened by %s %s, pid %d, args %v, rule %s\n", s.Id, s.Caller,
+		s.Remote, s.Pid, s.Args, spec.Rule)
+	s.serve()
+}
+
+// start
+// starts the session if the limit allows, it is listed from then on.
+func (sh *ShellCmd) start(s *shellSession, spec *execSpec, conf *ShellConfig, cols, rows int) error {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if len(sh.sessions) >= conf.MaxSessions {
+		return fmt.Errorf("too many shell sessions, limit %d", conf.MaxSessions)
+	}
+	if err := s.start(spec, conf.Term, cols, rows); err != nil {
+		return err
+	}
+	sh.sessions[s.Id] = s
+	return nil
+}
+
+func (sh *ShellCmd) remove(s *shellSession) {
+	sh.lock.Lock()
+	delete(sh.sessions, s.Id)
+	sh.lock.Unlock()
+}
+
+// sessionAdmin
+// whether caller may see and end s, its own sessions or any with the
+// shell:admin permission.
+func sessionAdmin(s *shellSession, caller string) bool {
+	return s.Caller == caller || cmds.Permitted(caller, "shell", "admin")
+}
+
+// list
+// the sessions caller may see.
+func (sh *ShellCmd) list(caller string) []SessionStatus {
+	sh.lock.Lock()
+	res := make([]SessionStatus, 0, len(sh.sessions))
+	for _, s := range sh.sessions {
+		if !sessionAdmin(s, caller) {
+			continue
+		}
+		st := s.SessionStatus
+		st.Idle = time.Since(time.Unix(0, atomic.LoadInt64(&s.lastInput))).Seconds()
+		res = append(res, st)
+	}
+	sh.lock.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].StartTime.Before(res[j].StartTime) })
+	return res
+}
+
+func (sh *ShellCmd) Stats() []cmds.Metric {
+	sh.lock.Lock()
+	n := len(sh.sessions)
+	sh.lock.Unlock()
+	return []cmds.Metric{{Name: "cmdserver_shell_sessions", Help: "Open shell sessions.",
+		Type: "gauge", Value: float64(n)}}
+}
+
+// start
+// runs spec as the session leader of a new pty.
+func (s *shellSession) start(spec *execSpec, term string, cols, rows int) error {
+	ptmx, tty, err := openPty()
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+	if err = setWinsize(ptmx, cols, rows); err != nil {
+		ptmx.Close()
+		return err
+	}
+	env := spec.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd := exec.Command(spec.Path, spec.Args...)
+	cmd.Args[0] = s.Args[0]
+	cmd.Dir = spec.Dir
+	cmd.Env = append(append([]string(nil), env...), "TERM="+term)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0, Credential: spec.Cred}
+	if err = cmd.Start(); err != nil {
+		ptmx.Close()
+		return err
+	}
+	s.cmd, s.ptmx, s.Pid = cmd, ptmx, cmd.Process.Pid
+	atomic.StoreInt64(&s.lastInput, time.Now().UnixNano())
+	go func() {
+		cmd.Wait()
+		close(s.done)
+	}()
+	return nil
+}
+
+// kill
+// hangs up the session, whatever is left of it is killed a few seconds
+// later.
+func (s *shellSession) kill(reason string) {
+	s.killOnce.Do(func() {
+		cmdlog.Printf("shell session %s %s\n", s.Id, reason)
+		syscall.Kill(-s.Pid, syscall.SIGHUP)
+		go func() {
+			select {
+			case <-s.done:
+			case <-time.After(3 * time.Second):
+				syscall.Kill(-s.Pid, syscall.SIGKILL)
+			}
+		}()
+	})
+}
+
+// serve
+// relays the terminal both ways until the command exits or the client
+// goes away.
+func (s *shellSession) serve() {
+	go s.output()
+	go s.input()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	timedOut := false
+wait:
+	for {
+		select {
+		case <-s.done:
+			break wait
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&s.lastInput))
+			if !timedOut && time.Since(last) > s.idle {
+				timedOut = true
+				s.send(&shellMessage{Op: "timeout", Reason: fmt.Sprintf("idle for %s", s.idle)})
+				s.kill("idle timeout")
+			}
+		}
+	}
+	// the output still buffered in the pty, a leftover background process
+	// holding the terminal does not keep the session open.
+	select {
+	case <-s.outputDone:
+	case <-time.After(time.Second):
+	}
+	exitCode := -1
+	msg := &shellMessage{Op: "exit", ExitCode: &exitCode}
+	if ps := s.cmd.ProcessState; ps != nil {
+		if ws, ok := ps.Sys().(syscall.WaitStatus); ok {
+			exitCode = ws.ExitStatus()
+			if ws.Signaled() {
+				msg.Signal = ws.Signal().String()
+			}
+		}
+	}
+	s.send(msg)
+	s.ws.Close(wsCloseNormal, "")
+	s.ptmx.Close()
+	syscall.Kill(-s.Pid, syscall.SIGHUP)
+	s.rec.Close()
+	cmdlog.Printf("shell session %s closed, exit code %d %s\n", s.Id, exitCode, msg.Signal)
+}
+
+func (s *shellSession) send(msg *shellMessage) {
+	data, _ := json.Marshal(msg)
+	s.ws.WriteMessage(wsText, data)
+}
+
+func (s *shellSession) output() {
+	defer close(s.outputDone)
+	buf := make([]byte, 32*1024)
+	var pending []byte
+	for {
+		n, err := s.ptmx.Read(buf)
+		if n > 0 {
+			if werr := s.ws.WriteMessage(wsBinary, buf[:n]); werr != nil {
+				s.kill("client gone")
+			}
+			pending = s.rec.event("o", append(pending, buf[:n]...))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *shellSession) input() {
+	var pending []byte
+	for {
+		opcode, data, err := s.ws.ReadMessage()
+		if err != nil {
+			s.kill("client gone")
+			return
+		}
+		atomic.StoreInt64(&s.lastInput, time.Now().UnixNano())
+		if opcode == wsText {
+			msg := &shellMessage{}
+			if err = json.Unmarshal(data, msg); err != nil {
+				s.send(&shellMessage{Op: "error", Reason: err.Error()})
+				continue
+			}
+			switch msg.Op {
+			case "resize":
+				if msg.Cols <= 0 || msg.Rows <= 0 || msg.Cols > 0xffff || msg.Rows > 0xffff {
+					s.send(&shellMessage{Op: "error", Reason: "bad terminal size"})
+					continue
+				}
+				setWinsize(s.ptmx, msg.Cols, msg.Rows)
+				s.rec.event("r", []byte(fmt.Sprintf("%dx%d", msg.Cols, msg.Rows)))
+				continue
+			case "input":
+				data = []byte(msg.Data)
+			default:
+				s.send(&shellMessage{Op: "error", Reason: "unknown op " + msg.Op})
+				continue
+			}
+		}
+		if _, err = s.ptmx.Write(data); err != nil {
+			return
+		}
+		pending = s.rec.event("i", append(pending, data...))
+	}
+}
+
+// recorder
+// writes a session in the asciicast v2 format, one JSON header line and
+// one [time, type, data] line per event.
+type recorder struct {
+	mu    sync.Mutex
+	file  *os.File
+	start time.Time
+}
+
+func newRecorder(path string, s *shellSession, term string, cols, rows int) (*recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	header, _ := json.Marshal(map[string]interface{}{"version": 2, "width": cols, "height": rows,
+		"timestamp": s.StartTime.Unix(), "title": strings.Join(s.Args, " "),
+		"env":       map[string]string{"TERM": term, "SHELL": s.Args[0]},
+		"cmdserver": map[string]string{"id": s.Id, "caller": s.Caller, "remote": s.Remote}})
+	if _, err = fmt.Fprintf(file, "%s\n", header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &recorder{file: file, start: time.Now()}, nil
+}
+
+// event
+// records data up to its last complete utf-8 sequence, the rest is
+// returned to be prepended to the next chunk of the same stream.
+func (rec *recorder) event(kind string, data []byte) []byte {
+	if rec == nil {
+		return nil
+	}
+	n := len(data)
+	for i := 1; i <= utf8.UTFMax && i <= len(data); i++ {
+		if r := data[len(data)-i]; r < utf8.RuneSelf || utf8.RuneStart(r) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				n = len(data) - i
+			}
+			break
+		}
+	}
+	if n > 0 {
+		line, _ := json.Marshal([]interface{}{time.Since(rec.start).Seconds(), kind, string(data[:n])})
+		rec.mu.Lock()
+		rec.file.Write(append(line, '\n'))
+		rec.mu.Unlock()
+	}
+	return append([]byte(nil), data[n:]...)
+}
+
+func (rec *recorder) Close() {
+	if rec != nil {
+		rec.file.Close()
+	}
+}
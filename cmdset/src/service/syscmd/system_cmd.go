@@ -4,30 +4,38 @@ import (
 	"bufio"
 	"cmdproto"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
-	"os/exec"
 	"service/cmdlog"
 	"service/cmds"
+	"strconv"
 	"strings"
-	"sync/atomic"
+	"sync"
 	"time"
 )
 
 type SysCmdConfig struct {
-	SysRequestPoolSize int `toml:"request_pool_size"`
-	DiskLeftNotify     int `toml:"disk_left_notify"`
+	SysRequestPoolSize int           `toml:"request_pool_size"`
+	DiskLeftNotify     int           `toml:"disk_left_notify"`
+	MaxJobs            int           `toml:"max_jobs"`
+	JobOutputLimit     int           `toml:"job_output_limit"`
+	JobRetain          cmds.Duration `toml:"job_retain"`
+	MonitorInterval    cmds.Duration `toml:"monitor_interval"`
+	Policy             PolicyConfig  `toml:"policy"`
+	Limits             LimitsConfig  `toml:"limits"`
 }
 
 type SystemCmd struct {
 	*SysCmdConfig
-	cmdHandlers  map[string]func(sc *SystemCmd, req *cmdproto.SysRequest) (interface{}, error)
-	cmdReqPool   chan *cmdproto.SysRequest
-	diskMonCh    chan bool
-	diskMonState int32
+	cmdHandlers map[string]func(sc *SystemCmd, req *cmdproto.SysRequest) (interface{}, error)
+	cmdReqPool  chan *cmdproto.SysRequest
+	jobs        *jobRegistry
+	monitors    *monitorRegistry
+	policy      *policy
+	confLock    sync.RWMutex
 }
 
 func (sc *SystemCmd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -43,6 +51,7 @@ func (sc *SystemCmd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	sysReq := sc.getAvalibleReq()
 
 	defer sc.recycle(sysReq)
+	*sysReq = cmdproto.SysRequest{}
 	err = json.Unmarshal(data, sysReq)
 	if err != nil {
 		cmdlog.EPrintf("%s\n", err.Error())
@@ -53,9 +62,18 @@ func (sc *SystemCmd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if handler, ok := sc.cmdHandlers[op]; ok {
 		res, err := handler(sc, sysReq)
 		if err != nil {
+			if _, ok := err.(*PolicyError); ok {
+				cmdlog.EPrintf("%s, request %v\n", err.Error(), sysReq.Args)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if jr, ok := res.(*jobReader); ok {
+			w.Header().Set("X-Job-Id", jr.job.Id)
+			w.Header().Set("Trailer", exitTrailers)
+		}
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
 		switch res.(type) {
@@ -68,18 +86,9 @@ func (sc *SystemCmd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		case int:
 			fmt.Fprintln(w, res.(int))
 		case io.ReadCloser:
-			stdout := res.(io.ReadCloser)
-			defer stdout.Close()
-			reader := bufio.NewReader(stdout)
-			for {
-				line, err := reader.ReadBytes('\n')
-				if err != nil {
-					cmdlog.EPrintf("err:%s\n", err.Error())
-					break
-				}
-				// fmt.Println("%s is executing...", sysReq.Op)
-				fmt.Fprintf(w, "%s", string(line))
-				w.(http.Flusher).Flush()
+			complete := streamOutput(w, req, res.(io.ReadCloser))
+			if jr, ok := res.(*jobReader); ok && complete {
+				writeExitStatus(w, jr)
 			}
 		}
 	} else {
@@ -89,14 +98,109 @@ func (sc *SystemCmd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+const exitTrailers = "X-Cmd-State, X-Cmd-Exit-Code, X-Cmd-Signal, X-Cmd-Limit, X-Cmd-Wall-Time, X-Cmd-Rusage"
+
+// streamOutput
+// relays rc to the client line by line, it reports whether rc was read to
+// the end. a dropped client only detaches the reader, the job keeps running.
+func streamOutput(w http.ResponseWriter, req *http.Request, rc io.ReadCloser) bool {
+	defer rc.Close()
+	w.(http.Flusher).Flush()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-req.Context().Done():
+			rc.Close()
+		case <-done:
+		}
+	}()
+	reader := bufio.NewReader(rc)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			fmt.Fprintf(w, "%s", string(line))
+			w.(http.Flusher).Flush()
+		}
+		if err != nil {
+			if err != io.EOF {
+				cmdlog.EPrintf("err:%s\n", err.Error())
+				return false
+			}
+			return true
+		}
+	}
+}
+
+// writeExitStatus
+// sets the exit trailers and, if asked for, writes the footer line.
+func writeExitStatus(w http.ResponseWriter, jr *jobReader) {
+	es := jr.job.ExitStatus()
+	rusage, _ := json.Marshal(es.Rusage)
+	w.Header().Set("X-Cmd-State", es.State)
+	w.Header().Set("X-Cmd-Exit-Code", strconv.Itoa(es.ExitCode))
+	w.Header().Set("X-Cmd-Signal", es.Signal)
+	w.Header().Set("X-Cmd-Limit", es.Limit)
+	w.Header().Set("X-Cmd-Wall-Time", strconv.FormatFloat(es.WallTime, 'f', 3, 64))
+	w.Header().Set("X-Cmd-Rusage", string(rusage))
+	if jr.footer {
+		footer, _ := json.Marshal(es)
+		if !jr.endedLine() {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s%s\n", cmdproto.ExitFooterPrefix, string(footer))
+	}
+}
+
+func (sc *SystemCmd) DescribeRequest(req *http.Request) (string, []string, error) {
+	data, err := cmds.PeekBody(req)
+	if err != nil {
+		return "", nil, err
+	}
+	sysReq := &cmdproto.SysRequest{}
+	if err = json.Unmarshal(data, sysReq); err != nil {
+		return "", nil, err
+	}
+	return strings.ToLower(sysReq.Op), sysReq.Args, nil
+}
+
 func (sc *SystemCmd) ConfigStruct() interface{} {
 	return &SysCmdConfig{SysRequestPoolSize: 100,
-		DiskLeftNotify: 10}
+		DiskLeftNotify:  10,
+		MaxJobs:         64,
+		JobOutputLimit:  1 << 20,
+		JobRetain:       cmds.Duration{Duration: time.Hour},
+		MonitorInterval: cmds.Duration{Duration: 10 * time.Second}}
+}
+
+// validate
+// checks what Init and Reload both take, the policy is compiled apart.
+func (conf *SysCmdConfig) validate() error {
+	if conf.MaxJobs <= 0 || conf.JobOutputLimit <= 0 {
+		return errors.New("max_jobs and job_output_limit must be positive")
+	}
+	if conf.MonitorInterval.Duration <= 0 {
+		return errors.New("monitor_interval must be positive")
+	}
+	return conf.Limits.validate()
 }
 
 func (sc *SystemCmd) Init(config interface{}) (err error) {
 	sc.SysCmdConfig = config.(*SysCmdConfig)
 	cmdlog.Printf("SystemCmd Init config :(%+v)\n", sc.SysCmdConfig)
+	if err = sc.validate(); err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+	sc.policy, err = newPolicy(&sc.Policy)
+	if err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
+	if err = sc.Limits.setupCgroup(); err != nil {
+		cmdlog.EPrintln(err.Error())
+		return err
+	}
 
 	sc.cmdHandlers = make(map[string]func(sc *SystemCmd, req *cmdproto.SysRequest) (interface{}, error))
 	sc.cmdReqPool = make(chan *cmdproto.SysRequest, sc.SysRequestPoolSize)
@@ -104,77 +208,255 @@ func (sc *SystemCmd) Init(config interface{}) (err error) {
 	for i := 0; i < sc.SysRequestPoolSize; i++ {
 		sc.cmdReqPool <- new(cmdproto.SysRequest)
 	}
-	sc.diskMonCh = make(chan bool)
-	sc.diskMonState = 0
+	sc.monitors = newMonitorRegistry()
+	sc.jobs = newJobRegistry(sc.MaxJobs, sc.JobOutputLimit, sc.JobRetain.Duration)
 
 	//todo:
 	sc.register("monitor", monitorHandler)
 	sc.register("syscmd", syscmdHandler)
+	sc.register("submit", submitHandler)
+	sc.register("status", statusHandler)
+	sc.register("result", resultHandler)
+	sc.register("follow", followHandler)
+	sc.register("cancel", cancelHandler)
+	sc.register("jobs", jobsHandler)
+	sc.register("unmonitor", unmonitorHandler)
+	sc.register("monitors", monitorsHandler)
 	cmdlog.Printf("SystemCmd Init ok\n")
 	return nil
 }
 
-func diskMon(sc *SystemCmd) {
-	ticker := time.NewTicker(time.Second * 10)
-	atomic.StoreInt32(&sc.diskMonState, 1)
-	defer func() {
-		ticker.Stop()
-		atomic.StoreInt32(&sc.diskMonState, 0)
-	}()
-
-	stop := false
-	addrs, _ := net.InterfaceAddrs()
-	for {
-		select {
-		case <-ticker.C:
-			diskInfo := cmds.DiskUsage("/")
-			diskLeft := int(float64(diskInfo.Free) / float64(diskInfo.All) * 100)
-			if diskLeft < sc.DiskLeftNotify {
-				for i := 0; i < 5; i++ {
-					cmds.SendMail("Disk Usage", fmt.Sprintf("[%s]---(%+v)---Disk left %d%%, please clear mongo data!", time.Now().UTC().String(), addrs, diskLeft))
-				}
-				stop = true
-			}
-		}
-		if stop == true {
-			break
+// Reload
+// swaps in a new config once its policy compiles. request_pool_size only
+// changes on restart, running jobs and monitors are kept.
+func (sc *SystemCmd) Reload(config interface{}) error {
+	newConf := config.(*SysCmdConfig)
+	if err := newConf.validate(); err != nil {
+		return err
+	}
+	p, err := newPolicy(&newConf.Policy)
+	if err != nil {
+		return err
+	}
+	if newConf.Limits.Cgroup != sc.config().Limits.Cgroup {
+		if err = newConf.Limits.setupCgroup(); err != nil {
+			return err
 		}
 	}
+	sc.confLock.Lock()
+	defer sc.confLock.Unlock()
+	if newConf.SysRequestPoolSize != sc.SysRequestPoolSize {
+		cmdlog.EPrintf("SystemCmd request_pool_size change needs a restart\n")
+		newConf.SysRequestPoolSize = sc.SysRequestPoolSize
+	}
+	sc.jobs.setLimits(newConf.MaxJobs, newConf.JobOutputLimit, newConf.JobRetain.Duration)
+	sc.SysCmdConfig = newConf
+	sc.policy = p
+	return nil
+}
+
+// Stats
+// pool occupancy, jobs and monitors by state, and the last value of every
+// monitor.
+func (sc *SystemCmd) Stats() []cmds.Metric {
+	res := cmds.PoolStats("syscmd", cap(sc.cmdReqPool), len(sc.cmdReqPool))
+	jobStates := map[string]int{jobRunning: 0, jobExited: 0, jobFailed: 0, jobCanceled: 0, jobKilled: 0}
+	for _, job := range sc.jobs.list() {
+		jobStates[job.State]++
+	}
+	for state, n := range jobStates {
+		res = append(res, cmds.Metric{Name: "cmdserver_jobs", Help: "Jobs kept by syscmd by state.",
+			Type: "gauge", Labels: map[string]string{"state": state}, Value: float64(n)})
+	}
+	monStates := map[string]int{monitorOk: 0, monitorFiring: 0, monitorUnknown: 0}
+	for _, mon := range sc.monitors.list() {
+		monStates[mon.State]++
+		res = append(res, cmds.Metric{Name: "cmdserver_monitor_value", Help: "Last value sampled by a monitor.",
+			Type: "gauge", Labels: map[string]string{"id": mon.Id, "type": mon.Type}, Value: mon.Value})
+		res = append(res, cmds.Metric{Name: "cmdserver_monitor_threshold", Help: "Threshold of a monitor.",
+			Type: "gauge", Labels: map[string]string{"id": mon.Id, "type": mon.Type}, Value: mon.Threshold})
+	}
+	for state, n := range monStates {
+		res = append(res, cmds.Metric{Name: "cmdserver_monitors", Help: "Running monitors by state.",
+			Type: "gauge", Labels: map[string]string{"state": state}, Value: float64(n)})
+	}
+	return res
+}
 
-	return
+func (sc *SystemCmd) config() *SysCmdConfig {
+	sc.confLock.RLock()
+	defer sc.confLock.RUnlock()
+	return sc.SysCmdConfig
 }
 
+// monitorHandler
+// starts a monitor, args are the monitor type and an optional target such
+// as the mountpoint of a disk or inode monitor.
 func monitorHandler(sc *SystemCmd, req *cmdproto.SysRequest) (interface{}, error) {
-	resourceType := strings.ToLower(req.Args[0])
-	if resourceType == "disk" {
-		state := atomic.LoadInt32(&sc.diskMonState)
-		if state > 0 {
-			return "disk monitor has started", nil
+	if len(req.Args) == 0 {
+		return nil, errors.New("without specify monitor type")
+	}
+	interval := sc.config().MonitorInterval.Duration
+	if req.Options.Interval != "" {
+		var err error
+		if interval, err = time.ParseDuration(req.Options.Interval); err != nil {
+			return nil, err
 		}
-		go diskMon(sc)
-	} else if resourceType == "mem" {
-		//todo
-	} else {
-		//todo:
 	}
-	return "monitor start ok.", nil
+	target := ""
+	if len(req.Args) > 1 {
+		target = req.Args[1]
+	}
+	m, started, err := sc.monitors.start(sc, strings.ToLower(req.Args[0]), target, req.Options.Threshold, interval)
+	if err != nil {
+		return nil, err
+	}
+	if !started {
+		return fmt.Sprintf("monitor %s has started.", m.Status().Id), nil
+	}
+	return fmt.Sprintf("monitor %s started.", m.Status().Id), nil
 }
 
+// unmonitorHandler
+// stops the monitor with the id listed by monitors, or given as type and
+// target.
+func unmonitorHandler(sc *SystemCmd, req *cmdproto.SysRequest) (interface{}, error) {
+	if len(req.Args) == 0 {
+		return nil, errors.New("without specify monitor")
+	}
+	id := req.Args[0]
+	if len(req.Args) > 1 {
+		id = monitorId(strings.ToLower(id), req.Args[1])
+	} else if mt, ok := monitorTypes[strings.ToLower(id)]; ok {
+		id = monitorId(mt.Name, mt.Target)
+	}
+	if err := sc.monitors.stop(id); err != nil {
+		return nil, err
+	}
+	return fmt.Sprintf("monitor %s stopped.", id), nil
+}
+
+func monitorsHandler(sc *SystemCmd, req *cmdproto.SysRequest) (interface{}, error) {
+	return json.Marshal(sc.monitors.list())
+}
+
+// syscmdHandler
+// runs the command as a job and streams its stdout, the job output stays
+// available through the job ops if the client goes away.
 func syscmdHandler(sc *SystemCmd, req *cmdproto.SysRequest) (interface{}, error) {
 	cmdlog.Println(req)
-	cmdType := strings.ToLower(req.Args[0])
-	cmd := exec.Command(cmdType, req.Args[1:]...)
-	stdout, err := cmd.StdoutPipe()
+	mask, err := outputMask(&req.Options)
 	if err != nil {
-		cmdlog.EPrintln(err.Error())
 		return nil, err
 	}
-	if err := cmd.Start(); err != nil {
-		cmdlog.EPrintln(err.Error())
+	job, err := sc.startJob(req.Args, &req.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	return job.Follow(mask, req.Options.Footer), nil
+}
+
+// startJob
+// starts args as a job if the policy allows it and the limits asked for
+// by opts are within the ceilings.
+func (sc *SystemCmd) startJob(args []string, opts *cmdproto.SysOptions) (*Job, error) {
+	spec, err := sc.checkPolicy(args)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := resolveLimits(&sc.config().Limits, opts)
+	if err != nil {
+		return nil, err
+	}
+	return sc.jobs.start(spec, args, limits)
+}
+
+// checkPolicy
+// what the current policy allows args to run as.
+func (sc *SystemCmd) checkPolicy(args []string) (*execSpec, error) {
+	sc.confLock.RLock()
+	p := sc.policy
+	sc.confLock.RUnlock()
+	if p == nil {
+		return nil, errors.New("syscmd is not enabled")
+	}
+	return p.check(args)
+}
+
+func outputMask(opts *cmdproto.SysOptions) (int, error) {
+	switch opts.Stderr {
+	case "":
+		return streamStdout, nil
+	case "merge":
+		return streamStdout | streamStderr, nil
+	}
+	return 0, fmt.Errorf("invalid stderr option %s", opts.Stderr)
+}
+
+func submitHandler(sc *SystemCmd, req *cmdproto.SysRequest) (interface{}, error) {
+	cmdlog.Println(req)
+	job, err := sc.startJob(req.Args, &req.Options)
+	if err != nil {
 		return nil, err
 	}
+	return json.Marshal(job.Status())
+}
+
+// lookupJob
+// finds the job named by req.JobId, or by the first argument.
+func lookupJob(sc *SystemCmd, req *cmdproto.SysRequest) (*Job, error) {
+	id := req.JobId
+	if id == "" && len(req.Args) > 0 {
+		id = req.Args[0]
+	}
+	if id == "" {
+		return nil, errors.New("without specify job id")
+	}
+	return sc.jobs.get(id)
+}
+
+func statusHandler(sc *SystemCmd, req *cmdproto.SysRequest) (interface{}, error) {
+	job, err := lookupJob(sc, req)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(job.Status())
+}
+
+func resultHandler(sc *SystemCmd, req *cmdproto.SysRequest) (interface{}, error) {
+	job, err := lookupJob(sc, req)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(job.Result())
+}
+
+func followHandler(sc *SystemCmd, req *cmdproto.SysRequest) (interface{}, error) {
+	mask, err := outputMask(&req.Options)
+	if err != nil {
+		return nil, err
+	}
+	job, err := lookupJob(sc, req)
+	if err != nil {
+		return nil, err
+	}
+	return job.Follow(mask, req.Options.Footer), nil
+}
+
+func cancelHandler(sc *SystemCmd, req *cmdproto.SysRequest) (interface{}, error) {
+	job, err := lookupJob(sc, req)
+	if err != nil {
+		return nil, err
+	}
+	if err = job.Cancel(); err != nil {
+		return nil, err
+	}
+	return fmt.Sprintf("job %s canceled", job.Id), nil
+}
 
-	return stdout, nil
+func jobsHandler(sc *SystemCmd, req *cmdproto.SysRequest) (interface{}, error) {
+	return json.Marshal(sc.jobs.list())
 }
 func (sc *SystemCmd) register(cmd string, handler func(sc *SystemCmd, req *cmdproto.SysRequest) (interface{}, error)) {
 	if _, ok := sc.cmdHandlers[cmd]; ok {
@@ -196,4 +478,6 @@ func (sc *SystemCmd) recycle(req *cmdproto.SysRequest) {
 func init() {
 	scHandler := &SystemCmd{}
 	cmds.RegisterCmd("syscmd", scHandler)
+	// shell sessions run under the syscmd policy.
+	cmds.RegisterCmd("shell", &ShellCmd{sc: scHandler})
 }
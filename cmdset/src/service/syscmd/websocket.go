@@ -0,0 +1,266 @@
+package syscmd
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocket opcodes, RFC 6455 section 5.2.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// close codes, RFC 6455 section 7.4.1.
+const (
+	wsCloseNormal   = 1000
+	wsCloseProtocol = 1002
+	wsCloseTooBig   = 1009
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var errWsClosed = errors.New("websocket closed")
+
+// wsConn
+// the server side of a websocket. reads belong to one goroutine, writes
+// may come from any.
+type wsConn struct {
+	conn       net.Conn
+	rw         *bufio.ReadWriter
+	maxMessage int
+	writeLock  sync.Mutex
+	closeOnce  sync.Once
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isWebsocket
+// whether req asks for a websocket upgrade.
+func isWebsocket(req *http.Request) bool {
+	return headerContains(req.Header, "Connection", "upgrade") &&
+		headerContains(req.Header, "Upgrade", "websocket")
+}
+
+// checkOrigin
+// refuses browser requests from an origin not in allowed, clients that are
+// no browser send no Origin header.
+func checkOrigin(req *http.Request, allowed []string) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	for _, o := range allowed {
+		if strings.EqualFold(o, origin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s not allowed", origin)
+}
+
+// wsUpgrade
+// completes the opening handshake and takes the connection over from the
+// http server.
+func wsUpgrade(w http.ResponseWriter, req *http.Request, maxMessage int) (*wsConn, error) {
+	if req.Method != http.MethodGet {
+		return nil, errors.New("websocket upgrade needs GET")
+	}
+	if !isWebsocket(req) {
+		return nil, errors.New("not a websocket upgrade")
+	}
+	if req.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := req.Header.Get("Sec-Websocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, errors.New("bad Sec-WebSocket-Key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection can not be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, rw: rw, maxMessage: maxMessage}, nil
+}
+
+// readFrame
+// reads one frame and unmasks its payload, clients must mask.
+func (ws *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(ws.rw, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		return fin, opcode, nil, ws.fail(wsCloseProtocol, "reserved bits set")
+	}
+	if head[1]&0x80 == 0 {
+		return fin, opcode, nil, ws.fail(wsCloseProtocol, "unmasked client frame")
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.rw, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.rw, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsClose && (length > 125 || !fin) {
+		return fin, opcode, nil, ws.fail(wsCloseProtocol, "bad control frame")
+	}
+	if length > uint64(ws.maxMessage) {
+		return fin, opcode, nil, ws.fail(wsCloseTooBig, "frame too big")
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.rw, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.rw, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// ReadMessage
+// returns the next text or binary message, fragments are joined. pings
+// are answered, a close frame is echoed and ends the connection.
+func (ws *wsConn) ReadMessage() (opcode byte, data []byte, err error) {
+	for {
+		fin, op, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsPing:
+			ws.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			ws.Close(code, "")
+			return 0, nil, errWsClosed
+		case wsContinuation:
+			if opcode == 0 {
+				return 0, nil, ws.fail(wsCloseProtocol, "unexpected continuation frame")
+			}
+		case wsText, wsBinary:
+			if opcode != 0 {
+				return 0, nil, ws.fail(wsCloseProtocol, "interleaved data frame")
+			}
+			opcode = op
+		default:
+			return 0, nil, ws.fail(wsCloseProtocol, fmt.Sprintf("unknown opcode %d", op))
+		}
+		if len(data)+len(payload) > ws.maxMessage {
+			return 0, nil, ws.fail(wsCloseTooBig, "message too big")
+		}
+		data = append(data, payload...)
+		if fin {
+			return opcode, data, nil
+		}
+	}
+}
+
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	head := make([]byte, 2, 10)
+	head[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		head[1] = byte(n)
+	case n <= 0xffff:
+		head[1] = 126
+		head = head[:4]
+		binary.BigEndian.PutUint16(head[2:], uint16(n))
+	default:
+		head[1] = 127
+		head = head[:10]
+		binary.BigEndian.PutUint64(head[2:], uint64(n))
+	}
+	ws.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if _, err := ws.rw.Write(head); err != nil {
+		return err
+	}
+	if _, err := ws.rw.Write(payload); err != nil {
+		return err
+	}
+	return ws.rw.Flush()
+}
+
+func (ws *wsConn) WriteMessage(opcode byte, data []byte) error {
+	return ws.writeFrame(opcode, data)
+}
+
+// fail
+// closes the connection after a protocol error.
+func (ws *wsConn) fail(code int, reason string) error {
+	ws.Close(code, reason)
+	return errors.New("websocket: " + reason)
+}
+
+// Close
+// sends the close frame and closes the connection, only the first call
+// does anything.
+func (ws *wsConn) Close(code int, reason string) {
+	ws.closeOnce.Do(func() {
+		payload := make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
+		ws.writeFrame(wsClose, append(payload, reason...))
+		ws.conn.Close()
+	})
+}
@@ -0,0 +1,192 @@
+package syscmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// clientFrame
+// a frame as a client sends it, masked unless told otherwise.
+func clientFrame(fin bool, opcode byte, payload []byte, masked bool) []byte {
+	head := opcode
+	if fin {
+		head |= 0x80
+	}
+	frame := []byte{head, 0}
+	switch n := len(payload); {
+	case n < 126:
+		frame[1] = byte(n)
+	case n <= 0xffff:
+		frame[1] = 126
+		frame = append(frame, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(n))
+	default:
+		frame[1] = 127
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[2:], uint64(n))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	frame[1] |= 0x80
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func closeFrame(code int) []byte {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return clientFrame(true, wsClose, payload, true)
+}
+
+// serverFrames
+// splits what the server wrote into opcode and payload pairs.
+func serverFrames(t *testing.T, data []byte) (ops []byte, payloads [][]byte) {
+	for len(data) > 0 {
+		if len(data) < 2 || data[1]&0x80 != 0 {
+			t.Fatalf("bad server frame % x", data)
+		}
+		ops = append(ops, data[0]&0x0f)
+		n := int(data[1] & 0x7f)
+		data = data[2:]
+		if n == 126 {
+			n, data = int(binary.BigEndian.Uint16(data)), data[2:]
+		}
+		payloads = append(payloads, data[:n])
+		data = data[n:]
+	}
+	return ops, payloads
+}
+
+func TestReadMessage(t *testing.T) {
+	long := bytes.Repeat([]byte("x"), 150)
+	tests := []struct {
+		name     string
+		frames   [][]byte
+		messages []string
+		err      string
+		replies  []byte
+		code     int
+	}{
+		{name: "text",
+			frames:   [][]byte{clientFrame(true, wsText, []byte("hi"), true), closeFrame(wsCloseNormal)},
+			messages: []string{"hi"}, err: errWsClosed.Error(), replies: []byte{wsClose}, code: wsCloseNormal},
+		{name: "extended length",
+			frames:   [][]byte{clientFrame(true, wsBinary, long, true), closeFrame(wsCloseNormal)},
+			messages: []string{string(long)}, err: errWsClosed.Error(), replies: []byte{wsClose}, code: wsCloseNormal},
+		{name: "fragments around a ping",
+			frames: [][]byte{clientFrame(false, wsBinary, []byte("ab"), true), clientFrame(true, wsPing, []byte("p"), true),
+				clientFrame(true, wsContinuation, []byte("cd"), true), closeFrame(4000)},
+			messages: []string{"abcd"}, err: errWsClosed.Error(), replies: []byte{wsPong, wsClose}, code: 4000},
+		{name: "unmasked",
+			frames: [][]byte{clientFrame(true, wsText, []byte("hi"), false)},
+			err:    "unmasked client frame", replies: []byte{wsClose}, code: wsCloseProtocol},
+		{name: "reserved bits",
+			frames: [][]byte{append([]byte{0xc1}, clientFrame(true, wsText, nil, true)[1:]...)},
+			err:    "reserved bits set", replies: []byte{wsClose}, code: wsCloseProtocol},
+		{name: "frame too big",
+			frames: [][]byte{clientFrame(true, wsText, bytes.Repeat(long, 2), true)},
+			err:    "frame too big", replies: []byte{wsClose}, code: wsCloseTooBig},
+		{name: "message too big",
+			frames: [][]byte{clientFrame(false, wsText, long, true), clientFrame(true, wsContinuation, long, true)},
+			err:    "message too big", replies: []byte{wsClose}, code: wsCloseTooBig},
+		{name: "continuation first",
+			frames: [][]byte{clientFrame(true, wsContinuation, []byte("x"), true)},
+			err:    "unexpected continuation frame", replies: []byte{wsClose}, code: wsCloseProtocol},
+		{name: "interleaved",
+			frames: [][]byte{clientFrame(false, wsText, []byte("a"), true), clientFrame(true, wsBinary, []byte("b"), true)},
+			err:    "interleaved data frame", replies: []byte{wsClose}, code: wsCloseProtocol},
+		{name: "fragmented ping",
+			frames: [][]byte{clientFrame(false, wsPing, []byte("p"), true)},
+			err:    "bad control frame", replies: []byte{wsClose}, code: wsCloseProtocol},
+		{name: "unknown opcode",
+			frames: [][]byte{clientFrame(true, 0x3, nil, true)},
+			err:    "unknown opcode 3", replies: []byte{wsClose}, code: wsCloseProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			ws := &wsConn{conn: server, rw: bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)),
+				maxMessage: 200}
+			go func() {
+				for _, frame := range tt.frames {
+					if _, err := client.Write(frame); err != nil {
+						return
+					}
+				}
+			}()
+			replies := make(chan []byte)
+			go func() {
+				data, _ := ioutil.ReadAll(client)
+				replies <- data
+			}()
+
+			var messages []string
+			var err error
+			for {
+				var data []byte
+				if _, data, err = ws.ReadMessage(); err != nil {
+					break
+				}
+				messages = append(messages, string(data))
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+			if strings.Join(messages, "|") != strings.Join(tt.messages, "|") {
+				t.Fatalf("messages %q, want %q", messages, tt.messages)
+			}
+			ops, payloads := serverFrames(t, <-replies)
+			if !bytes.Equal(ops, tt.replies) {
+				t.Fatalf("replies % x, want % x", ops, tt.replies)
+			}
+			last := payloads[len(payloads)-1]
+			if code := int(binary.BigEndian.Uint16(last)); code != tt.code {
+				t.Fatalf("close code %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func originRequest(origin string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/shell", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	return req
+}
+
+func TestCheckOrigin(t *testing.T) {
+	allowed := []string{"https://console.example.com"}
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{"https://console.example.com", true},
+		{"HTTPS://Console.Example.com", true},
+		{"https://evil.example.com", false},
+		{"https://console.example.com.evil.com", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		req := originRequest(tt.origin)
+		if err := checkOrigin(req, allowed); (err == nil) != tt.ok {
+			t.Errorf("origin %q: %v, want ok %v", tt.origin, err, tt.ok)
+		}
+	}
+	if err := checkOrigin(originRequest("https://console.example.com"), nil); err == nil {
+		t.Error("browser origin allowed without origins configured")
+	}
+}